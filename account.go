@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/codegangsta/martini-contrib/sessions"
+	"github.com/codegangsta/martini-contrib/web"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Users send this to confirm that they really want to delete their accounts.
+const AccountDeletionConfirmation = "delete my account"
+
+// AccountProfile is the user in an account dump.
+type AccountProfile struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Identities []Identity `json:"identities"`
+	Settings   *Settings  `json:"settings"`
+}
+
+func profileOf(user *User) *AccountProfile {
+	return &AccountProfile{
+		Id:         user.Id.Hex(),
+		Name:       user.Name,
+		Identities: user.Identities,
+		Settings:   settingsOf(user),
+	}
+}
+
+// writeAccountDump writes everything about the user as a JSON object:
+//
+//	{"exportedAt": "...", "profile": {...}, "entries": [...]}
+//
+// Entries are written one by one so that they are never all in memory.
+func writeAccountDump(w io.Writer, entries EntryStore, user *User, now time.Time) error {
+	exportedAt, err := json.Marshal(now)
+	if err != nil {
+		return err
+	}
+	profile, err := json.Marshal(profileOf(user))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, `{"exportedAt":%s,"profile":%s,"entries":[`, exportedAt, profile)
+	if err != nil {
+		return err
+	}
+
+	separator := ""
+	err = eachEntry(entries, user, func(entry *Entry) error {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s%s", separator, data)
+		separator = ","
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+// deleteAccount removes the user and everything of theirs. The user is
+// removed last so that a failed deletion can be retried.
+func deleteAccount(users UserStore, entries EntryStore, revisions RevisionStore, tokens TokenStore, logins SessionStore, user *User) error {
+	err := logins.RemoveByUser(user)
+	if err != nil {
+		return err
+	}
+	err = tokens.RemoveByUser(user)
+	if err != nil {
+		return err
+	}
+	err = revisions.RemoveByUser(user)
+	if err != nil {
+		return err
+	}
+	err = entries.RemoveByUser(user)
+	if err != nil {
+		return err
+	}
+	return users.Remove(user)
+}
+
+// A duplicate account being merged is left with this identity of its own ID
+// until it's removed. Users need at least one identity to be unique.
+const MergedProvider = "merged"
+
+// mergeAccounts moves everything of the duplicate account from into the
+// account into, and removes from. Entries of the same date are joined, and
+// the replaced body is kept as a revision. Returns the dates of joined
+// entries.
+//
+// It can be retried after a failure. Identities are moved first so that no
+// login is lost, each entry of from is removed as soon as it's moved, and from
+// is removed last.
+func mergeAccounts(users UserStore, entries EntryStore, revisions RevisionStore, tokens TokenStore, logins SessionStore, policy RevisionPolicy, into, from *User) ([]string, error) {
+	err := moveIdentities(users, into, from)
+	if err != nil {
+		return nil, err
+	}
+
+	var joined []string
+	err = eachEntry(entries, from, func(entry *Entry) error {
+		existing, err := entries.Find(into, entry.Date)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			moved := *entry
+			moved.UserId = into.Id
+			moved.updateDerivedFields(into)
+			_, err = entries.Create(&moved)
+			if err != nil {
+				return err
+			}
+			err = revisions.MoveToEntry(entry, &moved)
+			if err != nil {
+				return err
+			}
+			return entries.Remove(entry)
+		}
+
+		// The body may have been joined already by a failed merge, which
+		// mergeBodies doesn't repeat.
+		oldBody := existing.Body
+		existing.Body = mergeBodies([]string{existing.Body, entry.Body})
+		if existing.Body != oldBody {
+			existing.ActiveSeconds += entry.ActiveSeconds
+			existing.updateDerivedFields(into)
+			err = entries.Update(existing)
+			if err != nil {
+				return err
+			}
+			err = recordRevision(revisions, policy, existing, oldBody, true)
+			if err != nil {
+				return err
+			}
+		}
+		err = revisions.MoveToEntry(entry, existing)
+		if err != nil {
+			return err
+		}
+		joined = append(joined, entry.Date)
+		return entries.Remove(entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return joined, deleteAccount(users, entries, revisions, tokens, logins, from)
+}
+
+// moveIdentities links the identities and the password of from to into.
+// Identities are unique, so they are removed from from first. If into can't be
+// saved, they are put back.
+func moveIdentities(users UserStore, into, from *User) error {
+	var moved []Identity
+	for _, identity := range from.Identities {
+		if identity.Provider != MergedProvider {
+			moved = append(moved, identity)
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+
+	stripped := *from
+	stripped.Identities = []Identity{{Provider: MergedProvider, Subject: from.Id.Hex()}}
+	stripped.PasswordHash = ""
+	err := users.Update(&stripped)
+	if err != nil {
+		return err
+	}
+
+	updated := *into
+	updated.Identities = append([]Identity(nil), into.Identities...)
+	for _, identity := range moved {
+		if !updated.HasIdentity(&identity) {
+			updated.Identities = append(updated.Identities, identity)
+		}
+	}
+	if updated.PasswordHash == "" {
+		updated.PasswordHash = from.PasswordHash
+	}
+	err = users.Update(&updated)
+	if err != nil {
+		if restoreErr := users.Update(from); restoreErr != nil {
+			return restoreErr
+		}
+		return err
+	}
+	*into = updated
+	*from = stripped
+	return nil
+}
+
+//
+// Handlers
+//
+
+func ShowAccount(ctx *web.Context, ren render.Render, providers IdentityProviders, tokens TokenStore, logins SessionStore, session sessions.Session, csrfToken CsrfToken, current *LoginSession, user *User) {
+	data, err := accountData(providers, tokens, logins, csrfToken, current, user)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	data["Flashes"] = loginFlashes(session)
+	ren.HTML(200, "account", data)
+}
+
+// accountData returns the data of the account page.
+func accountData(providers IdentityProviders, tokens TokenStore, logins SessionStore, csrfToken CsrfToken, current *LoginSession, user *User) (map[string]interface{}, error) {
+	var links []providerLink
+	for _, provider := range providers {
+		links = append(links, providerLink{provider.Name(), provider.DisplayName(), "/account/link/" + provider.Name()})
+	}
+	apiTokens, err := tokens.FindByUser(user)
+	if err != nil {
+		return nil, err
+	}
+	loginSessions, err := sessionInfos(logins, user, current)
+	if err != nil {
+		return nil, err
+	}
+	data := pageData(user, csrfToken)
+	data["Identities"] = user.Identities
+	data["Providers"] = links
+	data["HasPassword"] = user.PasswordHash != ""
+	data["ApiTokens"] = apiTokens
+	data["Sessions"] = loginSessions
+	return data, nil
+}
+
+// ShowMerge asks the user to confirm merging the account found while linking
+// an identity.
+func ShowMerge(ctx *web.Context, ren render.Render, users UserStore, entries EntryStore, session sessions.Session, token CsrfToken, user *User) {
+	other := mergingUser(users, session)
+	if other == nil {
+		ctx.Redirect(http.StatusFound, "/account")
+		return
+	}
+	summaries, err := entries.Summaries(other)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	data := pageData(user, token)
+	data["Other"] = other
+	data["OtherEntries"] = len(summaries)
+	ren.HTML(200, "merge", data)
+}
+
+func MergeAccount(ctx *web.Context, users UserStore, entries EntryStore, revisions RevisionStore, tokens TokenStore, logins SessionStore, policy RevisionPolicy, session sessions.Session, user *User, l *log.Logger) {
+	other := mergingUser(users, session)
+	if other == nil || other.Id == user.Id {
+		session.Delete(SessionMergeUserIdKey)
+		ctx.Redirect(http.StatusFound, "/account")
+		return
+	}
+	// The user can retry a failed merge.
+	joined, err := mergeAccounts(users, entries, revisions, tokens, logins, policy, user, other)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	session.Delete(SessionMergeUserIdKey)
+	l.Printf("Merged user %s into %s joining %d entries", other.Id.Hex(), user.Id.Hex(), len(joined))
+	ctx.Redirect(http.StatusFound, "/account")
+}
+
+// mergingUser returns the user to be merged, or nil.
+func mergingUser(users UserStore, session sessions.Session) *User {
+	id, ok := session.Get(SessionMergeUserIdKey).(string)
+	if !ok || id == "" {
+		return nil
+	}
+	other, err := users.Get(id)
+	if err != nil {
+		return nil
+	}
+	return other
+}
+
+func ExportAccount(ctx *web.Context, entries EntryStore, user *User, l *log.Logger) {
+	filename := fmt.Sprintf("morning-pages-account-%s.json", user.Today())
+	ctx.SetHeader("Content-Type", "application/json; charset=utf-8", true)
+	ctx.SetHeader("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename), true)
+	ctx.WriteHeader(http.StatusOK)
+
+	err := writeAccountDump(ctx.ResponseWriter, entries, user, time.Now())
+	if err != nil {
+		// Too late to change the status. The client gets broken JSON.
+		l.Println("Failed to export the account", err)
+	}
+}
+
+// DeleteAccount permanently deletes the user's account. The request body
+// should be {"confirmation": "delete my account"}.
+func DeleteAccount(ctx *web.Context, ren render.Render, users UserStore, entries EntryStore, revisions RevisionStore, tokens TokenStore, logins SessionStore, session sessions.Session, user *User, l *log.Logger) {
+	requestBody, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	var input struct {
+		Confirmation string `json:"confirmation"`
+	}
+	err = json.Unmarshal(requestBody, &input)
+	if err != nil || input.Confirmation != AccountDeletionConfirmation {
+		ctx.Abort(http.StatusBadRequest, fmt.Sprintf(`Send {"confirmation": "%s"} to delete your account`, AccountDeletionConfirmation))
+		return
+	}
+
+	err = deleteAccount(users, entries, revisions, tokens, logins, user)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	l.Println("Deleted user", user.Id.Hex())
+	session.Delete(SessionUserIdKey)
+	session.Delete(SessionIdKey)
+	ren.JSON(200, map[string]bool{"deleted": true})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/codegangsta/martini-contrib/web"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_writeAccountDump(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234", Name: "Hello World"})
+	saveEntry(t, storage, user, "2014-03-31", "Hello")
+	saveEntry(t, storage, user, "2014-05-01", "World")
+
+	var buf bytes.Buffer
+	now := time.Date(2014, 5, 2, 0, 0, 0, 0, time.UTC)
+	if err := writeAccountDump(&buf, storage.Entries, user, now); err != nil {
+		t.Fatal(err)
+	}
+	var dump struct {
+		ExportedAt time.Time      `json:"exportedAt"`
+		Profile    AccountProfile `json:"profile"`
+		Entries    []Entry        `json:"entries"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+		t.Fatalf("Expected valid JSON but got %v: %s", err, buf.String())
+	}
+	if !dump.ExportedAt.Equal(now) || dump.Profile.Name != "Hello World" || dump.Profile.Settings.DailyGoal != DefaultDailyGoal {
+		t.Errorf("Expected the profile but got %v", dump)
+	}
+	if len(dump.Entries) != 2 || dump.Entries[0].Body != "Hello" || dump.Entries[1].Body != "World" {
+		t.Errorf("Expected all entries but got %v", dump.Entries)
+	}
+}
+
+func deleteAccountRequest(storage *Storage, user *User, session *mockSession, body string) (*httptest.ResponseRecorder, *mockRender) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("DELETE", "/account", strings.NewReader(body))
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	render := &mockRender{}
+	l := log.New(os.Stdout, "", 0)
+	DeleteAccount(ctx, render, storage.Users, storage.Entries, storage.Revisions, storage.Tokens, storage.Sessions, session, user, l)
+	return w, render
+}
+
+func Test_DeleteAccount(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	other, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "5678"})
+	saveEntry(t, storage, user, "2014-04-01", "Hello")
+	saveEntry(t, storage, other, "2014-04-01", "Other")
+	entry, _ := storage.Entries.Find(user, "2014-04-01")
+	storage.Revisions.Create(NewRevision(entry, "Hell", time.Now()))
+	token, _, _ := newApiToken(user, "CLI", []string{TokenScopeRead}, 0, time.Now())
+	storage.Tokens.Create(token)
+	r, _ := http.NewRequest("GET", "/", nil)
+	session := &mockSession{v: make(map[interface{}]interface{})}
+	logIn(r, storage.Sessions, session, user)
+
+	w, _ := deleteAccountRequest(storage, user, session, `{"confirmation": "yes"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d without confirmation but got %d", http.StatusBadRequest, w.Code)
+	}
+	if _, err := storage.Users.Get(user.Id.Hex()); err != nil {
+		t.Errorf("Expected not to delete without confirmation but got %v", err)
+	}
+
+	_, render := deleteAccountRequest(storage, user, session, `{"confirmation": "delete my account"}`)
+	if render.status != 200 {
+		t.Fatalf("Expected %d but got %d", 200, render.status)
+	}
+	if _, err := storage.Users.Get(user.Id.Hex()); err != ErrNotFound {
+		t.Errorf("Expected the user to be deleted but got %v", err)
+	}
+	if es, _ := storage.Entries.FindByDate(user, "", ""); len(es) != 0 {
+		t.Errorf("Expected the entries to be deleted but got %v", es)
+	}
+	if rs, _ := storage.Revisions.FindByEntry(entry); len(rs) != 0 {
+		t.Errorf("Expected the revisions to be deleted but got %v", rs)
+	}
+	if ts, _ := storage.Tokens.FindByUser(user); len(ts) != 0 {
+		t.Errorf("Expected the tokens to be deleted but got %v", ts)
+	}
+	if ss, _ := storage.Sessions.FindByUser(user); len(ss) != 0 {
+		t.Errorf("Expected the sessions to be deleted but got %v", ss)
+	}
+	if session.Get(SessionUserIdKey) != nil || session.Get(SessionIdKey) != nil {
+		t.Error("Expected to log out")
+	}
+	if es, _ := storage.Entries.FindByDate(other, "", ""); len(es) != 1 {
+		t.Errorf("Expected not to delete another user's entries but got %v", es)
+	}
+}
+
+func Test_mergeAccounts(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	other, _ := storage.Users.CreateByIdentity(&Identity{Provider: "google", Subject: "abc"})
+	saveEntry(t, storage, user, "2014-04-01", "Mine")
+	saveEntry(t, storage, other, "2014-04-01", "Theirs")
+	saveEntry(t, storage, other, "2014-04-02", "Only theirs")
+	entry, _ := storage.Entries.Find(other, "2014-04-02")
+	storage.Revisions.Create(NewRevision(entry, "Only", time.Now()))
+
+	joined, err := mergeAccounts(storage.Users, storage.Entries, storage.Revisions, storage.Tokens, storage.Sessions, DefaultRevisionPolicy, user, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(joined) != 1 || joined[0] != "2014-04-01" {
+		t.Errorf("Expected the joined date but got %v", joined)
+	}
+
+	entries, _ := storage.Entries.FindByDate(user, "", "")
+	if len(entries) != 2 || entries[0].Body != "Mine\n\nTheirs" || entries[1].Body != "Only theirs" {
+		t.Errorf("Expected the merged entries but got %v", entries)
+	}
+	if rs, _ := storage.Revisions.FindByEntry(&entries[0]); len(rs) != 1 || rs[0].Body != "Mine" {
+		t.Errorf("Expected the replaced body to be kept but got %v", rs)
+	}
+	if rs, _ := storage.Revisions.FindByEntry(&entries[1]); len(rs) != 1 || rs[0].Body != "Only" || rs[0].UserId != user.Id {
+		t.Errorf("Expected the revision to be moved but got %v", rs)
+	}
+
+	if _, err := storage.Users.Get(other.Id.Hex()); err != ErrNotFound {
+		t.Errorf("Expected the duplicate user to be removed but got %v", err)
+	}
+	found, err := storage.Users.FindByIdentity(&Identity{Provider: "google", Subject: "abc"})
+	if err != nil || found.Id != user.Id {
+		t.Errorf("Expected the identity to be linked but got %v and %v", found, err)
+	}
+	if es, _ := storage.Entries.FindByDate(other, "", ""); len(es) != 0 {
+		t.Errorf("Expected no entries left but got %v", es)
+	}
+}
+
+// flakyEntryStore fails to remove entries while failing is set.
+type flakyEntryStore struct {
+	EntryStore
+	failing bool
+}
+
+func (store *flakyEntryStore) Remove(entry *Entry) error {
+	if store.failing {
+		return errors.New("Failed to remove")
+	}
+	return store.EntryStore.Remove(entry)
+}
+
+// updateFailingUserStore fails to update the user of the ID.
+type updateFailingUserStore struct {
+	UserStore
+	id string
+}
+
+func (store *updateFailingUserStore) Update(user *User) error {
+	if user.Id.Hex() == store.id {
+		return errors.New("Failed to update")
+	}
+	return store.UserStore.Update(user)
+}
+
+func Test_mergeAccounts_retry(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	other, _ := storage.Users.CreateByIdentity(&Identity{Provider: "google", Subject: "abc"})
+	saveEntry(t, storage, user, "2014-04-01", "Mine")
+	saveEntry(t, storage, other, "2014-04-01", "Theirs")
+
+	// The identity stays with the duplicate if it can't be linked.
+	users := &updateFailingUserStore{storage.Users, user.Id.Hex()}
+	if _, err := mergeAccounts(users, storage.Entries, storage.Revisions, storage.Tokens, storage.Sessions, DefaultRevisionPolicy, user, other); err == nil {
+		t.Fatal("Expected an error but didn't get one")
+	}
+	found, err := storage.Users.FindByIdentity(&Identity{Provider: "google", Subject: "abc"})
+	if err != nil || found.Id != other.Id {
+		t.Errorf("Expected the identity to be kept but got %v and %v", found, err)
+	}
+
+	// Entries are joined once even if the merge fails after joining them.
+	entries := &flakyEntryStore{storage.Entries, true}
+	if _, err := mergeAccounts(storage.Users, entries, storage.Revisions, storage.Tokens, storage.Sessions, DefaultRevisionPolicy, user, other); err == nil {
+		t.Fatal("Expected an error but didn't get one")
+	}
+	found, err = storage.Users.FindByIdentity(&Identity{Provider: "google", Subject: "abc"})
+	if err != nil || found.Id != user.Id {
+		t.Errorf("Expected the identity to be linked before the entries but got %v and %v", found, err)
+	}
+	entries.failing = false
+	if _, err := mergeAccounts(storage.Users, entries, storage.Revisions, storage.Tokens, storage.Sessions, DefaultRevisionPolicy, user, other); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := storage.Entries.Find(user, "2014-04-01"); entry.Body != "Mine\n\nTheirs" {
+		t.Errorf("Expected the body to be joined once but got %q", entry.Body)
+	}
+	if _, err := storage.Users.Get(other.Id.Hex()); err != ErrNotFound {
+		t.Errorf("Expected the duplicate user to be removed but got %v", err)
+	}
+}
+
+func Test_MergeAccount(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	other, _ := storage.Users.CreateByIdentity(&Identity{Provider: "google", Subject: "abc"})
+	session := &mockSession{v: map[interface{}]interface{}{SessionMergeUserIdKey: other.Id.Hex()}}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/account/merge", nil)
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	l := log.New(os.Stdout, "", 0)
+	MergeAccount(ctx, storage.Users, storage.Entries, storage.Revisions, storage.Tokens, storage.Sessions, DefaultRevisionPolicy, session, user, l)
+
+	if w.Code != 302 || w.Header().Get("Location") != "/account" {
+		t.Errorf("Expected to redirect to /account but got %d and %s", w.Code, w.Header().Get("Location"))
+	}
+	if _, ok := session.v[SessionMergeUserIdKey]; ok {
+		t.Error("Expected to delete the merging user from the session but didn't")
+	}
+	if found, _ := storage.Users.Get(user.Id.Hex()); len(found.Identities) != 2 {
+		t.Errorf("Expected the identities to be merged but got %v", found.Identities)
+	}
+}
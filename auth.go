@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/codegangsta/martini-contrib/sessions"
+	"github.com/codegangsta/martini-contrib/web"
+	"log"
+	"net/http"
+)
+
+//
+// Filters
+//
+
+// FindProvider maps the provider named in the URL.
+func FindProvider(ctx *web.Context, c martini.Context, params martini.Params, providers IdentityProviders) {
+	provider := providers.Get(params["provider"])
+	if provider == nil {
+		ctx.Abort(http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+	c.MapTo(provider, (*IdentityProvider)(nil))
+}
+
+// UseProvider maps the provider of the name. For callback URLs registered
+// before there were other providers than Facebook.
+func UseProvider(name string) martini.Handler {
+	return func(ctx *web.Context, c martini.Context, providers IdentityProviders) {
+		provider := providers.Get(name)
+		if provider == nil {
+			ctx.Abort(http.StatusNotFound, "Unknown identity provider")
+			return
+		}
+		c.MapTo(provider, (*IdentityProvider)(nil))
+	}
+}
+
+//
+// Handlers
+//
+
+type providerLink struct {
+	Name        string
+	DisplayName string
+	Url         string
+}
+
+func ShowLogin(r render.Render, providers IdentityProviders, session sessions.Session, token CsrfToken) {
+	data := loginData(providers, token)
+	data["Flashes"] = loginFlashes(session)
+	r.HTML(200, "auth", data)
+}
+
+// loginData returns the data of the login page.
+func loginData(providers IdentityProviders, token CsrfToken) map[string]interface{} {
+	var links []providerLink
+	for _, provider := range providers {
+		links = append(links, providerLink{provider.Name(), provider.DisplayName(), "/auth/" + provider.Name()})
+	}
+	data := pageData(nil, token)
+	data["Providers"] = links
+	return data
+}
+
+func Logout(ctx *web.Context, logins SessionStore, session sessions.Session) {
+	err := logOut(logins, session)
+	if err != nil {
+		log.Println("Failed to remove a session", err)
+	}
+	ctx.Redirect(http.StatusFound, "/auth")
+}
+
+func RedirectToProvider(ctx *web.Context, provider IdentityProvider, session sessions.Session) {
+	state, err := newOAuthState(session)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx.Redirect(http.StatusFound, provider.AuthorizeUrl(state))
+}
+
+func GetAccessToken(ctx *web.Context, c martini.Context, provider IdentityProvider, session sessions.Session) {
+	query := ctx.Request.URL.Query()
+	name := provider.DisplayName()
+	// The state is missing or different if someone else started logging in.
+	validState := checkOAuthState(session, query.Get("state"))
+
+	// The provider redirects back with an error if the user cancelled.
+	if e := query.Get("error"); e != "" {
+		reason := LoginRefused
+		if e == "access_denied" {
+			reason = LoginCancelled
+		}
+		loginFailed(ctx, session, &ProviderError{name, reason, fmt.Errorf("%s %s", e, query.Get("error_description"))})
+		return
+	}
+	if !validState {
+		loginFailed(ctx, session, &ProviderError{name, LoginInvalidState, nil})
+		return
+	}
+
+	// Get access token with the code.
+	code := query.Get("code")
+	if code == "" {
+		loginFailed(ctx, session, providerFailed(name, "No code is given"))
+		return
+	}
+	token, err := provider.Exchange(code)
+	if err != nil {
+		loginFailed(ctx, session, err)
+		return
+	}
+
+	c.Map(token)
+}
+
+func GetUserInfo(ctx *web.Context, c martini.Context, token AccessToken, provider IdentityProvider, session sessions.Session) {
+	identity, err := provider.Profile(token)
+	if err != nil {
+		loginFailed(ctx, session, err)
+		return
+	}
+
+	c.Map(identity)
+}
+
+// LinkIdentity starts logging in with another provider to add the identity to
+// the user's account.
+func LinkIdentity(ctx *web.Context, provider IdentityProvider, session sessions.Session, user *User) {
+	state, err := newOAuthState(session)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	session.Set(SessionLinkUserIdKey, user.Id.Hex())
+	ctx.Redirect(http.StatusFound, provider.AuthorizeUrl(state))
+}
+
+func FindOrCreateUser(ctx *web.Context, identity *Identity, users UserStore, logins SessionStore, session sessions.Session) {
+	if linkUserId, ok := session.Get(SessionLinkUserIdKey).(string); ok && linkUserId != "" {
+		session.Delete(SessionLinkUserIdKey)
+		// Only if they are still logged in as the user.
+		if session.Get(SessionUserIdKey) == linkUserId {
+			addIdentity(ctx, identity, users, session, linkUserId)
+			return
+		}
+	}
+
+	user, err := users.FindByIdentity(identity)
+	if err == ErrNotFound {
+		user, err = users.CreateByIdentity(identity)
+		if err != nil {
+			log.Println("Failed to create a user")
+			loginFailed(ctx, session, err)
+			return
+		}
+		log.Println("Created a new user", user.Id)
+	} else if err != nil {
+		log.Println("Failed to find a user")
+		loginFailed(ctx, session, err)
+		return
+	} else {
+		log.Println("Found a user", user.Id)
+	}
+
+	err = logIn(ctx.Request, logins, session, user)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx.Redirect(http.StatusFound, "/")
+}
+
+// addIdentity links the identity to the user. If another user has the
+// identity, the user is asked to merge the accounts, which are likely of the
+// same person.
+func addIdentity(ctx *web.Context, identity *Identity, users UserStore, session sessions.Session, userId string) {
+	user, err := users.Get(userId)
+	if err != nil {
+		ctx.Redirect(http.StatusFound, "/auth")
+		return
+	}
+	owner, err := users.FindByIdentity(identity)
+	switch {
+	case err == ErrNotFound:
+		user.Identities = append(user.Identities, *identity)
+		err = users.Update(user)
+		if err != nil {
+			log.Println("Failed to link an identity")
+			log.Println(err)
+			session.AddFlash("ログイン方法の連携に失敗しました。もう一度お試しください。", LoginFlashKey)
+		} else {
+			log.Println("Linked an identity to a user", user.Id)
+		}
+	case err != nil:
+		log.Println("Failed to find a user")
+		log.Println(err)
+		session.AddFlash("ログイン方法の連携に失敗しました。もう一度お試しください。", LoginFlashKey)
+	case owner.Id != user.Id:
+		session.Set(SessionMergeUserIdKey, owner.Id.Hex())
+		ctx.Redirect(http.StatusFound, "/account/merge")
+		return
+	}
+	ctx.Redirect(http.StatusFound, "/account")
+}
+
+// Key of flash messages about logging in.
+const LoginFlashKey = "login"
+
+// loginFailed tells the user why logging in failed on the login page, or on
+// the account page if they were linking an identity.
+func loginFailed(ctx *web.Context, session sessions.Session, err error) {
+	log.Println("Login failed:", err)
+	message := "ログインに失敗しました。もう一度お試しください。"
+	if e, ok := err.(*ProviderError); ok {
+		message = e.Message()
+	}
+	session.AddFlash(message, LoginFlashKey)
+
+	if linkUserId, ok := session.Get(SessionLinkUserIdKey).(string); ok && linkUserId != "" {
+		session.Delete(SessionLinkUserIdKey)
+		ctx.Redirect(http.StatusFound, "/account")
+		return
+	}
+	ctx.Redirect(http.StatusFound, "/auth")
+}
+
+// loginFlashes returns and clears flash messages about logging in.
+func loginFlashes(session sessions.Session) []string {
+	var messages []string
+	for _, flash := range session.Flashes(LoginFlashKey) {
+		if message, ok := flash.(string); ok {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"github.com/codegangsta/inject"
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/web"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_ShowLogin(t *testing.T) {
+	render := &mockRender{}
+	providers := IdentityProviders{NewFacebookProvider("APP_ID", "APP_SECRET", "http://somewhere.org/something")}
+	expectedStatus := 200
+	expectedName := "auth"
+	ShowLogin(render, providers, &mockSession{v: make(map[interface{}]interface{})}, CsrfToken("TOKEN"))
+	if status := render.status; status != expectedStatus {
+		t.Errorf("Expected to set status %d but got %d", expectedStatus, status)
+	}
+	if name := render.name; name != expectedName {
+		t.Errorf("Expected to set name %s but got %s", expectedName, name)
+	}
+	links := render.v.(map[string]interface{})["Providers"].([]providerLink)
+	if len(links) != 1 || links[0].Url != "/auth/facebook" || links[0].DisplayName != "Facebook" {
+		t.Errorf("Expected a link to log in with Facebook but got %v", links)
+	}
+}
+
+func Test_Logout(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	v := make(map[interface{}]interface{})
+	v[SessionUserIdKey] = "SOME_USER_KEY"
+	session := &mockSession{v: v}
+	Logout(ctx, newLocalSessionStore(), session)
+
+	if _, ok := v[SessionUserIdKey]; ok {
+		t.Error("Expected to delete session user ID key but didn't")
+	}
+
+	expectedCode := 302
+	if w.Code != expectedCode {
+		t.Errorf("Expected %d but got %d", expectedCode, w.Code)
+	}
+
+	expectedLocation := "/auth"
+	if loc := w.HeaderMap["Location"][0]; loc != expectedLocation {
+		t.Errorf("Expected %s but got %s", expectedLocation, loc)
+	}
+}
+
+func Test_FindProvider_unknown(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/auth/twitter", nil)
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	c := &mockContext{inject.New()}
+	providers := IdentityProviders{&mockIdentityProvider{}}
+	FindProvider(ctx, c, martini.Params{"provider": "twitter"}, providers)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected %d but got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func Test_GetAccessToken(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/somewhere?code=12345&state=STATE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	c := &mockContext{inject.New()}
+	provider := &mockIdentityProvider{token: AccessToken("TOKEN")}
+	session := &mockSession{v: map[interface{}]interface{}{SessionOAuthStateKey: "STATE"}}
+	GetAccessToken(ctx, c, provider, session)
+
+	if _, ok := session.v[SessionOAuthStateKey]; ok {
+		t.Error("Expected the state to be used only once but it wasn't")
+	}
+
+	expectedCode := "12345"
+	if provider.code != expectedCode {
+		t.Errorf("Expected %s but got %s", expectedCode, provider.code)
+	}
+
+	expectedToken := AccessToken("TOKEN")
+	token := c.Get(reflect.TypeOf(AccessToken(""))).Interface().(AccessToken)
+	if token != expectedToken {
+		t.Errorf("Expected %s but got %s", expectedToken, token)
+	}
+}
+
+func Test_FindOrCreateUser(t *testing.T) {
+	storage := openMemoryStorage()
+	identity := &Identity{Provider: "standin", Subject: "abc123", Name: "Hello World"}
+
+	var ids []interface{}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/auth/standin/callback", nil)
+		ctx := &web.Context{Request: r, ResponseWriter: w}
+		session := &mockSession{v: make(map[interface{}]interface{})}
+		FindOrCreateUser(ctx, identity, storage.Users, storage.Sessions, session)
+		if w.Code != 302 || w.Header().Get("Location") != "/" {
+			t.Errorf("Expected to redirect to / but got %d and %s", w.Code, w.Header().Get("Location"))
+		}
+		ids = append(ids, session.Get(SessionUserIdKey))
+	}
+	if ids[0] == nil || ids[0] != ids[1] {
+		t.Errorf("Expected to log in as the same user but got %v", ids)
+	}
+	user, err := storage.Users.FindByIdentity(identity)
+	if err != nil || user.Name != "Hello World" {
+		t.Errorf("Expected the created user but got %v and %v", user, err)
+	}
+}
+
+func linkCallback(users UserStore, identity *Identity, session *mockSession) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/auth/standin/callback", nil)
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	FindOrCreateUser(ctx, identity, users, newLocalSessionStore(), session)
+	return w
+}
+
+func Test_FindOrCreateUser_link(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	identity := &Identity{Provider: "standin", Subject: "abc123"}
+	session := &mockSession{v: map[interface{}]interface{}{
+		SessionUserIdKey:     user.Id.Hex(),
+		SessionLinkUserIdKey: user.Id.Hex(),
+	}}
+
+	w := linkCallback(storage.Users, identity, session)
+	if w.Code != 302 || w.Header().Get("Location") != "/account" {
+		t.Errorf("Expected to redirect to /account but got %d and %s", w.Code, w.Header().Get("Location"))
+	}
+	if _, ok := session.v[SessionLinkUserIdKey]; ok {
+		t.Error("Expected to delete the linking user from the session but didn't")
+	}
+	found, err := storage.Users.FindByIdentity(identity)
+	if err != nil || found.Id != user.Id {
+		t.Errorf("Expected the identity to be linked but got %v and %v", found, err)
+	}
+}
+
+func Test_FindOrCreateUser_linkOtherUser(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	identity := &Identity{Provider: "standin", Subject: "abc123"}
+	other, _ := storage.Users.CreateByIdentity(identity)
+	session := &mockSession{v: map[interface{}]interface{}{
+		SessionUserIdKey:     user.Id.Hex(),
+		SessionLinkUserIdKey: user.Id.Hex(),
+	}}
+
+	w := linkCallback(storage.Users, identity, session)
+	if w.Code != 302 || w.Header().Get("Location") != "/account/merge" {
+		t.Errorf("Expected to redirect to /account/merge but got %d and %s", w.Code, w.Header().Get("Location"))
+	}
+	if id := session.Get(SessionMergeUserIdKey); id != other.Id.Hex() {
+		t.Errorf("Expected to merge %s but got %v", other.Id.Hex(), id)
+	}
+	if id := session.Get(SessionUserIdKey); id != user.Id.Hex() {
+		t.Errorf("Expected to stay logged in as %s but got %v", user.Id.Hex(), id)
+	}
+}
+
+func Test_FindOrCreateUser_linkLoggedOut(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	identity := &Identity{Provider: "standin", Subject: "abc123"}
+	session := &mockSession{v: map[interface{}]interface{}{SessionLinkUserIdKey: user.Id.Hex()}}
+
+	w := linkCallback(storage.Users, identity, session)
+	if w.Code != 302 || w.Header().Get("Location") != "/" {
+		t.Errorf("Expected to log in normally but got %d and %s", w.Code, w.Header().Get("Location"))
+	}
+	if found, _ := storage.Users.FindByIdentity(identity); found == nil || found.Id == user.Id {
+		t.Errorf("Expected a new user but got %v", found)
+	}
+}
+
+func Test_GetAccessToken_cancelled(t *testing.T) {
+	cases := []struct {
+		query, flash string
+	}{
+		{"error=access_denied&error_reason=user_denied&state=STATE", (&ProviderError{Provider: "Mock", Reason: LoginCancelled}).Message()},
+		{"error=server_error&state=STATE", (&ProviderError{Provider: "Mock", Reason: LoginRefused}).Message()},
+		{"state=STATE", (&ProviderError{Provider: "Mock", Reason: LoginProviderFailed}).Message()},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/auth/mock/callback?"+c.query, nil)
+		ctx := &web.Context{Request: r, ResponseWriter: w}
+		ic := &mockContext{inject.New()}
+		provider := &mockIdentityProvider{token: AccessToken("TOKEN")}
+		session := &mockSession{v: map[interface{}]interface{}{SessionOAuthStateKey: "STATE"}}
+		GetAccessToken(ctx, ic, provider, session)
+
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/auth" {
+			t.Errorf("Expected to redirect to /auth for %s but got %d and %s", c.query, w.Code, w.Header().Get("Location"))
+		}
+		if flashes := loginFlashes(session); len(flashes) != 1 || flashes[0] != c.flash {
+			t.Errorf("Expected %s for %s but got %v", c.flash, c.query, flashes)
+		}
+	}
+}
+
+func Test_GetAccessToken_cancelledLinking(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/auth/mock/callback?error=access_denied&state=STATE", nil)
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	session := &mockSession{v: map[interface{}]interface{}{SessionOAuthStateKey: "STATE", SessionLinkUserIdKey: "USER_ID"}}
+	GetAccessToken(ctx, &mockContext{inject.New()}, &mockIdentityProvider{}, session)
+
+	if w.Header().Get("Location") != "/account" {
+		t.Errorf("Expected to go back to /account but got %s", w.Header().Get("Location"))
+	}
+	if _, ok := session.v[SessionLinkUserIdKey]; ok {
+		t.Error("Expected to stop linking but didn't")
+	}
+}
+
+func Test_ShowLogin_flashes(t *testing.T) {
+	render := &mockRender{}
+	session := &mockSession{v: make(map[interface{}]interface{})}
+	session.AddFlash("Cancelled", LoginFlashKey)
+	ShowLogin(render, IdentityProviders{}, session, CsrfToken("TOKEN"))
+	flashes := render.v.(map[string]interface{})["Flashes"].([]string)
+	if len(flashes) != 1 || flashes[0] != "Cancelled" {
+		t.Errorf("Expected the flash message but got %v", flashes)
+	}
+	if len(loginFlashes(session)) != 0 {
+		t.Error("Expected the flash message to be shown only once")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// CountOptions tells countCharacters what not to count.
+type CountOptions struct {
+	ExcludeWhitespace  bool
+	ExcludePunctuation bool
+}
+
+// countCharacters counts user-perceived characters, which are grapheme
+// clusters roughly following Unicode Standard Annex #29. e.g. "が" written
+// with a combining mark, a kanji with a variation selector, a flag and a family
+// emoji joined with ZWJ count as one character each.
+func countCharacters(s string, opts CountOptions) int {
+	count := 0
+	for len(s) > 0 {
+		base, size := nextGrapheme(s)
+		s = s[size:]
+		if opts.ExcludeWhitespace && unicode.IsSpace(base) {
+			continue
+		}
+		if opts.ExcludePunctuation && unicode.IsPunct(base) {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// nextGrapheme returns the first rune of the first grapheme cluster in s and
+// the cluster's length in bytes.
+func nextGrapheme(s string) (rune, int) {
+	base, size := utf8.DecodeRuneInString(s)
+	if base == '\r' && len(s) > size && s[size] == '\n' {
+		return base, size + 1
+	}
+	if isControl(base) {
+		return base, size
+	}
+
+	prev := base
+	regionalIndicators := 0
+	if isRegionalIndicator(base) {
+		regionalIndicators = 1
+	}
+	for size < len(s) {
+		r, n := utf8.DecodeRuneInString(s[size:])
+		joins := isExtend(r) ||
+			prev == '\u200d' && !isControl(r) ||
+			regionalIndicators == 1 && isRegionalIndicator(r) ||
+			hangulJoins(prev, r)
+		if !joins {
+			break
+		}
+		if isRegionalIndicator(r) {
+			regionalIndicators++
+		}
+		prev = r
+		size += n
+	}
+	return base, size
+}
+
+func isControl(r rune) bool {
+	return r == '\r' || r == '\n' || unicode.Is(unicode.Cc, r) || unicode.Is(unicode.Zl, r) || unicode.Is(unicode.Zp, r)
+}
+
+// isExtend tells whether r attaches to the previous character.
+func isExtend(r rune) bool {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc):
+		// Combining marks including dakuten, handakuten and variation selectors.
+		return true
+	case r == '\u200d':
+		return true
+	case r == '\uff9e' || r == '\uff9f':
+		// Halfwidth katakana voiced sound marks.
+		return true
+	case 0x1f3fb <= r && r <= 0x1f3ff:
+		// Emoji skin tone modifiers.
+		return true
+	case 0xe0020 <= r && r <= 0xe007f:
+		// Tags used in subdivision flags.
+		return true
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool {
+	return 0x1f1e6 <= r && r <= 0x1f1ff
+}
+
+// Hangul syllable types for conjoining jamo.
+const (
+	hangulNone = iota
+	hangulL
+	hangulV
+	hangulT
+	hangulLV
+	hangulLVT
+)
+
+func hangulType(r rune) int {
+	switch {
+	case 0x1100 <= r && r <= 0x115f, 0xa960 <= r && r <= 0xa97c:
+		return hangulL
+	case 0x1160 <= r && r <= 0x11a7, 0xd7b0 <= r && r <= 0xd7c6:
+		return hangulV
+	case 0x11a8 <= r && r <= 0x11ff, 0xd7cb <= r && r <= 0xd7fb:
+		return hangulT
+	case 0xac00 <= r && r <= 0xd7a3:
+		if (r-0xac00)%28 == 0 {
+			return hangulLV
+		}
+		return hangulLVT
+	}
+	return hangulNone
+}
+
+func hangulJoins(prev, r rune) bool {
+	p, t := hangulType(prev), hangulType(r)
+	switch p {
+	case hangulL:
+		return t == hangulL || t == hangulV || t == hangulLV || t == hangulLVT
+	case hangulLV, hangulV:
+		return t == hangulV || t == hangulT
+	case hangulLVT, hangulT:
+		return t == hangulT
+	}
+	return false
+}
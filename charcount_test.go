@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_countCharacters(t *testing.T) {
+	cases := []struct {
+		s        string
+		expected int
+	}{
+		{"", 0},
+		{"Hello", 5},
+		{"今日は晴れ", 5},
+		// Surrogate pairs in UTF-16.
+		{"𠮷野家", 3},
+		// Combining dakuten.
+		{"か\u3099", 1},
+		// Halfwidth katakana with a voiced sound mark.
+		{"ｶ\uff9e", 1},
+		// Kanji with a variation selector.
+		{"葛\U000e0100", 1},
+		// Emoji with a skin tone modifier.
+		{"👍\U0001f3fd", 1},
+		// Family emoji joined with ZWJ.
+		{"👨\u200d👩\u200d👧", 1},
+		// Flags.
+		{"🇯🇵🇩🇪", 2},
+		// Conjoining hangul jamo.
+		{"\u1100\u1161\u11a8", 1},
+		{"\r\n", 1},
+	}
+	for _, c := range cases {
+		if count := countCharacters(c.s, CountOptions{}); count != c.expected {
+			t.Errorf("Expected %d for %q but got %d", c.expected, c.s, count)
+		}
+	}
+}
+
+func Test_countCharacters_excludeWhitespace(t *testing.T) {
+	s := "今日は　晴れ。\nGood morning!"
+	opts := CountOptions{ExcludeWhitespace: true}
+	expected := 18
+	if count := countCharacters(s, opts); count != expected {
+		t.Errorf("Expected %d but got %d", expected, count)
+	}
+}
+
+func Test_countCharacters_excludePunctuation(t *testing.T) {
+	s := "「今日は、晴れ。」"
+	opts := CountOptions{ExcludePunctuation: true}
+	expected := 5
+	if count := countCharacters(s, opts); count != expected {
+		t.Errorf("Expected %d but got %d", expected, count)
+	}
+}
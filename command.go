@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// runCommand runs a subcommand given as command line arguments such as
+// `morning_pages migrate -dry-run`. The storage is opened only by the commands
+// that use it so that `session-key` works without a database.
+func runCommand(storageUrl string, name string, args []string) error {
+	l := log.New(os.Stdout, "["+name+"] ", 0)
+	switch name {
+	case "migrate":
+		flags := flag.NewFlagSet(name, flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "only show what would be done")
+		flags.Parse(args)
+		return withStorage(storageUrl, func(storage *Storage) error {
+			if storage.migrator == nil {
+				l.Println("Nothing to migrate")
+				return nil
+			}
+			return storage.Migrate(*dryRun, l)
+		})
+	case "import":
+		flags := flag.NewFlagSet(name, flag.ExitOnError)
+		userId := flags.String("user", "", "ID of the user to import entries for")
+		format := flags.String("format", ImportFormatFiles, "750words, dayone or files")
+		conflict := flags.String("conflict", ImportConflictSkip, "skip, overwrite or append existing entries")
+		flags.Parse(args)
+		if flags.NArg() != 1 {
+			return fmt.Errorf("Usage: morning_pages import -user ID [-format FORMAT] [-conflict POLICY] PATH")
+		}
+		return withStorage(storageUrl, func(storage *Storage) error {
+			return runImport(storage, *userId, *format, *conflict, flags.Arg(0), l)
+		})
+	case "session-key":
+		pair, err := generateSessionKeyPair()
+		if err != nil {
+			return err
+		}
+		fmt.Println(pair)
+		return nil
+	}
+	return fmt.Errorf("Unknown command: %s", name)
+}
+
+// runImport imports a file, a ZIP archive or a directory of files for the user.
+func runImport(storage *Storage, userId, format, conflict, path string, l *log.Logger) error {
+	if !isImportFormat(format) {
+		return fmt.Errorf("Unsupported format: %s", format)
+	}
+	if !isImportConflict(conflict) {
+		return fmt.Errorf("Invalid conflict: %s", conflict)
+	}
+	user, err := storage.Users.Get(userId)
+	if err != nil {
+		return fmt.Errorf("User %s: %s", userId, err)
+	}
+	policy, err := revisionPolicyFromEnv()
+	if err != nil {
+		return err
+	}
+	files, err := readImportPath(path)
+	if err != nil {
+		return err
+	}
+
+	report := newImportReport()
+	imported := parseImportFiles(format, files, user, report)
+	err = importEntries(storage.Entries, storage.Revisions, policy, user, imported, conflict, report)
+	if err != nil {
+		return err
+	}
+	l.Printf("Created %d, overwrote %d, appended to %d and skipped %d entries",
+		len(report.Created), len(report.Overwritten), len(report.Appended), len(report.Skipped))
+	for _, message := range report.Errors {
+		l.Println("Error:", message)
+	}
+	return nil
+}
+
+func withStorage(url string, f func(*Storage) error) error {
+	storage, err := OpenStorage(url)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	return f(storage)
+}
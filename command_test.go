@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_runCommand_sessionKey(t *testing.T) {
+	// Operators generate keys before the database is set up.
+	if err := runCommand("unknown://", "session-key", nil); err != nil {
+		t.Errorf("Expected session-key not to open the storage but got %v", err)
+	}
+	if err := runCommand("unknown://", "migrate", nil); err == nil {
+		t.Error("Expected migrate to open the storage")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//
+// The session cookie is signed and encrypted with SESSION_KEYS, a list of
+// "<hash key>:<encryption key>" pairs in base64 separated by commas. The
+// first pair signs new cookies and all of them verify, so that a key can be
+// rotated by adding a new pair in front and removing the old one after the
+// sessions signed with it have expired.
+//
+
+const SessionCookieName = "default-session"
+
+// Hash keys are for HMAC-SHA256.
+const MinSessionHashKeyLength = 32
+
+// Encryption keys select AES-128, AES-192 or AES-256.
+var sessionBlockKeyLengths = []int{16, 24, 32}
+
+type sessionKeyPair struct {
+	Hash  []byte
+	Block []byte
+}
+
+func decodeSessionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return key, nil
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// parseSessionKeys parses the value of SESSION_KEYS.
+func parseSessionKeys(value string) ([]sessionKeyPair, error) {
+	var pairs []sessionKeyPair
+	for i, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Session key %d must be <hash key>:<encryption key>", i+1)
+		}
+		hash, err := decodeSessionKey(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Hash key %d is not base64: %v", i+1, err)
+		}
+		block, err := decodeSessionKey(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Encryption key %d is not base64: %v", i+1, err)
+		}
+		if len(hash) < MinSessionHashKeyLength {
+			return nil, fmt.Errorf("Hash key %d must be at least %d bytes", i+1, MinSessionHashKeyLength)
+		}
+		if !isSessionBlockKeyLength(len(block)) {
+			return nil, fmt.Errorf("Encryption key %d must be 16, 24 or 32 bytes", i+1)
+		}
+		pairs = append(pairs, sessionKeyPair{hash, block})
+	}
+	return pairs, nil
+}
+
+func isSessionBlockKeyLength(n int) bool {
+	for _, length := range sessionBlockKeyLengths {
+		if n == length {
+			return true
+		}
+	}
+	return false
+}
+
+// generateSessionKeyPair returns a new pair for SESSION_KEYS.
+func generateSessionKeyPair() (string, error) {
+	hash := securecookie.GenerateRandomKey(64)
+	block := securecookie.GenerateRandomKey(32)
+	if hash == nil || block == nil {
+		return "", fmt.Errorf("Failed to generate a session key")
+	}
+	return base64.StdEncoding.EncodeToString(hash) + ":" + base64.StdEncoding.EncodeToString(block), nil
+}
+
+// sessionKeysFromEnv returns the keys of SESSION_KEYS. In development,
+// random keys are used if it's not set, which log everyone out on restart.
+//
+// SESSION_KEY, which only signed cookies, is still accepted to verify them
+// after the keys so that nobody is logged out on the switch. New cookies are
+// always encrypted.
+func sessionKeysFromEnv(env string, l *log.Logger) ([]sessionKeyPair, error) {
+	pairs, err := parseSessionKeys(os.Getenv("SESSION_KEYS"))
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		if env != martini.Dev {
+			return nil, fmt.Errorf("Set SESSION_KEYS. Generate one with `morning_pages session-key`.")
+		}
+		l.Println("SESSION_KEYS is not set. Using random keys.")
+		pairs = append(pairs, sessionKeyPair{securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)})
+	}
+
+	if legacy := os.Getenv("SESSION_KEY"); legacy != "" {
+		if len(legacy) < MinSessionHashKeyLength && env != martini.Dev {
+			return nil, fmt.Errorf("SESSION_KEY must be at least %d bytes. Remove it once its cookies have expired.", MinSessionHashKeyLength)
+		}
+		pairs = append(pairs, sessionKeyPair{Hash: []byte(legacy)})
+	}
+	return pairs, nil
+}
+
+//
+// Cookie options
+//
+
+type cookieOptions struct {
+	Secure bool
+	// "Lax", "Strict" or "None".
+	SameSite string
+}
+
+// cookieOptionsFromEnv reads COOKIE_SECURE, which is true except in
+// development, and COOKIE_SAMESITE, which is Lax by default. Strict would
+// drop the cookie when providers redirect back after logging in.
+func cookieOptionsFromEnv(env string) (cookieOptions, error) {
+	options := cookieOptions{Secure: env != martini.Dev, SameSite: "Lax"}
+	switch secure := strings.ToLower(os.Getenv("COOKIE_SECURE")); secure {
+	case "":
+	case "true", "1":
+		options.Secure = true
+	case "false", "0":
+		options.Secure = false
+	default:
+		return options, fmt.Errorf("COOKIE_SECURE must be true or false: %s", secure)
+	}
+	switch sameSite := strings.ToLower(os.Getenv("COOKIE_SAMESITE")); sameSite {
+	case "":
+	case "lax":
+		options.SameSite = "Lax"
+	case "strict":
+		options.SameSite = "Strict"
+	case "none":
+		options.SameSite = "None"
+	default:
+		return options, fmt.Errorf("COOKIE_SAMESITE must be lax, strict or none: %s", sameSite)
+	}
+	if options.SameSite == "None" && !options.Secure {
+		return options, fmt.Errorf("COOKIE_SAMESITE=none needs secure cookies")
+	}
+	return options, nil
+}
+
+// newCookieSessionStore returns the store of the session cookie. Cookies
+// last as long as login sessions can.
+func newCookieSessionStore(pairs []sessionKeyPair, options cookieOptions) *gsessions.CookieStore {
+	maxAge := int(SessionMaxAge.Seconds())
+	var codecs []securecookie.Codec
+	for _, pair := range pairs {
+		codecs = append(codecs, securecookie.New(pair.Hash, pair.Block).MaxAge(maxAge))
+	}
+	return &gsessions.CookieStore{
+		Codecs: codecs,
+		Options: &gsessions.Options{
+			Path:     "/",
+			MaxAge:   maxAge,
+			Secure:   options.Secure,
+			HttpOnly: true,
+		},
+	}
+}
+
+// SameSite adds the SameSite attribute to cookies, which the session store
+// can't. Use it before sessions.Sessions so that it runs after the session
+// is saved.
+func SameSite(mode string) martini.Handler {
+	return func(rw http.ResponseWriter) {
+		rw.(martini.ResponseWriter).Before(func(rw martini.ResponseWriter) {
+			addSameSite(rw.Header(), mode)
+		})
+	}
+}
+
+func addSameSite(header http.Header, mode string) {
+	cookies := header["Set-Cookie"]
+	for i, cookie := range cookies {
+		if !strings.Contains(strings.ToLower(cookie), "samesite=") {
+			cookies[i] = cookie + "; SameSite=" + mode
+		}
+	}
+}
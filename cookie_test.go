@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/codegangsta/martini"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func sessionKey(n int) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", n)))
+}
+
+func Test_parseSessionKeys(t *testing.T) {
+	pairs, err := parseSessionKeys(sessionKey(64) + ":" + sessionKey(32) + ", " + sessionKey(32) + ":" + sessionKey(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || len(pairs[0].Hash) != 64 || len(pairs[0].Block) != 32 || len(pairs[1].Block) != 16 {
+		t.Errorf("Expected two pairs but got %v", pairs)
+	}
+
+	invalid := []string{
+		sessionKey(64),
+		sessionKey(31) + ":" + sessionKey(32),
+		sessionKey(64) + ":" + sessionKey(20),
+		"not base64!:" + sessionKey(32),
+	}
+	for _, value := range invalid {
+		if _, err := parseSessionKeys(value); err == nil {
+			t.Errorf("Expected an error for %s but didn't get one", value)
+		}
+	}
+}
+
+func Test_generateSessionKeyPair(t *testing.T) {
+	pair, err := generateSessionKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pairs, err := parseSessionKeys(pair); err != nil || len(pairs) != 1 {
+		t.Errorf("Expected a valid pair but got %v and %v", pairs, err)
+	}
+}
+
+func Test_sessionKeysFromEnv(t *testing.T) {
+	defer os.Setenv("SESSION_KEYS", os.Getenv("SESSION_KEYS"))
+	defer os.Setenv("SESSION_KEY", os.Getenv("SESSION_KEY"))
+	l := log.New(ioutil.Discard, "", 0)
+
+	os.Setenv("SESSION_KEYS", "")
+	os.Setenv("SESSION_KEY", "")
+	if _, err := sessionKeysFromEnv(martini.Prod, l); err == nil {
+		t.Error("Expected an error without keys in production but didn't get one")
+	}
+	if pairs, err := sessionKeysFromEnv(martini.Dev, l); err != nil || len(pairs) != 1 || len(pairs[0].Block) != 32 {
+		t.Errorf("Expected random keys in development but got %v and %v", pairs, err)
+	}
+
+	os.Setenv("SESSION_KEYS", sessionKey(64)+":"+sessionKey(32))
+	os.Setenv("SESSION_KEY", "short")
+	if _, err := sessionKeysFromEnv(martini.Prod, l); err == nil {
+		t.Error("Expected an error for a short SESSION_KEY in production but didn't get one")
+	}
+	os.Setenv("SESSION_KEY", strings.Repeat("s", 32))
+	pairs, err := sessionKeysFromEnv(martini.Prod, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || pairs[1].Block != nil {
+		t.Errorf("Expected the old key to verify after the new ones but got %v", pairs)
+	}
+}
+
+func Test_cookieOptionsFromEnv(t *testing.T) {
+	defer os.Setenv("COOKIE_SECURE", os.Getenv("COOKIE_SECURE"))
+	defer os.Setenv("COOKIE_SAMESITE", os.Getenv("COOKIE_SAMESITE"))
+
+	cases := []struct {
+		env, secure, sameSite string
+		expected              cookieOptions
+		ok                    bool
+	}{
+		{martini.Dev, "", "", cookieOptions{false, "Lax"}, true},
+		{martini.Prod, "", "", cookieOptions{true, "Lax"}, true},
+		{martini.Prod, "false", "strict", cookieOptions{false, "Strict"}, true},
+		{martini.Prod, "", "none", cookieOptions{true, "None"}, true},
+		{martini.Dev, "", "none", cookieOptions{}, false},
+		{martini.Prod, "maybe", "", cookieOptions{}, false},
+		{martini.Prod, "", "loose", cookieOptions{}, false},
+	}
+	for _, c := range cases {
+		os.Setenv("COOKIE_SECURE", c.secure)
+		os.Setenv("COOKIE_SAMESITE", c.sameSite)
+		options, err := cookieOptionsFromEnv(c.env)
+		if (err == nil) != c.ok || (c.ok && options != c.expected) {
+			t.Errorf("Expected %v for %v but got %v and %v", c.expected, c, options, err)
+		}
+	}
+}
+
+func sessionCookie(t *testing.T, pairs []sessionKeyPair, value string) *http.Cookie {
+	store := newCookieSessionStore(pairs, cookieOptions{Secure: true, SameSite: "Lax"})
+	r, _ := http.NewRequest("GET", "/", nil)
+	s, _ := store.New(r, SessionCookieName)
+	s.Values[SessionUserIdKey] = value
+	w := httptest.NewRecorder()
+	if err := store.Save(r, w, s); err != nil {
+		t.Fatal(err)
+	}
+	res := http.Response{Header: w.Header()}
+	return res.Cookies()[0]
+}
+
+func Test_newCookieSessionStore(t *testing.T) {
+	old := []sessionKeyPair{{[]byte(strings.Repeat("o", 32)), []byte(strings.Repeat("o", 16))}}
+	rotated := []sessionKeyPair{{[]byte(strings.Repeat("n", 32)), []byte(strings.Repeat("n", 32))}, old[0]}
+
+	cookie := sessionCookie(t, old, "USER_ID")
+	if !cookie.Secure || !cookie.HttpOnly || cookie.MaxAge != int(SessionMaxAge.Seconds()) {
+		t.Errorf("Expected a secure HttpOnly cookie but got %v", cookie)
+	}
+	decoded, _ := base64.URLEncoding.DecodeString(cookie.Value)
+	if strings.Contains(string(decoded), "USER_ID") {
+		t.Error("Expected the cookie to be encrypted")
+	}
+
+	// Cookies of the old key are valid after a new key is added.
+	store := newCookieSessionStore(rotated, cookieOptions{})
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	s, err := store.New(r, SessionCookieName)
+	if err != nil || s.Values[SessionUserIdKey] != "USER_ID" {
+		t.Errorf("Expected to read the old cookie but got %v and %v", s.Values, err)
+	}
+
+	// And invalid after the old key is removed.
+	store = newCookieSessionStore(rotated[:1], cookieOptions{})
+	r, _ = http.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if s, err := store.New(r, SessionCookieName); err == nil || s.Values[SessionUserIdKey] != nil {
+		t.Errorf("Expected the old cookie to be rejected but got %v", s.Values)
+	}
+}
+
+func Test_addSameSite(t *testing.T) {
+	header := http.Header{"Set-Cookie": {"a=1; Path=/", "b=2; SameSite=Strict"}}
+	addSameSite(header, "Lax")
+	if cookies := header["Set-Cookie"]; cookies[0] != "a=1; Path=/; SameSite=Lax" || cookies[1] != "b=2; SameSite=Strict" {
+		t.Errorf("Expected SameSite to be added but got %v", cookies)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/sessions"
+	"github.com/codegangsta/martini-contrib/web"
+	"net/http"
+	"strings"
+)
+
+// Cookies are sent with cross-site requests too, so requests that change
+// anything must prove that they come from our pages with a token that only
+// our pages know. Logging in with a provider carries a random state for the
+// same reason so that nobody can log others in to their accounts.
+
+const SessionCsrfTokenKey string = "csrf-token"
+const SessionOAuthStateKey string = "oauth-state"
+
+// Header that the front-end sends the token in. Forms send it as the
+// csrf_token field.
+const CsrfHeader = "X-CSRF-Token"
+const CsrfField = "csrf_token"
+
+// CsrfToken is the token of the session, which pages embed.
+type CsrfToken string
+
+// randomToken returns a random URL-safe string.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// sessionToken returns the token saved in the session with the key, creating
+// one if there is none.
+func sessionToken(session sessions.Session, key string) (string, error) {
+	if token, ok := session.Get(key).(string); ok && token != "" {
+		return token, nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	session.Set(key, token)
+	return token, nil
+}
+
+func tokensEqual(a, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// requestCsrfToken returns the token sent with the request. The form is read
+// only if it's URL-encoded so that uploads are left to handlers.
+func requestCsrfToken(r *http.Request) string {
+	if token := r.Header.Get(CsrfHeader); token != "" {
+		return token
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return r.PostFormValue(CsrfField)
+	}
+	return ""
+}
+
+// newOAuthState returns a state for the authorization URL of a provider and
+// binds it to the session.
+func newOAuthState(session sessions.Session) (string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	session.Set(SessionOAuthStateKey, state)
+	return state, nil
+}
+
+// checkOAuthState returns whether the state came back from the provider to
+// the session that started logging in. A state can be used only once.
+func checkOAuthState(session sessions.Session, state string) bool {
+	expected, _ := session.Get(SessionOAuthStateKey).(string)
+	session.Delete(SessionOAuthStateKey)
+	return tokensEqual(expected, state)
+}
+
+//
+// Filters
+//
+
+// Csrf maps the session's CsrfToken and rejects requests with other methods
+// than GET, HEAD and OPTIONS without the token. Requests with API tokens
+// don't need it because browsers never send them by themselves.
+func Csrf(ctx *web.Context, c martini.Context, session sessions.Session) {
+	token, err := sessionToken(session, SessionCsrfTokenKey)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, hasBearer := bearerToken(ctx.Request)
+	if !isSafeMethod(ctx.Request.Method) && !hasBearer && !tokensEqual(token, requestCsrfToken(ctx.Request)) {
+		ctx.Abort(http.StatusForbidden, "Invalid CSRF token. Reload the page and try again.")
+		return
+	}
+	c.Map(CsrfToken(token))
+}
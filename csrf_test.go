@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/codegangsta/inject"
+	"github.com/codegangsta/martini-contrib/web"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func csrfRequest(session *mockSession, r *http.Request) (*httptest.ResponseRecorder, *mockContext) {
+	w := httptest.NewRecorder()
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	c := &mockContext{inject.New()}
+	Csrf(ctx, c, session)
+	return w, c
+}
+
+func Test_Csrf_get(t *testing.T) {
+	session := &mockSession{v: make(map[interface{}]interface{})}
+	r, _ := http.NewRequest("GET", "/", nil)
+	w, c := csrfRequest(session, r)
+	if w.Code != 200 {
+		t.Errorf("Expected GET to pass but got %d", w.Code)
+	}
+	token := c.Get(reflect.TypeOf(CsrfToken(""))).Interface().(CsrfToken)
+	if token == "" || session.Get(SessionCsrfTokenKey) != string(token) {
+		t.Errorf("Expected the session's token to be mapped but got %s", token)
+	}
+
+	// The token stays the same in the session.
+	_, c = csrfRequest(session, r)
+	if again := c.Get(reflect.TypeOf(CsrfToken(""))).Interface().(CsrfToken); again != token {
+		t.Errorf("Expected %s but got %s", token, again)
+	}
+}
+
+func Test_Csrf_post(t *testing.T) {
+	session := &mockSession{v: map[interface{}]interface{}{SessionCsrfTokenKey: "TOKEN"}}
+
+	cases := []struct {
+		header, field string
+		expected      int
+	}{
+		{"", "", http.StatusForbidden},
+		{"WRONG", "", http.StatusForbidden},
+		{"", "WRONG", http.StatusForbidden},
+		{"TOKEN", "", http.StatusOK},
+		{"", "TOKEN", http.StatusOK},
+	}
+	for _, c := range cases {
+		form := url.Values{CsrfField: {c.field}}
+		r, _ := http.NewRequest("POST", "/entries/2014-04-01", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c.header != "" {
+			r.Header.Set(CsrfHeader, c.header)
+		}
+		if w, _ := csrfRequest(session, r); w.Code != c.expected {
+			t.Errorf("Expected %d for header %q and field %q but got %d", c.expected, c.header, c.field, w.Code)
+		}
+	}
+}
+
+func Test_Csrf_newSession(t *testing.T) {
+	// A token is never empty so that an empty one doesn't match a new session.
+	session := &mockSession{v: make(map[interface{}]interface{})}
+	r, _ := http.NewRequest("DELETE", "/account", nil)
+	r.Header.Set(CsrfHeader, "")
+	if w, _ := csrfRequest(session, r); w.Code != http.StatusForbidden {
+		t.Errorf("Expected %d but got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func Test_RedirectToProvider_state(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/auth/mock", nil)
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	session := &mockSession{v: make(map[interface{}]interface{})}
+	RedirectToProvider(ctx, &mockIdentityProvider{}, session)
+
+	state, _ := session.Get(SessionOAuthStateKey).(string)
+	if state == "" || w.Header().Get("Location") != "AUTHORIZE_URL?state="+state {
+		t.Errorf("Expected to redirect with the state %s but got %s", state, w.Header().Get("Location"))
+	}
+}
+
+func Test_GetAccessToken_invalidState(t *testing.T) {
+	for _, stored := range []interface{}{nil, "STATE"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/auth/mock/callback?code=12345&state=OTHER", nil)
+		ctx := &web.Context{Request: r, ResponseWriter: w}
+		c := &mockContext{inject.New()}
+		provider := &mockIdentityProvider{token: AccessToken("TOKEN")}
+		session := &mockSession{v: map[interface{}]interface{}{SessionOAuthStateKey: stored}}
+		GetAccessToken(ctx, c, provider, session)
+
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/auth" || provider.code != "" {
+			t.Errorf("Expected to reject the state for %v but got %d", stored, w.Code)
+		}
+	}
+}
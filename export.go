@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"github.com/codegangsta/martini-contrib/web"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportEntries writes the user's entries to w as a ZIP archive with a
+// Markdown file per entry.
+func exportEntries(w io.Writer, entries EntryStore, user *User) error {
+	archive := zip.NewWriter(w)
+	err := eachEntry(entries, user, func(entry *Entry) error {
+		return writeExportedEntry(archive, entry, user.Location())
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// eachEntry calls f with each of the user's entries in date order. Entries
+// are read a month at a time so that the whole history is never in memory.
+func eachEntry(entries EntryStore, user *User, f func(entry *Entry) error) error {
+	// Find the range of months without loading bodies.
+	summaries, err := entries.Summaries(user)
+	if err != nil || len(summaries) == 0 {
+		return err
+	}
+	first, err := time.Parse("2006-01-02", summaries[0].Date)
+	if err != nil {
+		return err
+	}
+	last := summaries[len(summaries)-1].Date
+	for month := beginningOfMonth(first); dateStringOfTime(month) <= last; month = beginningOfNextMonth(month) {
+		from := dateStringOfTime(month)
+		to := dateString(month.Year(), month.Month(), daysIn(month.Month(), month.Year()))
+		es, err := entries.FindByDate(user, from, to)
+		if err != nil {
+			return err
+		}
+		for i := range es {
+			err = f(&es[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportPath returns the path of an entry in the archive such as
+// "2014/04/2014-04-01.md".
+func exportPath(entry *Entry) string {
+	return fmt.Sprintf("%s/%s/%s.md", entry.Date[:4], entry.Date[5:7], entry.Date)
+}
+
+func writeExportedEntry(archive *zip.Writer, entry *Entry, loc *time.Location) error {
+	header := &zip.FileHeader{Name: exportPath(entry), Method: zip.Deflate}
+	if entry.SavedAt != nil {
+		header.SetModTime(*entry.SavedAt)
+	}
+	f, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, frontMatter(entry, loc)+entry.Body)
+	if err == nil && !strings.HasSuffix(entry.Body, "\n") {
+		_, err = io.WriteString(f, "\n")
+	}
+	return err
+}
+
+// frontMatter returns YAML front matter of the entry with times in loc.
+func frontMatter(entry *Entry, loc *time.Location) string {
+	lines := []string{
+		"---",
+		"date: " + entry.Date,
+		fmt.Sprintf("characters: %d", entry.Count),
+	}
+	if entry.StartedAt != nil {
+		lines = append(lines, "started_at: "+entry.StartedAt.In(loc).Format(time.RFC3339))
+	}
+	if entry.SavedAt != nil {
+		lines = append(lines, "saved_at: "+entry.SavedAt.In(loc).Format(time.RFC3339))
+	}
+	if entry.ActiveSeconds > 0 {
+		lines = append(lines, fmt.Sprintf("active_seconds: %d", entry.ActiveSeconds))
+	}
+	lines = append(lines, "---", "", "")
+	return strings.Join(lines, "\n")
+}
+
+func beginningOfMonth(t time.Time) time.Time {
+	y, m, _ := t.Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+}
+
+//
+// Handlers
+//
+
+func ExportEntries(ctx *web.Context, entries EntryStore, user *User, l *log.Logger) {
+	format := ctx.Params["format"]
+	if format != "" && format != "zip" {
+		ctx.Abort(http.StatusBadRequest, "Unsupported format. Only zip is available.")
+		return
+	}
+
+	filename := fmt.Sprintf("morning-pages-%s.zip", user.Today())
+	ctx.SetHeader("Content-Type", "application/zip", true)
+	ctx.SetHeader("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename), true)
+	ctx.WriteHeader(http.StatusOK)
+
+	err := exportEntries(ctx.ResponseWriter, entries, user)
+	if err != nil {
+		// Too late to change the status. The client gets a broken archive.
+		l.Println("Failed to export entries", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"github.com/codegangsta/martini-contrib/web"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_ExportEntries(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	saveEntry(t, storage, user, "2014-03-31", "Hello")
+	saveEntry(t, storage, user, "2014-05-01", "World\n")
+
+	started := time.Date(2014, 3, 30, 21, 0, 0, 0, time.UTC)
+	entry, _ := storage.Entries.Find(user, "2014-03-31")
+	entry.StartedAt = &started
+	entry.ActiveSeconds = 300
+	storage.Entries.Update(entry)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/export?format=zip", nil)
+	ctx := &web.Context{Request: r, ResponseWriter: w, Params: map[string]string{"format": "zip"}}
+	ExportEntries(ctx, storage.Entries, user, log.New(os.Stdout, "", 0))
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/zip" {
+		t.Errorf("Expected %s but got %s", "application/zip", contentType)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"2014/03/2014-03-31.md": "---\ndate: 2014-03-31\ncharacters: 5\nstarted_at: 2014-03-31T06:00:00+09:00\nactive_seconds: 300\n---\n\nHello\n",
+		"2014/05/2014-05-01.md": "---\ndate: 2014-05-01\ncharacters: 6\n---\n\nWorld\n",
+	}
+	if len(archive.File) != len(expected) {
+		t.Fatalf("Expected %d files but got %d", len(expected), len(archive.File))
+	}
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if string(content) != expected[f.Name] {
+			t.Errorf("Expected %q for %s but got %q", expected[f.Name], f.Name, content)
+		}
+	}
+}
+
+func Test_ExportEntries_unsupportedFormat(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/export?format=pdf", nil)
+	ctx := &web.Context{Request: r, ResponseWriter: w, Params: map[string]string{"format": "pdf"}}
+	ExportEntries(ctx, storage.Entries, user, log.New(os.Stdout, "", 0))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d but got %d", http.StatusBadRequest, w.Code)
+	}
+}
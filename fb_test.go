@@ -1,14 +1,9 @@
 package main
 
 import (
-	"fmt"
 	"github.com/codegangsta/inject"
 	"github.com/codegangsta/martini-contrib/render"
 	"github.com/codegangsta/martini-contrib/sessions"
-	"github.com/codegangsta/martini-contrib/web"
-	"net/http"
-	"net/http/httptest"
-	"reflect"
 	"testing"
 )
 
@@ -68,6 +63,9 @@ func (session *mockSession) Delete(key interface{}) {
 
 func (session *mockSession) AddFlash(value interface{}, vars ...string) {
 	key := vars[0]
+	if session.flashes == nil {
+		session.flashes = make(map[interface{}][]interface{})
+	}
 	session.flashes[key] = append(session.flashes[key], value)
 }
 
@@ -77,6 +75,7 @@ func (session *mockSession) Flashes(vars ...string) []interface{} {
 	if !ok || len(values) == 0 {
 		return nil
 	}
+	delete(session.flashes, key)
 	return values
 }
 
@@ -98,207 +97,42 @@ func (ctx *mockContext) Written() bool {
 }
 
 //
-// Mock FacebookAuth
+// Mock IdentityProvider
 //
-type mockFacebookAuth struct {
-	token FacebookToken
-	user  *FacebookUser
-	code  string
+type mockIdentityProvider struct {
+	token    AccessToken
+	identity *Identity
+	code     string
 }
 
-func (fb *mockFacebookAuth) DialogUrl() string {
-	return "DIALOG_URL"
-}
-func (fb *mockFacebookAuth) AccessTokenUrl(code string) string {
-	fb.code = code
-	return "ACCESS_TOKEN_URL"
+func (p *mockIdentityProvider) Name() string {
+	return "mock"
 }
-func (fb *mockFacebookAuth) MyUrl(token FacebookToken) string {
-	return "MY_URL"
+func (p *mockIdentityProvider) DisplayName() string {
+	return "Mock"
 }
-func (fb *mockFacebookAuth) GetAccessToken(tokenUrl string) (FacebookToken, error) {
-	return fb.token, nil
+func (p *mockIdentityProvider) AuthorizeUrl(state string) string {
+	return "AUTHORIZE_URL?state=" + state
 }
-func (fb *mockFacebookAuth) GetUserInfo(userUrl string) (*FacebookUser, error) {
-	return fb.user, nil
+func (p *mockIdentityProvider) Exchange(code string) (AccessToken, error) {
+	p.code = code
+	return p.token, nil
 }
-
-func TestFacebookAuth_DialogUrl(t *testing.T) {
-	fb := NewFacebookAuth("APP_ID", "APP_SECRET", "http://somewhere.org/something")
-	expected := "https://www.facebook.com/dialog/oauth?client_id=APP_ID&redirect_uri=http%3A%2F%2Fsomewhere.org%2Fsomething"
-	if u := fb.DialogUrl(); u != expected {
-		t.Errorf("Expected %s but got %s", expected, u)
-	}
-}
-
-func TestFacebookAuth_AccessTokenUrl(t *testing.T) {
-	fb := NewFacebookAuth("APP_ID", "APP_SECRET", "http://somewhere.org/something")
-	code := "SOME_CODE"
-	expected := "https://graph.facebook.com/oauth/access_token?client_id=APP_ID&client_secret=APP_SECRET&code=SOME_CODE&redirect_uri=http%3A%2F%2Fsomewhere.org%2Fsomething"
-	if u := fb.AccessTokenUrl(code); u != expected {
-		t.Errorf("Expected %s but got %s", expected, u)
-	}
+func (p *mockIdentityProvider) Profile(token AccessToken) (*Identity, error) {
+	return p.identity, nil
 }
 
-func TestFacebookAuth_MyUrl(t *testing.T) {
-	fb := NewFacebookAuth("APP_ID", "APP_SECRET", "http://somewhere.org/something")
-	token := FacebookToken("SOME_TOKEN")
-	expected := "https://graph.facebook.com/me?access_token=SOME_TOKEN"
-	if u := fb.MyUrl(token); u != expected {
+func TestFacebookProvider_AuthorizeUrl(t *testing.T) {
+	fb := NewFacebookProvider("APP_ID", "APP_SECRET", "http://somewhere.org/something")
+	expected := "https://www.facebook.com/dialog/oauth?client_id=APP_ID&redirect_uri=http%3A%2F%2Fsomewhere.org%2Fsomething&response_type=code"
+	if u := fb.AuthorizeUrl(""); u != expected {
 		t.Errorf("Expected %s but got %s", expected, u)
 	}
 }
 
-func TestFacebookAuth_GetAccessToken_ok(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "access_token=HELLO")
-	}))
-	defer ts.Close()
-
-	fb := NewFacebookAuth("APP_ID", "APP_SECRET", "http://somewhere.org/something")
-	token, err := fb.GetAccessToken(ts.URL)
-	if err != nil {
-		t.Errorf("Got error %s", err.Error())
-	}
-
-	actual := (string)(token)
-	expected := "HELLO"
-	if actual != expected {
-		t.Errorf("Expected %s but got %s", expected, actual)
-	}
-}
-
-func TestFacebookAuth_GetAccessToken_err(t *testing.T) {
-	fb := NewFacebookAuth("APP_ID", "APP_SECRET", "http://somewhere.org/something")
-	_, err := fb.GetAccessToken("NOWHERE")
-	if err == nil {
-		t.Error("Expected an error but didn't get one")
-	}
-}
-
-func TestFacebookAuth_GetAccessToken_ng(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(400)
-		fmt.Fprintln(w, "Error!")
-	}))
-	defer ts.Close()
-
-	fb := NewFacebookAuth("APP_ID", "APP_SECRET", "http://somewhere.org/something")
-	_, err := fb.GetAccessToken(ts.URL)
-	if err == nil {
-		t.Error("Expected an error but didn't get one")
-	}
-}
-
-func TestFacebookAuth_GetUserInfo_ok(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, `{"id": "1234567890", "name": "Hello World"}`)
-	}))
-	defer ts.Close()
-
-	fb := NewFacebookAuth("APP_ID", "APP_SECRET", "http://somewhere.org/something")
-	user, err := fb.GetUserInfo(ts.URL)
-	if err != nil {
-		t.Errorf("Got error %s", err.Error())
-	}
-
-	expectedId := "1234567890"
-	expectedName := "Hello World"
-	if user.Id != expectedId {
-		t.Errorf("Expected %s but got %s", expectedId, user.Id)
-	}
-	if user.Name != expectedName {
-		t.Errorf("Expected %s but got %s", expectedName, user.Name)
-	}
-}
-
-func TestFacebookAuth_GetUserInfo_err(t *testing.T) {
-	fb := NewFacebookAuth("APP_ID", "APP_SECRET", "http://somewhere.org/something")
-	_, err := fb.GetUserInfo("NOWHERE")
-	if err == nil {
-		t.Error("Expected an error but didn't get one")
-	}
-}
-
-func TestFacebookAuth_GetUserInfo_ng(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(400)
-		fmt.Fprintln(w, "Error!")
-	}))
-	defer ts.Close()
-
-	fb := NewFacebookAuth("APP_ID", "APP_SECRET", "http://somewhere.org/something")
-	_, err := fb.GetUserInfo(ts.URL)
-	if err == nil {
-		t.Error("Expected an error but didn't get one")
-	}
-}
-
-func Test_ShowLogin(t *testing.T) {
-	render := &mockRender{}
-	fb := NewFacebookAuth("APP_ID", "APP_SECRET", "http://somewhere.org/something")
-	expectedStatus := 200
-	expectedName := "auth"
-	expectedFbUrl := "https://www.facebook.com/dialog/oauth?client_id=APP_ID&redirect_uri=http%3A%2F%2Fsomewhere.org%2Fsomething"
-	ShowLogin(render, fb)
-	if status := render.status; status != expectedStatus {
-		t.Errorf("Expected to set status %d but got %d", expectedStatus, status)
-	}
-	if name := render.name; name != expectedName {
-		t.Errorf("Expected to set name %s but got %s", expectedName, name)
-	}
-	if url := render.v.(map[string]interface{})["FacebookUrl"]; url != expectedFbUrl {
-		t.Errorf("Expected to set FacebookUrl %s but got %s", expectedFbUrl, url)
-	}
-}
-
-func Test_Logout(t *testing.T) {
-	w := httptest.NewRecorder()
-	r, err := http.NewRequest("", "", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	ctx := &web.Context{Request: r, ResponseWriter: w}
-	v := make(map[interface{}]interface{})
-	v[SessionUserIdKey] = "SOME_USER_KEY"
-	session := &mockSession{v: v}
-	Logout(ctx, session)
-
-	if _, ok := v[SessionUserIdKey]; ok {
-		t.Error("Expected to delete session user ID key but didn't")
-	}
-
-	expectedCode := 302
-	if w.Code != expectedCode {
-		t.Errorf("Expected %d but got %d", expectedCode, w.Code)
-	}
-
-	expectedLocation := "/auth"
-	if loc := w.HeaderMap["Location"][0]; loc != expectedLocation {
-		t.Errorf("Expected %s but got %s", expectedLocation, loc)
-	}
-}
-
-func Test_GetAccessToken(t *testing.T) {
-	w := httptest.NewRecorder()
-	r, err := http.NewRequest("GET", "/somewhere?code=12345", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	ctx := &web.Context{Request: r, ResponseWriter: w}
-	c := &mockContext{inject.New()}
-	fb := &mockFacebookAuth{token: FacebookToken("FB_TOKEN")}
-	GetAccessToken(ctx, c, fb)
-
-	expectedCode := "12345"
-	if fb.code != expectedCode {
-		t.Errorf("Expected %s but got %s", expectedCode, fb.code)
-	}
-
-	expectedToken := FacebookToken("FB_TOKEN")
-	token := c.Get(reflect.TypeOf(FacebookToken(""))).Interface().(FacebookToken)
-	if token != expectedToken {
-		t.Errorf("Expected %s but got %s", expectedToken, token)
+func TestFacebookProvider_Name(t *testing.T) {
+	fb := NewFacebookProvider("APP_ID", "APP_SECRET", "http://somewhere.org/something")
+	if fb.Name() != "facebook" || fb.DisplayName() != "Facebook" {
+		t.Errorf("Expected facebook and Facebook but got %s and %s", fb.Name(), fb.DisplayName())
 	}
 }
@@ -5,6 +5,7 @@ var React = require('react');
 var domready = require('domready');
 
 var EntryApp = require('./components/entry-app');
+var charcount = require('./lib/charcount');
 var utils = require('./lib/utils');
 
 var AppRouter = Backbone.Router.extend({
@@ -15,6 +16,8 @@ var AppRouter = Backbone.Router.extend({
     '': 'showToday',
     'entries/:date': 'show',
     'entries/:date/edit': 'edit',
+    'search/:query': 'search',
+    'search/:query/:page': 'search',
     // Facebook callback redirects to URL with '#_=_'.
     // http://stackoverflow.com/questions/7131909/facebook-callback-appends-to-return-url
     '_=_': 'showToday'
@@ -25,20 +28,37 @@ var AppRouter = Backbone.Router.extend({
   edit: function (date) {
     this.app.edit(date);
   },
+  search: function (query, page) {
+    this.app.search(query, parseInt(page, 10) || 1);
+  },
   showToday: function () {
-    this.navigate('entries/' + utils.dateToString(new Date()), { trigger: true });
+    this.navigate('entries/' + utils.today(), { trigger: true });
   }
 });
 
 domready(function () {
   var container = document.getElementById('mp-view-container');
   if (!container) return;
+  utils.serverToday = container.getAttribute('data-today');
+  charcount.options = {
+    excludeWhitespace: container.getAttribute('data-exclude-whitespace') === 'true',
+    excludePunctuation: container.getAttribute('data-exclude-punctuation') === 'true'
+  };
 
   var app = React.renderComponent(
     <EntryApp />,
     container
   );
 
-  new AppRouter({ app: app });
+  var router = new AppRouter({ app: app });
   Backbone.history.start();
+
+  var searchForm = document.getElementById('mp-search-form');
+  searchForm.addEventListener('submit', function (e) {
+    e.preventDefault();
+    var query = searchForm.elements.q.value.trim();
+    if (query) {
+      router.navigate('search/' + encodeURIComponent(query), { trigger: true });
+    }
+  });
 });
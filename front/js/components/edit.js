@@ -5,7 +5,13 @@ var React = require('react');
 var BackboneMixin = require('../lib/backbone-mixin');
 var utils = require('../lib/utils');
 
+// Pauses in typing longer than this don't count as writing time.
+var IDLE_MS = 60 * 1000;
+
 module.exports = React.createClass({
+  componentWillMount: function () {
+    this.resetWritingTime();
+  },
   componentDidMount: function() {
     this.wait();
   },
@@ -37,9 +43,19 @@ module.exports = React.createClass({
       } else {
         window.location = '#/entries/' + this.props.entry.get('date');
       }
-    }.bind(this)).fail(function () {
-      console.log('save failure', arguments[0].responseText);
-      this.setState({ dirty: true });
+    }.bind(this)).fail(function (xhr) {
+      console.log('save failure', xhr.responseText);
+      var error = xhr.responseJSON;
+      if (xhr.status === 409 || xhr.status === 412) {
+        // Saved on another device. Let the user choose which one to keep.
+        this.setState({ dirty: true, conflict: xhr.responseJSON });
+      } else if (xhr.status === 403 && error && error.error) {
+        // The page is no longer editable. Keep the text in the textarea so that
+        // the user can copy it somewhere.
+        this.setState({ dirty: true, error: error });
+      } else {
+        this.setState({ dirty: true });
+      }
     }.bind(this)).always(function () {
       if (auto) {
         this.wait();
@@ -47,11 +63,41 @@ module.exports = React.createClass({
     }.bind(this));
   },
   wait: function () {
-    if (this.isMounted()) {
+    if (this.isMounted() && !this.state.error && !this.state.conflict) {
       setTimeout(this.save.bind(this, true), 15 * 1000);
     }
   },
+  useServerCopy: function () {
+    var server = this.state.conflict;
+    this.props.entry.set(this.props.entry.parse(server));
+    this.resetWritingTime();
+    this.setState({ dirty: false, conflict: null, body: server.body }, this.wait);
+  },
+  overwrite: function () {
+    this.props.entry.set('version', this.state.conflict.version);
+    this.setState({ dirty: true, conflict: null }, this.save.bind(this, true));
+  },
+  resetWritingTime: function () {
+    this.baseSeconds = this.props.entry.get('activeSeconds') || 0;
+    this.activeMs = 0;
+    this.lastKeystroke = null;
+  },
+  // The server keeps the first keystroke and checks the active time against
+  // the time between saves.
+  trackWritingTime: function () {
+    var now = Date.now();
+    var entry = this.props.entry;
+    if (!entry.get('startedAt')) {
+      entry.set('startedAt', new Date(now).toISOString());
+    }
+    if (this.lastKeystroke && now - this.lastKeystroke < IDLE_MS) {
+      this.activeMs += now - this.lastKeystroke;
+    }
+    this.lastKeystroke = now;
+    entry.set('activeSeconds', this.baseSeconds + Math.floor(this.activeMs / 1000));
+  },
   handleChange: function (e) {
+    this.trackWritingTime();
     this.props.entry.set('body', e.target.value);
     this.setState({
       dirty: true,
@@ -60,7 +106,17 @@ module.exports = React.createClass({
   },
   render: function () {
     var status;
-    if (this.state.dirty === undefined) {
+    if (this.state.conflict) {
+      status = (
+        <span>
+          <i className="fa fa-warning" /> 他の端末で更新されています。
+          <button className="btn btn-default btn-xs" onClick={this.useServerCopy}>他の端末の内容を使う</button>
+          <button className="btn btn-default btn-xs" onClick={this.overwrite}>この内容で上書き</button>
+        </span>
+      );
+    } else if (this.state.error) {
+      status = <span><i className="fa fa-warning" /> {this.state.error.today} になったため保存できません。テキストをコピーしてください。</span>;
+    } else if (this.state.dirty === undefined) {
       status = '';
     } else if (this.state.dirty) {
       status = <span><i className="fa fa-pencil" /> 未保存</span>;
@@ -77,7 +133,7 @@ module.exports = React.createClass({
           <button className="btn btn-default" onClick={this.save.bind(this, false)}>完了</button>
           <span id="mp-entry-status">{status}</span>
           <p className="pull-right">
-            <span id="mp-char-count">{this.state.body.length}</span> 文字
+            <span id="mp-char-count">{this.props.entry.count()}</span> 文字
           </p>
         </div>
       </div>
@@ -6,12 +6,13 @@ var Entry = require('../models/entry');
 var EntryIndex = require('./entry-index');
 var View = require('./view');
 var Edit = require('./edit');
-var utils = require('../lib/utils');
+var Search = require('./search');
 
 module.exports = React.createClass({
   getInitialState: function () {
     return {
       editing: false,
+      search: null,
       date: undefined,
       entry: undefined
     };
@@ -29,6 +30,8 @@ module.exports = React.createClass({
       this.setState({ entry: entry });
     }.bind(this)).fail(function (xhr) {
       if (xhr.status === 404) {
+        // The server tells whether the page can be written.
+        entry.set('editable', !!(xhr.responseJSON && xhr.responseJSON.editable));
         this.setState({ entry: entry });
       } else {
         console.log('Failed to get entry.');
@@ -36,20 +39,26 @@ module.exports = React.createClass({
     }.bind(this));
   },
   show: function (date) {
-    this.setState({ date: date, editing: false });
+    this.setState({ date: date, editing: false, search: null });
   },
   edit: function (date) {
-    this.setState({ date: date, editing: true });
+    this.setState({ date: date, editing: true, search: null });
+  },
+  search: function (query, page) {
+    this.setState({ search: { query: query, page: page } });
   },
   render: function () {
+    if (this.state.search) {
+      return <Search query={this.state.search.query} page={this.state.search.page} />;
+    }
     if (!this.state.entry) {
       return <div></div>;
     }
 
-    var today = utils.dateToString(new Date());
-    var isEditable = today === this.state.entry.get('date');
+    // Decided by the server because it depends on the user's edit mode.
+    var isEditable = !!this.state.entry.get('editable');
     var button;
-    if (this.state.editing) {
+    if (this.state.editing && isEditable) {
       button = '';
     } else if (isEditable) {
       var editPath = '#entries/' + this.state.entry.get('date') + '/edit';
@@ -61,7 +70,7 @@ module.exports = React.createClass({
       <div>
         <EntryIndex date={this.state.date} />
         <h2>{this.state.entry.get('date')} {button}</h2>
-        {this.state.editing ? 
+        {this.state.editing && isEditable ?
           <Edit entry={this.state.entry} /> :
           <View entry={this.state.entry} />
         }
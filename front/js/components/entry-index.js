@@ -10,7 +10,7 @@ module.exports = React.createClass({
     return {
       from: null,
       to: null,
-      today: utils.dateToString(new Date()),
+      today: utils.today(),
       entries: new EntryList()
     };
   },
@@ -55,6 +55,8 @@ module.exports = React.createClass({
       var entry = this.state.entries.findWhere({ date: date });
       if (date === this.props.date) {
         items.push(<li key={date}><span className="mp-date-active">{day}</span></li>);
+      } else if (entry && entry.get('goalMet')) {
+        items.push(<li key={date}><a className="mp-date-complete" href={"#entries/" + date}>{day}</a></li>);
       } else if (entry || date === this.state.today) {
         items.push(<li key={date}><a href={"#entries/" + date}>{day}</a></li>);
       } else {
@@ -0,0 +1,61 @@
+/** @jsx React.DOM */
+
+var React = require('react');
+
+var Backbone = require('../lib/backbone-shim');
+
+module.exports = React.createClass({
+  getInitialState: function () {
+    return {
+      results: null
+    };
+  },
+  componentDidMount: function () {
+    this.search(this.props.query, this.props.page);
+  },
+  componentWillReceiveProps: function (nextProps) {
+    if (this.props.query !== nextProps.query || this.props.page !== nextProps.page) {
+      this.search(nextProps.query, nextProps.page);
+    }
+  },
+  search: function (query, page) {
+    var params = { q: query, page: page };
+    Backbone.$.getJSON('/entries/search', params).done(function (results) {
+      this.setState({ results: results });
+    }.bind(this)).fail(function () {
+      console.log('Failed to search entries.');
+    });
+  },
+  pagePath: function (page) {
+    return '#search/' + encodeURIComponent(this.props.query) + '/' + page;
+  },
+  render: function () {
+    var results = this.state.results;
+    if (!results) {
+      return <div></div>;
+    }
+
+    var items = results.results.map(function (result) {
+      return (
+        <li key={result.date} className="mp-search-result">
+          <a href={'#entries/' + result.date}>{result.date}</a>
+          <p dangerouslySetInnerHTML={ { __html: result.snippet } } />
+        </li>
+      );
+    });
+    var prev, next;
+    if (results.page > 1) {
+      prev = <li className="previous"><a href={this.pagePath(results.page - 1)}>前へ</a></li>;
+    }
+    if (results.page * results.perPage < results.total) {
+      next = <li className="next"><a href={this.pagePath(results.page + 1)}>次へ</a></li>;
+    }
+    return (
+      <div>
+        <h2>「{results.query}」の検索結果 <small>{results.total} 件</small></h2>
+        <ul className="mp-search-results">{items}</ul>
+        <ul className="pager">{prev}{next}</ul>
+      </div>
+    );
+  }
+});
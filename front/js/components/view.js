@@ -11,10 +11,15 @@ module.exports = React.createClass({
     return [this.props.entry];
   },
   render: function () {
+    var speed;
+    var cpm = this.props.entry.get('charsPerMinute');
+    if (cpm > 0) {
+      speed = <span> ({Math.round(this.props.entry.get('activeSeconds') / 60)} 分・{Math.round(cpm)} 文字/分)</span>;
+    }
     return (
       <div>
         <div dangerouslySetInnerHTML={ { __html: utils.lineBreak(this.props.entry.get('body')) } } />
-        <p className="pull-right"><span className="char-count">{this.props.entry.count()}</span> 文字</p>
+        <p className="pull-right"><span className="char-count">{this.props.entry.count()}</span> 文字{speed}</p>
       </div>
     );
   }
@@ -3,4 +3,14 @@ var jQuery = require('jquery');
 
 Backbone.$ = jQuery;
 
+// The server rejects requests that change anything without the CSRF token
+// embedded in the page.
+jQuery.ajaxPrefilter(function (options, originalOptions, xhr) {
+  if (/^(GET|HEAD|OPTIONS)$/i.test(options.type)) return;
+  var meta = document.querySelector('meta[name="csrf-token"]');
+  if (meta) {
+    xhr.setRequestHeader('X-CSRF-Token', meta.getAttribute('content'));
+  }
+});
+
 module.exports = Backbone;
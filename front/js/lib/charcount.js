@@ -0,0 +1,173 @@
+// Counts characters the way the server does in charcount.go so that the
+// count doesn't jump when an entry is saved. The Unicode tables are smaller
+// than Go's, so the server's count is used once the text is saved.
+
+var charcount = {
+  // The user's settings. Set by the server.
+  options: {
+    excludeWhitespace: false,
+    excludePunctuation: false
+  },
+  count: function (str, opts) {
+    opts = opts || charcount.options;
+    var codePoints = toCodePoints(str);
+    var count = 0;
+    var i = 0;
+    while (i < codePoints.length) {
+      var base = codePoints[i];
+      i = nextGrapheme(codePoints, i);
+      if (opts.excludeWhitespace && isSpace(base)) {
+        continue;
+      }
+      if (opts.excludePunctuation && isPunct(base)) {
+        continue;
+      }
+      count++;
+    }
+    return count;
+  }
+};
+
+function toCodePoints(str) {
+  var codePoints = [];
+  for (var i = 0; i < str.length; i++) {
+    var c = str.charCodeAt(i);
+    if (0xd800 <= c && c <= 0xdbff && i + 1 < str.length) {
+      var d = str.charCodeAt(i + 1);
+      if (0xdc00 <= d && d <= 0xdfff) {
+        codePoints.push((c - 0xd800) * 0x400 + (d - 0xdc00) + 0x10000);
+        i++;
+        continue;
+      }
+    }
+    codePoints.push(c);
+  }
+  return codePoints;
+}
+
+// nextGrapheme returns the index after the grapheme cluster starting at i.
+function nextGrapheme(codePoints, i) {
+  var base = codePoints[i];
+  i++;
+  if (base === 0x0d && codePoints[i] === 0x0a) {
+    return i + 1;
+  }
+  if (isControl(base)) {
+    return i;
+  }
+
+  var prev = base;
+  var regionalIndicators = isRegionalIndicator(base) ? 1 : 0;
+  while (i < codePoints.length) {
+    var r = codePoints[i];
+    var joins = isExtend(r) ||
+      prev === 0x200d && !isControl(r) ||
+      regionalIndicators === 1 && isRegionalIndicator(r) ||
+      hangulJoins(prev, r);
+    if (!joins) {
+      break;
+    }
+    if (isRegionalIndicator(r)) {
+      regionalIndicators++;
+    }
+    prev = r;
+    i++;
+  }
+  return i;
+}
+
+function inRanges(r, ranges) {
+  for (var i = 0; i < ranges.length; i += 2) {
+    if (ranges[i] <= r && r <= ranges[i + 1]) {
+      return true;
+    }
+  }
+  return false;
+}
+
+function isControl(r) {
+  return r <= 0x1f || 0x7f <= r && r <= 0x9f || r === 0x2028 || r === 0x2029;
+}
+
+// Combining marks including dakuten, handakuten and variation selectors,
+// ZWJ, halfwidth katakana voiced sound marks, emoji skin tone modifiers and
+// tags used in subdivision flags.
+var extendRanges = [
+  0x0300, 0x036f, 0x0483, 0x0489, 0x0591, 0x05bd, 0x0610, 0x061a,
+  0x064b, 0x065f, 0x0900, 0x0903, 0x093a, 0x094f, 0x0e31, 0x0e31,
+  0x0e34, 0x0e3a, 0x0e47, 0x0e4e, 0x1ab0, 0x1aff, 0x1dc0, 0x1dff,
+  0x200d, 0x200d, 0x20d0, 0x20ff, 0x302a, 0x302f, 0x3099, 0x309a,
+  0xfe00, 0xfe0f, 0xfe20, 0xfe2f, 0xff9e, 0xff9f, 0x1f3fb, 0x1f3ff,
+  0xe0020, 0xe007f, 0xe0100, 0xe01ef
+];
+
+function isExtend(r) {
+  return inRanges(r, extendRanges);
+}
+
+function isRegionalIndicator(r) {
+  return 0x1f1e6 <= r && r <= 0x1f1ff;
+}
+
+var spaceRanges = [
+  0x09, 0x0d, 0x20, 0x20, 0x85, 0x85, 0xa0, 0xa0, 0x1680, 0x1680,
+  0x2000, 0x200a, 0x2028, 0x2029, 0x202f, 0x202f, 0x205f, 0x205f,
+  0x3000, 0x3000
+];
+
+function isSpace(r) {
+  return inRanges(r, spaceRanges);
+}
+
+// ASCII, Latin-1, general, CJK and fullwidth punctuation.
+var punctRanges = [
+  0x21, 0x23, 0x25, 0x2a, 0x2c, 0x2f, 0x3a, 0x3b, 0x3f, 0x40,
+  0x5b, 0x5d, 0x5f, 0x5f, 0x7b, 0x7b, 0x7d, 0x7d, 0xa1, 0xa1,
+  0xa7, 0xa7, 0xab, 0xab, 0xb6, 0xb7, 0xbb, 0xbb, 0xbf, 0xbf,
+  0x2010, 0x2027, 0x2030, 0x2043, 0x2045, 0x2051, 0x2053, 0x205e,
+  0x3001, 0x3003, 0x3008, 0x3011, 0x3014, 0x301f, 0x3030, 0x3030,
+  0x303d, 0x303d, 0x30a0, 0x30a0, 0x30fb, 0x30fb, 0xfe10, 0xfe19,
+  0xfe30, 0xfe4f, 0xff01, 0xff03, 0xff05, 0xff0a, 0xff0c, 0xff0f,
+  0xff1a, 0xff1b, 0xff1f, 0xff20, 0xff3b, 0xff3d, 0xff3f, 0xff3f,
+  0xff5b, 0xff5b, 0xff5d, 0xff5d, 0xff5f, 0xff65
+];
+
+function isPunct(r) {
+  return inRanges(r, punctRanges);
+}
+
+// Hangul syllable types for conjoining jamo.
+var HANGUL_NONE = 0, HANGUL_L = 1, HANGUL_V = 2, HANGUL_T = 3, HANGUL_LV = 4, HANGUL_LVT = 5;
+
+function hangulType(r) {
+  if (0x1100 <= r && r <= 0x115f || 0xa960 <= r && r <= 0xa97c) {
+    return HANGUL_L;
+  }
+  if (0x1160 <= r && r <= 0x11a7 || 0xd7b0 <= r && r <= 0xd7c6) {
+    return HANGUL_V;
+  }
+  if (0x11a8 <= r && r <= 0x11ff || 0xd7cb <= r && r <= 0xd7fb) {
+    return HANGUL_T;
+  }
+  if (0xac00 <= r && r <= 0xd7a3) {
+    return (r - 0xac00) % 28 === 0 ? HANGUL_LV : HANGUL_LVT;
+  }
+  return HANGUL_NONE;
+}
+
+function hangulJoins(prev, r) {
+  var p = hangulType(prev), t = hangulType(r);
+  switch (p) {
+  case HANGUL_L:
+    return t === HANGUL_L || t === HANGUL_V || t === HANGUL_LV || t === HANGUL_LVT;
+  case HANGUL_LV:
+  case HANGUL_V:
+    return t === HANGUL_V || t === HANGUL_T;
+  case HANGUL_LVT:
+  case HANGUL_T:
+    return t === HANGUL_T;
+  }
+  return false;
+}
+
+module.exports = charcount;
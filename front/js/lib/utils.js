@@ -1,4 +1,10 @@
 var utils = {
+  // Date of the page being written now. Set by the server because it depends
+  // on the user's timezone and the hour their day starts at.
+  serverToday: null,
+  today: function () {
+    return utils.serverToday || utils.dateToString(new Date());
+  },
   lineBreak: function (str) {
     return str.replace(/\r?\n/g, '<br />');
   },
@@ -1,4 +1,5 @@
 var Backbone = require('../lib/backbone-shim');
+var charcount = require('../lib/charcount');
 
 module.exports = Backbone.Model.extend({
   url: function () {
@@ -7,7 +8,20 @@ module.exports = Backbone.Model.extend({
   defaults: {
     body: ''
   },
+  initialize: function () {
+    this.countedBody = this.has('count') ? this.get('body') : null;
+  },
+  // Remembers which text the server counted.
+  parse: function (resp) {
+    this.countedBody = resp && resp.count !== undefined ? resp.body : null;
+    return resp;
+  },
+  // The server counts characters when saving. Count in the browser only while
+  // the text differs from the saved one.
   count: function () {
-    return this.get('body').length;
+    if (this.has('count') && this.get('body') === this.countedBody) {
+      return this.get('count');
+    }
+    return charcount.count(this.get('body'));
   }
 });
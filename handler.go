@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/codegangsta/martini"
 	"github.com/codegangsta/martini-contrib/render"
 	"github.com/codegangsta/martini-contrib/sessions"
@@ -9,36 +10,34 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const SessionUserIdKey string = "user-id"
 
+// The user who is linking another identity to their account.
+const SessionLinkUserIdKey string = "link-user-id"
+
+// The duplicate user found while linking an identity, to be merged.
+const SessionMergeUserIdKey string = "merge-user-id"
+
 //
 // Filters
 //
 
-func Authorize(ctx *web.Context, users UserStore, c martini.Context, session sessions.Session, l *log.Logger) {
-	userId := session.Get(SessionUserIdKey)
-	if userId == nil || userId == "" {
-		l.Println("Unauthorized access")
-		ctx.Redirect(http.StatusFound, "/auth")
-		return
-	}
-
-	user, err := users.Get(userId.(string))
-	if err != nil {
-		l.Println("User not found")
-		session.Delete(SessionUserIdKey)
-		ctx.Redirect(http.StatusFound, "/auth")
+func Authorize(ctx *web.Context, users UserStore, tokens TokenStore, logins SessionStore, c martini.Context, session sessions.Session, l *log.Logger) {
+	if secret, ok := bearerToken(ctx.Request); ok {
+		authorizeToken(ctx, c, users, tokens, secret)
 		return
 	}
-
-	c.Map(user)
+	authorizeSession(ctx, c, users, logins, session, l)
 }
 
-func ValidateDate(ctx *web.Context, params martini.Params) {
+func ValidateDate(ctx *web.Context, params martini.Params, user *User) {
 	date := params["date"]
-	if !isValidDate(date) {
+	if !isValidDate(date, user.Location()) {
 		ctx.Abort(http.StatusBadRequest, "Invalid date. e.g. 2014-01-02")
 		return
 	}
@@ -48,9 +47,22 @@ func ValidateDate(ctx *web.Context, params martini.Params) {
 // Handlers
 //
 
-func ShowRoot(ren render.Render, user *User) {
+// pageData returns the data that the layout needs. user is nil on pages for
+// guests.
+func pageData(user *User, token CsrfToken) map[string]interface{} {
 	data := make(map[string]interface{})
-	data["CurrentUser"] = user
+	data["CsrfToken"] = token
+	if user != nil {
+		data["CurrentUser"] = user
+		data["DailyGoal"] = formatNumber(user.Goal())
+		data["YearlyGoal"] = formatNumber(user.Goal() * 365)
+	}
+	return data
+}
+
+func ShowRoot(ren render.Render, token CsrfToken, user *User) {
+	data := pageData(user, token)
+	data["Today"] = user.Today()
 	ren.HTML(200, "view", data)
 }
 
@@ -58,6 +70,15 @@ func ShowRoot(ren render.Render, user *User) {
 // JSON APIs
 //
 
+// entryInfo tells the client whether the user can edit the entry now, which
+// depends on their edit mode.
+type entryInfo struct {
+	*Entry
+	Editable bool `json:"editable"`
+}
+
+// GetEntry returns the entry of the date. The 404 response of a missing entry
+// also tells whether it can be written.
 func GetEntry(ctx *web.Context, ren render.Render, entries EntryStore, params martini.Params, user *User) {
 	date := params["date"]
 	entry, err := entries.Find(user, date)
@@ -65,16 +86,24 @@ func GetEntry(ctx *web.Context, ren render.Render, entries EntryStore, params ma
 		ctx.Abort(http.StatusInternalServerError, err.Error())
 		return
 	}
+	editable := editPolicyOf(user).Check(user, date, time.Now()) == nil
 	if entry == nil {
-		ctx.Abort(http.StatusNotFound, "Entry not found")
+		ren.JSON(http.StatusNotFound, map[string]interface{}{"error": "Entry not found", "editable": editable})
 		return
 	}
-	ren.JSON(200, entry)
+	setETag(ctx, entry)
+	ren.JSON(200, &entryInfo{entry, editable})
 }
 
 func GetEntries(ctx *web.Context, ren render.Render, entries EntryStore, user *User) {
 	from := ctx.Params["from"]
 	to := ctx.Params["to"]
+	for _, date := range []string{from, to} {
+		if date != "" && !isValidDate(date, user.Location()) {
+			ctx.Abort(http.StatusBadRequest, "Invalid date. e.g. 2014-01-02")
+			return
+		}
+	}
 	es, err := entries.FindByDate(user, from, to)
 	if err != nil {
 		ctx.Abort(http.StatusInternalServerError, err.Error())
@@ -83,41 +112,94 @@ func GetEntries(ctx *web.Context, ren render.Render, entries EntryStore, user *U
 	ren.JSON(200, es)
 }
 
-func CreateEntry(ctx *web.Context, ren render.Render, entries EntryStore, params martini.Params, user *User, l *log.Logger) {
-	// TODO: Extract as filter.
+// CreateEntry creates the entry of the date. Retrying a request with the same
+// body succeeds so that it doesn't make duplicates, but a different body
+// replaces the existing entry only with its version.
+func CreateEntry(ctx *web.Context, ren render.Render, entries EntryStore, revisions RevisionStore, policy RevisionPolicy, params martini.Params, user *User, l *log.Logger) {
 	date := params["date"]
-	if date != todayString() {
-		ctx.Abort(http.StatusBadRequest, "Past entries are not editable")
-		return
-	}
 
 	requestBody, err := ioutil.ReadAll(ctx.Request.Body)
 	if err != nil {
 		ctx.Abort(http.StatusInternalServerError, err.Error())
 		return
 	}
-	entry := NewEntry(user, date)
-	err = json.Unmarshal(requestBody, &entry)
+	var input Entry
+	err = json.Unmarshal(requestBody, &input)
 	if err != nil {
 		ctx.Abort(http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	entryId, err := entries.Create(entry)
+	existing, err := entries.Find(user, date)
 	if err != nil {
 		ctx.Abort(http.StatusInternalServerError, err.Error())
 		return
 	}
-	entry.Id = entryId
 
+	entry := NewEntry(user, date)
+	entry.Body = input.Body
+	if existing != nil {
+		entry.StartedAt = existing.StartedAt
+		entry.SavedAt = existing.SavedAt
+		entry.ActiveSeconds = existing.ActiveSeconds
+	}
+	entry.recordWritingTime(&input, time.Now())
+	entry.updateDerivedFields(user)
+	conflictStatus := http.StatusConflict
+	version, ok := ifMatchVersion(ctx.Request, input.Version)
+	if ok {
+		entry.Version = version
+		conflictStatus = http.StatusPreconditionFailed
+	} else {
+		entry.Version = input.Version
+	}
+	if !ok && entry.Version == 0 {
+		// A client that hasn't seen the entry, such as a page opened before
+		// another device saved, can only create it or save the same body.
+		switch {
+		case existing == nil:
+			_, err = entries.Create(entry)
+			if err == ErrDuplicate {
+				err = ErrConflict
+			}
+		case existing.Body == entry.Body:
+			entry.Version = existing.Version
+			err = entries.Upsert(entry)
+		default:
+			err = ErrConflict
+		}
+	} else {
+		err = entries.Upsert(entry)
+	}
+	if err == ErrConflict {
+		renderCurrentEntry(ctx, ren, entries, user, date, conflictStatus)
+		return
+	}
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if existing != nil {
+		err = recordRevision(revisions, policy, entry, existing.Body, false)
+		if err != nil {
+			l.Println("Failed to record a revision", err)
+		}
+	}
+
+	setETag(ctx, entry)
 	ren.JSON(200, entry)
 }
 
-func UpdateEntry(ctx *web.Context, ren render.Render, entries EntryStore, params martini.Params, user *User, l *log.Logger) {
-	// TODO: Extract as filter.
+func UpdateEntry(ctx *web.Context, ren render.Render, entries EntryStore, revisions RevisionStore, policy RevisionPolicy, params martini.Params, user *User, l *log.Logger) {
 	date := params["date"]
-	if date != todayString() {
-		ctx.Abort(http.StatusBadRequest, "Past entries are not editable")
+
+	entry, err := entries.Find(user, date)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entry == nil {
+		ctx.Abort(http.StatusNotFound, "Entry not found")
 		return
 	}
 
@@ -126,18 +208,80 @@ func UpdateEntry(ctx *web.Context, ren render.Render, entries EntryStore, params
 		ctx.Abort(http.StatusInternalServerError, err.Error())
 		return
 	}
-	entry := NewEntry(user, date)
-	err = json.Unmarshal(requestBody, &entry)
+	// Only the body and the writing time are editable.
+	var input Entry
+	err = json.Unmarshal(requestBody, &input)
 	if err != nil {
 		ctx.Abort(http.StatusInternalServerError, err.Error())
 		return
 	}
+	oldBody := entry.Body
+	entry.Body = input.Body
+	entry.recordWritingTime(&input, time.Now())
+	entry.updateDerivedFields(user)
 
+	// The store rejects the update if the entry has been updated since the
+	// client got its copy, e.g. on another device.
+	conflictStatus := http.StatusConflict
+	if version, ok := ifMatchVersion(ctx.Request, entry.Version); ok {
+		entry.Version = version
+		conflictStatus = http.StatusPreconditionFailed
+	} else {
+		entry.Version = input.Version
+	}
 	err = entries.Update(entry)
+	if err == ErrConflict {
+		renderCurrentEntry(ctx, ren, entries, user, date, conflictStatus)
+		return
+	}
 	if err != nil {
 		ctx.Abort(http.StatusInternalServerError, err.Error())
 		return
 	}
+	err = recordRevision(revisions, policy, entry, oldBody, false)
+	if err != nil {
+		l.Println("Failed to record a revision", err)
+	}
 
+	setETag(ctx, entry)
 	ren.JSON(200, entry)
 }
+
+// renderCurrentEntry responds with the server's copy of the entry so that the
+// client can resolve a conflict.
+func renderCurrentEntry(ctx *web.Context, ren render.Render, entries EntryStore, user *User, date string, status int) {
+	current, err := entries.Find(user, date)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if current == nil {
+		ctx.Abort(http.StatusNotFound, "Entry not found")
+		return
+	}
+	setETag(ctx, current)
+	ren.JSON(status, current)
+}
+
+func setETag(ctx *web.Context, entry *Entry) {
+	ctx.SetHeader("ETag", fmt.Sprintf(`"%d"`, entry.Version), true)
+}
+
+// ifMatchVersion returns the version in the If-Match header if it is given.
+// "*" matches any version, so current is returned for it.
+func ifMatchVersion(r *http.Request, current int) (int, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return 0, false
+	}
+	if header == "*" {
+		return current, true
+	}
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	version, err := strconv.Atoi(tag)
+	if err != nil {
+		// Never matches.
+		return -1, true
+	}
+	return version, true
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"fmt"
 	"github.com/codegangsta/martini"
 	"github.com/codegangsta/martini-contrib/web"
+	"log"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_ValidateDate_invalid(t *testing.T) {
 	w := httptest.NewRecorder()
 	ctx := &web.Context{ResponseWriter: w}
 	p := martini.Params{"date": "2013-1-1"}
-	ValidateDate(ctx, p)
+	ValidateDate(ctx, p, &User{})
 
 	badRequest := 400
 	if w.Code != badRequest {
@@ -23,10 +29,191 @@ func Test_ValidateDate_valid(t *testing.T) {
 	w := httptest.NewRecorder()
 	ctx := &web.Context{ResponseWriter: w}
 	p := martini.Params{"date": "2013-01-01"}
-	ValidateDate(ctx, p)
+	ValidateDate(ctx, p, &User{})
 
 	badRequest := 200
 	if w.Code != badRequest {
 		t.Errorf("Expected %d but got %d", badRequest, w.Code)
 	}
 }
+
+func putEntry(t *testing.T, storage *Storage, user *User, body string, header http.Header) (*httptest.ResponseRecorder, *mockRender) {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("PUT", "/entries/2014-04-01", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	render := &mockRender{}
+	params := martini.Params{"date": "2014-04-01"}
+	l := log.New(os.Stdout, "", 0)
+	UpdateEntry(ctx, render, storage.Entries, storage.Revisions, DefaultRevisionPolicy, params, user, l)
+	return w, render
+}
+
+func Test_UpdateEntry(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	storage.Entries.Create(NewEntry(user, "2014-04-01"))
+
+	w, render := putEntry(t, storage, user, `{"body": "Hello", "version": 1}`, nil)
+	if render.status != 200 {
+		t.Fatalf("Expected %d but got %d", 200, render.status)
+	}
+	if entry := render.v.(*Entry); entry.Body != "Hello" || entry.Version != 2 || entry.Count != 5 {
+		t.Errorf("Expected the updated entry but got %v", entry)
+	}
+	expectedETag := `"2"`
+	if etag := w.Header().Get("ETag"); etag != expectedETag {
+		t.Errorf("Expected %s but got %s", expectedETag, etag)
+	}
+}
+
+func Test_UpdateEntry_writingTime(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	storage.Entries.Create(NewEntry(user, "2014-04-01"))
+
+	started := time.Now().Add(-5 * time.Minute).UTC().Format(time.RFC3339)
+	body := fmt.Sprintf(`{"body": "Hello", "version": 1, "startedAt": "%s", "activeSeconds": 120}`, started)
+	_, render := putEntry(t, storage, user, body, nil)
+	if render.status != 200 {
+		t.Fatalf("Expected %d but got %d", 200, render.status)
+	}
+	entry := render.v.(*Entry)
+	if entry.StartedAt == nil || entry.StartedAt.Format(time.RFC3339) != started {
+		t.Errorf("Expected to start at %s but got %v", started, entry.StartedAt)
+	}
+	if entry.SavedAt == nil || entry.ActiveSeconds != 120 || entry.CharsPerMinute != 2.5 {
+		t.Errorf("Expected 120 seconds at 2.5 characters per minute but got %v", entry)
+	}
+}
+
+func Test_UpdateEntry_conflict(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	entry := NewEntry(user, "2014-04-01")
+	storage.Entries.Create(entry)
+	entry.Body = "From another device"
+	storage.Entries.Update(entry)
+
+	_, render := putEntry(t, storage, user, `{"body": "Hello", "version": 1}`, nil)
+	if render.status != 409 {
+		t.Fatalf("Expected %d but got %d", 409, render.status)
+	}
+	if current := render.v.(*Entry); current.Body != "From another device" {
+		t.Errorf("Expected the server's copy but got %v", current)
+	}
+}
+
+func Test_UpdateEntry_ifMatch(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	storage.Entries.Create(NewEntry(user, "2014-04-01"))
+
+	header := http.Header{"If-Match": {`"3"`}}
+	_, render := putEntry(t, storage, user, `{"body": "Hello", "version": 1}`, header)
+	if render.status != 412 {
+		t.Fatalf("Expected %d but got %d", 412, render.status)
+	}
+
+	header = http.Header{"If-Match": {`"1"`}}
+	_, render = putEntry(t, storage, user, `{"body": "Hello"}`, header)
+	if render.status != 200 {
+		t.Errorf("Expected %d but got %d", 200, render.status)
+	}
+}
+
+func postEntry(t *testing.T, storage *Storage, user *User, body string) *mockRender {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("POST", "/entries/2014-04-01", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	render := &mockRender{}
+	params := martini.Params{"date": "2014-04-01"}
+	l := log.New(os.Stdout, "", 0)
+	CreateEntry(ctx, render, storage.Entries, storage.Revisions, DefaultRevisionPolicy, params, user, l)
+	return render
+}
+
+func Test_CreateEntry_idempotent(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+
+	first := postEntry(t, storage, user, `{"body": "Hello"}`)
+	second := postEntry(t, storage, user, `{"body": "Hello"}`)
+	if first.status != 200 || second.status != 200 {
+		t.Fatalf("Expected %d but got %d and %d", 200, first.status, second.status)
+	}
+	if first.v.(*Entry).Id != second.v.(*Entry).Id {
+		t.Error("Expected the same entry for the same date")
+	}
+	es, _ := storage.Entries.FindByDate(user, "", "")
+	if len(es) != 1 {
+		t.Errorf("Expected %d entry but got %d", 1, len(es))
+	}
+}
+
+func Test_CreateEntry_otherDevice(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+
+	// A device saves first, and another that opened the empty page before
+	// autosaves without a version.
+	first := postEntry(t, storage, user, `{"body": "From the first device"}`)
+	if first.status != 200 {
+		t.Fatalf("Expected %d but got %d", 200, first.status)
+	}
+	second := postEntry(t, storage, user, `{"body": "From the second device"}`)
+	if second.status != 409 {
+		t.Fatalf("Expected %d but got %d", 409, second.status)
+	}
+	if current := second.v.(*Entry); current.Body != "From the first device" {
+		t.Errorf("Expected the server's copy but got %v", current)
+	}
+	if entry, _ := storage.Entries.Find(user, "2014-04-01"); entry.Body != "From the first device" {
+		t.Errorf("Expected not to overwrite but got %s", entry.Body)
+	}
+
+	// The second device can overwrite with the version.
+	version := first.v.(*Entry).Version
+	third := postEntry(t, storage, user, fmt.Sprintf(`{"body": "From the second device", "version": %d}`, version))
+	if third.status != 200 || third.v.(*Entry).Body != "From the second device" {
+		t.Errorf("Expected to overwrite with the version but got %d", third.status)
+	}
+}
+
+func getEntry(storage *Storage, user *User, date string) *mockRender {
+	r, _ := http.NewRequest("GET", "/entries/"+date, nil)
+	ctx := &web.Context{Request: r, ResponseWriter: httptest.NewRecorder()}
+	render := &mockRender{}
+	GetEntry(ctx, render, storage.Entries, martini.Params{"date": date}, user)
+	return render
+}
+
+func Test_GetEntry_editable(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	storage.Entries.Create(NewEntry(user, "2014-04-01"))
+
+	render := getEntry(storage, user, "2014-04-01")
+	if info := render.v.(*entryInfo); render.status != 200 || info.Date != "2014-04-01" || info.Editable {
+		t.Errorf("Expected a past entry not to be editable in the strict mode but got %d %v", render.status, render.v)
+	}
+
+	user.EditMode = EditModeAlways
+	render = getEntry(storage, user, "2014-04-01")
+	if info := render.v.(*entryInfo); !info.Editable {
+		t.Errorf("Expected a past entry to be editable in the always mode but got %v", info)
+	}
+
+	render = getEntry(storage, user, user.Today())
+	if data := render.v.(map[string]interface{}); render.status != 404 || data["editable"] != true {
+		t.Errorf("Expected today's missing entry to be editable but got %d %v", render.status, render.v)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Identity is a user's account at an identity provider.
+type Identity struct {
+	// Name of the provider such as "facebook".
+	Provider string `bson:"provider" json:"provider"`
+	// ID of the user at the provider.
+	Subject string `bson:"subject" json:"subject"`
+	Name    string `bson:"name,omitempty" json:"name"`
+	Email   string `bson:"email,omitempty" json:"email"`
+}
+
+type AccessToken string
+
+// Reasons of ProviderError.
+const (
+	// The user cancelled logging in at the provider.
+	LoginCancelled = "cancelled"
+	// The provider redirected back with an error.
+	LoginRefused = "refused"
+	// The callback is not of the login that the session started.
+	LoginInvalidState = "invalid_state"
+	// The provider couldn't be reached or responded with an error or
+	// something unexpected.
+	LoginProviderFailed = "provider_failed"
+)
+
+// ProviderError is why logging in with a provider failed.
+type ProviderError struct {
+	// DisplayName of the provider.
+	Provider string
+	Reason   string
+	// What happened for logs. Can be nil.
+	Err error
+}
+
+func (e *ProviderError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("Login with %s failed: %s", e.Provider, e.Reason)
+	}
+	return fmt.Sprintf("Login with %s failed: %s: %v", e.Provider, e.Reason, e.Err)
+}
+
+// Message explains what happened to the user.
+func (e *ProviderError) Message() string {
+	switch e.Reason {
+	case LoginCancelled:
+		return fmt.Sprintf("%s でのログインがキャンセルされました。", e.Provider)
+	case LoginRefused:
+		return fmt.Sprintf("%s でのログインが許可されませんでした。", e.Provider)
+	case LoginInvalidState:
+		return "ログインの有効期限が切れたか、別の画面から始められました。もう一度ログインしてください。"
+	}
+	return fmt.Sprintf("%s でのログインに失敗しました。しばらくしてからもう一度お試しください。", e.Provider)
+}
+
+func providerFailed(provider string, format string, args ...interface{}) *ProviderError {
+	return &ProviderError{Provider: provider, Reason: LoginProviderFailed, Err: fmt.Errorf(format, args...)}
+}
+
+// IdentityProvider logs users in with OAuth2:
+//
+//  1. Redirect the user to AuthorizeUrl.
+//  2. The provider redirects the user back to /auth/:provider/callback with a
+//     code, which is exchanged for an access token.
+//  3. Fetch the user's profile with the token.
+type IdentityProvider interface {
+	// Name is used in URLs such as /auth/facebook.
+	Name() string
+	// DisplayName is shown on the login page such as "Facebook".
+	DisplayName() string
+
+	AuthorizeUrl(state string) string
+	Exchange(code string) (AccessToken, error)
+	Profile(token AccessToken) (*Identity, error)
+}
+
+// IdentityProviders is the registry of providers available on the login page
+// in this order.
+type IdentityProviders []IdentityProvider
+
+// Get returns the provider of the name or nil.
+func (providers IdentityProviders) Get(name string) IdentityProvider {
+	for _, provider := range providers {
+		if provider.Name() == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+//
+// Generic OAuth2 and OpenID Connect provider
+//
+
+type OAuth2Config struct {
+	Name        string
+	DisplayName string
+
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string
+	Scopes       []string
+
+	AuthorizeUrl string
+	TokenUrl     string
+	// Returns the user's profile as a JSON object for the access token.
+	ProfileUrl string
+	// Field of the user's ID in the profile. "sub" if empty as in OpenID
+	// Connect.
+	SubjectField string
+}
+
+// Client of requests to providers. A provider that doesn't respond fails the
+// login or the startup instead of blocking them.
+var providerClient = &http.Client{Timeout: 10 * time.Second}
+
+type oauth2Provider struct {
+	config OAuth2Config
+	client *http.Client
+}
+
+func NewOAuth2Provider(config OAuth2Config) IdentityProvider {
+	if config.SubjectField == "" {
+		config.SubjectField = "sub"
+	}
+	if config.DisplayName == "" {
+		config.DisplayName = config.Name
+	}
+	return &oauth2Provider{config: config, client: providerClient}
+}
+
+func (p *oauth2Provider) Name() string {
+	return p.config.Name
+}
+
+func (p *oauth2Provider) DisplayName() string {
+	return p.config.DisplayName
+}
+
+func (p *oauth2Provider) AuthorizeUrl(state string) string {
+	params := url.Values{}
+	params.Add("client_id", p.config.ClientId)
+	params.Add("redirect_uri", p.config.RedirectUrl)
+	params.Add("response_type", "code")
+	if len(p.config.Scopes) > 0 {
+		params.Add("scope", strings.Join(p.config.Scopes, " "))
+	}
+	if state != "" {
+		params.Add("state", state)
+	}
+	return appendQuery(p.config.AuthorizeUrl, params)
+}
+
+func (p *oauth2Provider) Exchange(code string) (AccessToken, error) {
+	params := url.Values{}
+	params.Add("grant_type", "authorization_code")
+	params.Add("code", code)
+	params.Add("redirect_uri", p.config.RedirectUrl)
+	params.Add("client_id", p.config.ClientId)
+	params.Add("client_secret", p.config.ClientSecret)
+
+	name := p.config.DisplayName
+	res, err := p.client.PostForm(p.config.TokenUrl, params)
+	if err != nil {
+		return "", providerFailed(name, "%v", err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", providerFailed(name, "%v", err)
+	}
+
+	// Some providers such as Facebook respond with a query string instead of
+	// JSON.
+	var data struct {
+		AccessToken      interface{} `json:"access_token"`
+		Error            interface{} `json:"error"`
+		ErrorDescription interface{} `json:"error_description"`
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "{") {
+		err = json.Unmarshal(body, &data)
+	} else {
+		var values url.Values
+		values, err = url.ParseQuery(strings.TrimSpace(string(body)))
+		data.AccessToken = values.Get("access_token")
+		data.Error = values.Get("error")
+		data.ErrorDescription = values.Get("error_description")
+	}
+	if err != nil {
+		return "", providerFailed(name, "Malformed token response with status %d: %v", res.StatusCode, err)
+	}
+	token, _ := data.AccessToken.(string)
+	if res.StatusCode != 200 || token == "" {
+		return "", providerFailed(name, "No access token with status %d: %v %v", res.StatusCode, data.Error, data.ErrorDescription)
+	}
+	return AccessToken(token), nil
+}
+
+func (p *oauth2Provider) Profile(token AccessToken) (*Identity, error) {
+	name := p.config.DisplayName
+	req, err := http.NewRequest("GET", p.config.ProfileUrl, nil)
+	if err != nil {
+		return nil, providerFailed(name, "%v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+string(token))
+	req.Header.Set("Accept", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, providerFailed(name, "%v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, providerFailed(name, "Profile responded with status %d", res.StatusCode)
+	}
+
+	var profile map[string]interface{}
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber()
+	err = decoder.Decode(&profile)
+	if err != nil {
+		return nil, providerFailed(name, "Malformed profile: %v", err)
+	}
+	identity := &Identity{
+		Provider: p.config.Name,
+		Subject:  profileString(profile, p.config.SubjectField),
+		Name:     profileString(profile, "name"),
+		Email:    profileString(profile, "email"),
+	}
+	if identity.Subject == "" {
+		return nil, providerFailed(name, "No %s in the profile", p.config.SubjectField)
+	}
+	return identity, nil
+}
+
+// profileString returns a string or a number in the profile as a string.
+func profileString(profile map[string]interface{}, field string) string {
+	switch v := profile[field].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+func appendQuery(baseUrl string, params url.Values) string {
+	if strings.Contains(baseUrl, "?") {
+		return baseUrl + "&" + params.Encode()
+	}
+	return baseUrl + "?" + params.Encode()
+}
+
+// discoverOpenIdConfig fills endpoints of the config that are not set with
+// the OpenID Connect discovery document of the issuer.
+func discoverOpenIdConfig(config *OAuth2Config, issuer string) error {
+	res, err := providerClient.Get(strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("Failed to discover OpenID configuration of %s: %s", issuer, res.Status)
+	}
+	var discovery struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&discovery)
+	if err != nil {
+		return err
+	}
+	if config.AuthorizeUrl == "" {
+		config.AuthorizeUrl = discovery.AuthorizationEndpoint
+	}
+	if config.TokenUrl == "" {
+		config.TokenUrl = discovery.TokenEndpoint
+	}
+	if config.ProfileUrl == "" {
+		config.ProfileUrl = discovery.UserinfoEndpoint
+	}
+	return nil
+}
+
+//
+// Configuration
+//
+
+// identityProvidersFromEnv configures Facebook with FB_* variables and the
+// providers listed in OAUTH_PROVIDERS such as "google,corp" with
+// OAUTH_<NAME>_* variables. Users can log in with email and password without
+// any providers.
+func identityProvidersFromEnv() (IdentityProviders, error) {
+	var providers IdentityProviders
+	if appId := os.Getenv("FB_APP_ID"); appId != "" {
+		providers = append(providers, NewFacebookProvider(appId, os.Getenv("FB_APP_SECRET"), os.Getenv("FB_REDIRECT_URL")))
+	}
+
+	for _, name := range strings.Split(os.Getenv("OAUTH_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == PasswordProvider {
+			return nil, fmt.Errorf("Identity provider name %s is reserved", name)
+		}
+		if providers.Get(name) != nil {
+			return nil, fmt.Errorf("Identity provider %s is configured twice", name)
+		}
+		config, err := oauth2ConfigFromEnv(name)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, NewOAuth2Provider(config))
+	}
+	return providers, nil
+}
+
+func oauth2ConfigFromEnv(name string) (OAuth2Config, error) {
+	prefix := "OAUTH_" + strings.ToUpper(name) + "_"
+	config := OAuth2Config{
+		Name:         name,
+		DisplayName:  os.Getenv(prefix + "DISPLAY_NAME"),
+		ClientId:     os.Getenv(prefix + "CLIENT_ID"),
+		ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		RedirectUrl:  os.Getenv(prefix + "REDIRECT_URL"),
+		AuthorizeUrl: os.Getenv(prefix + "AUTHORIZE_URL"),
+		TokenUrl:     os.Getenv(prefix + "TOKEN_URL"),
+		ProfileUrl:   os.Getenv(prefix + "PROFILE_URL"),
+		SubjectField: os.Getenv(prefix + "SUBJECT_FIELD"),
+	}
+	if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+		config.Scopes = strings.Fields(strings.Replace(scopes, ",", " ", -1))
+	}
+	if issuer := os.Getenv(prefix + "ISSUER"); issuer != "" {
+		if config.Scopes == nil {
+			config.Scopes = []string{"openid", "profile", "email"}
+		}
+		err := discoverOpenIdConfig(&config, issuer)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	if config.ClientId == "" || config.RedirectUrl == "" {
+		return config, fmt.Errorf("Set %sCLIENT_ID and %sREDIRECT_URL", prefix, prefix)
+	}
+	if config.AuthorizeUrl == "" || config.TokenUrl == "" || config.ProfileUrl == "" {
+		return config, fmt.Errorf("Set %sISSUER or %sAUTHORIZE_URL, %sTOKEN_URL and %sPROFILE_URL", prefix, prefix, prefix, prefix)
+	}
+	return config, nil
+}
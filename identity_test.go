@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// newIdentityServer starts a stand-in OpenID Connect provider that accepts the
+// code "GOOD_CODE" and the token "GOOD_TOKEN".
+func newIdentityServer() *httptest.Server {
+	mux := http.NewServeMux()
+	var ts *httptest.Server
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer": "%s", "authorization_endpoint": "%s/authorize", "token_endpoint": "%s/token", "userinfo_endpoint": "%s/userinfo"}`, ts.URL, ts.URL, ts.URL, ts.URL)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.FormValue("code") != "GOOD_CODE" || r.FormValue("client_secret") != "SECRET" {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, `{"error": "invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"access_token": "GOOD_TOKEN", "token_type": "Bearer"}`)
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer GOOD_TOKEN" {
+			w.WriteHeader(401)
+			return
+		}
+		fmt.Fprintln(w, `{"sub": "abc123", "name": "Hello World", "email": "hello@example.com"}`)
+	})
+	ts = httptest.NewServer(mux)
+	return ts
+}
+
+func newStandInProvider(t *testing.T, ts *httptest.Server) IdentityProvider {
+	config := OAuth2Config{
+		Name:         "standin",
+		ClientId:     "CLIENT_ID",
+		ClientSecret: "SECRET",
+		RedirectUrl:  "http://somewhere.org/auth/standin/callback",
+	}
+	if err := discoverOpenIdConfig(&config, ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	return NewOAuth2Provider(config)
+}
+
+func Test_oauth2Provider_AuthorizeUrl(t *testing.T) {
+	ts := newIdentityServer()
+	defer ts.Close()
+	provider := newStandInProvider(t, ts)
+
+	expected := ts.URL + "/authorize?client_id=CLIENT_ID&redirect_uri=http%3A%2F%2Fsomewhere.org%2Fauth%2Fstandin%2Fcallback&response_type=code&state=STATE"
+	if u := provider.AuthorizeUrl("STATE"); u != expected {
+		t.Errorf("Expected %s but got %s", expected, u)
+	}
+}
+
+func Test_oauth2Provider_Exchange(t *testing.T) {
+	ts := newIdentityServer()
+	defer ts.Close()
+	provider := newStandInProvider(t, ts)
+
+	token, err := provider.Exchange("GOOD_CODE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "GOOD_TOKEN" {
+		t.Errorf("Expected %s but got %s", "GOOD_TOKEN", token)
+	}
+
+	if _, err := provider.Exchange("BAD_CODE"); err == nil {
+		t.Error("Expected an error but didn't get one")
+	}
+}
+
+func Test_oauth2Provider_Exchange_queryString(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "access_token=HELLO&expires=5183999")
+	}))
+	defer ts.Close()
+
+	provider := NewOAuth2Provider(OAuth2Config{Name: "facebook", TokenUrl: ts.URL})
+	token, err := provider.Exchange("SOME_CODE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "HELLO" {
+		t.Errorf("Expected %s but got %s", "HELLO", token)
+	}
+}
+
+func Test_oauth2Provider_Exchange_err(t *testing.T) {
+	provider := NewOAuth2Provider(OAuth2Config{Name: "nowhere", TokenUrl: "NOWHERE"})
+	if _, err := provider.Exchange("SOME_CODE"); err == nil {
+		t.Error("Expected an error but didn't get one")
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"token_type": "Bearer"}`)
+	}))
+	defer ts.Close()
+	provider = NewOAuth2Provider(OAuth2Config{Name: "notoken", TokenUrl: ts.URL})
+	if _, err := provider.Exchange("SOME_CODE"); err == nil {
+		t.Error("Expected an error for a response without a token but didn't get one")
+	}
+}
+
+func Test_oauth2Provider_Exchange_timeout(t *testing.T) {
+	hung := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer ts.Close()
+	defer close(hung)
+	defer func(timeout time.Duration) { providerClient.Timeout = timeout }(providerClient.Timeout)
+	providerClient.Timeout = 100 * time.Millisecond
+
+	if err := discoverOpenIdConfig(&OAuth2Config{}, ts.URL); err == nil {
+		t.Error("Expected discovery to time out but it didn't")
+	}
+	provider := NewOAuth2Provider(OAuth2Config{Name: "hung", TokenUrl: ts.URL + "/token"})
+	if _, err := provider.Exchange("GOOD_CODE"); err == nil {
+		t.Error("Expected the exchange to time out but it didn't")
+	}
+}
+
+func Test_oauth2Provider_malformed(t *testing.T) {
+	responses := []string{
+		`{"access_token": 1234}`,
+		`{"access_token": "TOKEN"`,
+		`[]`,
+		"<html>Service Unavailable</html>",
+		"",
+	}
+	for _, response := range responses {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, response)
+		}))
+		provider := NewOAuth2Provider(OAuth2Config{Name: "broken", TokenUrl: ts.URL, ProfileUrl: ts.URL, SubjectField: "id"})
+
+		_, err := provider.Exchange("SOME_CODE")
+		if e, ok := err.(*ProviderError); !ok || e.Reason != LoginProviderFailed {
+			t.Errorf("Expected a ProviderError for the token response %q but got %v", response, err)
+		}
+		_, err = provider.Profile("TOKEN")
+		if e, ok := err.(*ProviderError); !ok || e.Reason != LoginProviderFailed {
+			t.Errorf("Expected a ProviderError for the profile %q but got %v", response, err)
+		}
+		ts.Close()
+	}
+}
+
+func Test_ProviderError_Message(t *testing.T) {
+	for _, reason := range []string{LoginCancelled, LoginRefused, LoginInvalidState, LoginProviderFailed} {
+		e := &ProviderError{Provider: "Facebook", Reason: reason}
+		if e.Message() == "" || e.Error() == "" {
+			t.Errorf("Expected messages for %s", reason)
+		}
+	}
+}
+
+func Test_oauth2Provider_Profile(t *testing.T) {
+	ts := newIdentityServer()
+	defer ts.Close()
+	provider := newStandInProvider(t, ts)
+
+	identity, err := provider.Profile("GOOD_TOKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Identity{Provider: "standin", Subject: "abc123", Name: "Hello World", Email: "hello@example.com"}
+	if *identity != expected {
+		t.Errorf("Expected %v but got %v", expected, *identity)
+	}
+
+	if _, err := provider.Profile("BAD_TOKEN"); err == nil {
+		t.Error("Expected an error but didn't get one")
+	}
+}
+
+func Test_oauth2Provider_Profile_numericId(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"id": 1234567890123, "name": "Hello World"}`)
+	}))
+	defer ts.Close()
+
+	provider := NewOAuth2Provider(OAuth2Config{Name: "numeric", ProfileUrl: ts.URL, SubjectField: "id"})
+	identity, err := provider.Profile("TOKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "1234567890123" {
+		t.Errorf("Expected %s but got %s", "1234567890123", identity.Subject)
+	}
+}
+
+func Test_oauth2Provider_Profile_noSubject(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"name": "Hello World"}`)
+	}))
+	defer ts.Close()
+
+	provider := NewOAuth2Provider(OAuth2Config{Name: "nosubject", ProfileUrl: ts.URL})
+	if _, err := provider.Profile("TOKEN"); err == nil {
+		t.Error("Expected an error but didn't get one")
+	}
+}
+
+func Test_IdentityProviders_Get(t *testing.T) {
+	fb := NewFacebookProvider("APP_ID", "APP_SECRET", "http://somewhere.org/something")
+	providers := IdentityProviders{fb}
+	if providers.Get("facebook") != fb {
+		t.Error("Expected to get the provider by name")
+	}
+	if providers.Get("twitter") != nil {
+		t.Error("Expected nil for an unknown provider")
+	}
+}
+
+func Test_identityProvidersFromEnv(t *testing.T) {
+	ts := newIdentityServer()
+	defer ts.Close()
+
+	env := map[string]string{
+		"FB_APP_ID":                   "",
+		"OAUTH_PROVIDERS":             "standin",
+		"OAUTH_STANDIN_ISSUER":        ts.URL,
+		"OAUTH_STANDIN_CLIENT_ID":     "CLIENT_ID",
+		"OAUTH_STANDIN_CLIENT_SECRET": "SECRET",
+		"OAUTH_STANDIN_REDIRECT_URL":  "http://somewhere.org/auth/standin/callback",
+		"OAUTH_STANDIN_DISPLAY_NAME":  "Stand-in",
+	}
+	for k, v := range env {
+		old := os.Getenv(k)
+		os.Setenv(k, v)
+		defer os.Setenv(k, old)
+	}
+
+	providers, err := identityProvidersFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 1 || providers[0].Name() != "standin" || providers[0].DisplayName() != "Stand-in" {
+		t.Fatalf("Expected the stand-in provider but got %v", providers)
+	}
+	if token, err := providers[0].Exchange("GOOD_CODE"); err != nil || token != "GOOD_TOKEN" {
+		t.Errorf("Expected the discovered token endpoint to work but got %v and %v", token, err)
+	}
+
+	os.Setenv("OAUTH_STANDIN_CLIENT_ID", "")
+	if _, err := identityProvidersFromEnv(); err == nil {
+		t.Error("Expected an error without a client ID but didn't get one")
+	}
+
+	os.Setenv("OAUTH_PROVIDERS", "password")
+	if _, err := identityProvidersFromEnv(); err == nil {
+		t.Error("Expected an error for the reserved name but didn't get one")
+	}
+
+	os.Setenv("OAUTH_PROVIDERS", "")
+	if providers, err := identityProvidersFromEnv(); len(providers) != 0 || err != nil {
+		t.Errorf("Expected no providers but got %v and %v", providers, err)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/codegangsta/martini-contrib/web"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of files to import.
+const (
+	// Monthly text exports of 750words.com.
+	ImportFormat750Words = "750words"
+	// JSON exports of Day One.
+	ImportFormatDayOne = "dayone"
+	// .txt or .md files with dates in their names such as 2014-04-01.md, as
+	// exported by this app.
+	ImportFormatFiles = "files"
+)
+
+// What to do when the user already has an entry of an imported date.
+const (
+	ImportConflictSkip      = "skip"
+	ImportConflictOverwrite = "overwrite"
+	ImportConflictAppend    = "append"
+)
+
+// Larger uploads are rejected.
+const MaxImportSize = 32 << 20
+
+// Archives that expand to more than this are rejected so that a small ZIP
+// archive can't use up the memory. Variable so that tests can lower it.
+var maxImportUncompressedSize int64 = 128 << 20
+
+var (
+	ErrImportTooLarge     = errors.New("Too large to import")
+	ErrImportNameRequired = errors.New("Give the file name as the name parameter such as name=2014-04-01.md")
+)
+
+// ImportedEntry is an entry parsed from an imported file.
+type ImportedEntry struct {
+	Date          string
+	Body          string
+	ActiveSeconds int
+}
+
+// ImportReport tells what has been done to each date.
+type ImportReport struct {
+	Created     []string `json:"created"`
+	Overwritten []string `json:"overwritten"`
+	Appended    []string `json:"appended"`
+	Skipped     []string `json:"skipped"`
+	// Files or entries that couldn't be imported and why.
+	Errors []string `json:"errors"`
+}
+
+func newImportReport() *ImportReport {
+	return &ImportReport{
+		Created:     []string{},
+		Overwritten: []string{},
+		Appended:    []string{},
+		Skipped:     []string{},
+		Errors:      []string{},
+	}
+}
+
+func isImportFormat(format string) bool {
+	return format == ImportFormat750Words || format == ImportFormatDayOne || format == ImportFormatFiles
+}
+
+func isImportConflict(conflict string) bool {
+	return conflict == ImportConflictSkip || conflict == ImportConflictOverwrite || conflict == ImportConflictAppend
+}
+
+// importFile is a file to import. A ZIP archive is read as the files in it.
+type importFile struct {
+	Name string
+	Data []byte
+}
+
+// readImportFiles returns the files in data if it is a ZIP archive, or data
+// itself as a file of the name, which is required because parsers look at it.
+func readImportFiles(name string, data []byte) ([]importFile, error) {
+	if !bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		if name == "" {
+			return nil, ErrImportNameRequired
+		}
+		return []importFile{{name, data}}, nil
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var files []importFile
+	var total int64
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		remaining := maxImportUncompressedSize - total
+		if f.UncompressedSize64 > uint64(remaining) {
+			return nil, ErrImportTooLarge
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		// The header can lie about the size.
+		content, err := ioutil.ReadAll(io.LimitReader(rc, remaining+1))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		total += int64(len(content))
+		if total > maxImportUncompressedSize {
+			return nil, ErrImportTooLarge
+		}
+		files = append(files, importFile{f.Name, content})
+	}
+	return files, nil
+}
+
+// readImportPath reads a file, a ZIP archive or files in a directory.
+func readImportPath(path string) ([]importFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return readImportFiles(filepath.Base(path), data)
+	}
+
+	var files []importFile
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, importFile{filepath.ToSlash(name), data})
+		return nil
+	})
+	return files, err
+}
+
+// parseImportFiles parses the files in the format. Files that can't be parsed
+// are reported as errors so that the others can still be imported.
+func parseImportFiles(format string, files []importFile, user *User, report *ImportReport) []ImportedEntry {
+	var imported []ImportedEntry
+	for _, f := range files {
+		base := filepath.Base(f.Name)
+		if strings.HasPrefix(base, ".") {
+			// e.g. .DS_Store
+			continue
+		}
+
+		var es []ImportedEntry
+		var err error
+		switch format {
+		case ImportFormat750Words:
+			es, err = parse750Words(bytes.NewReader(f.Data))
+		case ImportFormatDayOne:
+			if filepath.Ext(base) != ".json" {
+				// Photos and such.
+				continue
+			}
+			es, err = parseDayOne(f.Data, user)
+		case ImportFormatFiles:
+			ext := filepath.Ext(base)
+			if ext != ".txt" && ext != ".md" {
+				continue
+			}
+			var entry ImportedEntry
+			entry, err = parseDatedFile(f.Name, f.Data)
+			es = []ImportedEntry{entry}
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", f.Name, err))
+			continue
+		}
+		imported = append(imported, es...)
+	}
+	return imported
+}
+
+const entrySeparator750Words = "------ ENTRY ------"
+
+// parse750Words parses a monthly export of 750words.com:
+//
+//	------ ENTRY ------
+//	Date:    2014-04-01
+//	Words:   812
+//	Minutes: 15
+//
+//	Body...
+func parse750Words(r io.Reader) ([]ImportedEntry, error) {
+	var imported []ImportedEntry
+	var current *ImportedEntry
+	var body []string
+	inHeader := false
+
+	flush := func() {
+		if current != nil {
+			current.Body = strings.Join(body, "\n")
+			imported = append(imported, *current)
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == entrySeparator750Words {
+			flush()
+			current = &ImportedEntry{}
+			body = nil
+			inHeader = true
+			continue
+		}
+		if current == nil {
+			if strings.TrimSpace(line) != "" {
+				return nil, fmt.Errorf("not a 750words export")
+			}
+			continue
+		}
+		if inHeader {
+			if strings.TrimSpace(line) == "" {
+				inHeader = false
+				continue
+			}
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 {
+				inHeader = false
+				body = append(body, line)
+				continue
+			}
+			value := strings.TrimSpace(parts[1])
+			switch strings.ToLower(strings.TrimSpace(parts[0])) {
+			case "date":
+				current.Date = value
+			case "minutes":
+				minutes, err := strconv.Atoi(value)
+				if err == nil {
+					current.ActiveSeconds = minutes * 60
+				}
+			}
+			continue
+		}
+		body = append(body, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return imported, nil
+}
+
+type dayOneExport struct {
+	Entries []struct {
+		CreationDate time.Time `json:"creationDate"`
+		TimeZone     string    `json:"timeZone"`
+		Text         string    `json:"text"`
+	} `json:"entries"`
+}
+
+// parseDayOne parses a JSON export of Day One. Entries belong to dates in the
+// timezone they were written in, with the user's day start hour.
+func parseDayOne(data []byte, user *User) ([]ImportedEntry, error) {
+	var export dayOneExport
+	err := json.Unmarshal(data, &export)
+	if err != nil {
+		return nil, err
+	}
+	var imported []ImportedEntry
+	for _, e := range export.Entries {
+		if e.CreationDate.IsZero() {
+			return nil, fmt.Errorf("entry without creationDate")
+		}
+		loc, err := time.LoadLocation(e.TimeZone)
+		if e.TimeZone == "" || err != nil {
+			loc = user.Location()
+		}
+		date := logicalDate(e.CreationDate, loc, user.DayStartHour)
+		imported = append(imported, ImportedEntry{Date: date, Body: e.Text})
+	}
+	return imported, nil
+}
+
+var datedFileName = regexp.MustCompile(`(\d{4})-(\d{2})-(\d{2})`)
+
+// parseDatedFile parses a text file with the date in its name. Front matter
+// such as the one exported by this app is removed.
+func parseDatedFile(name string, data []byte) (ImportedEntry, error) {
+	date := datedFileName.FindString(filepath.Base(name))
+	if date == "" {
+		return ImportedEntry{}, fmt.Errorf("no date in the file name")
+	}
+	body := strings.Replace(string(data), "\r\n", "\n", -1)
+	if strings.HasPrefix(body, "---\n") {
+		if end := strings.Index(body[4:], "\n---\n"); end >= 0 {
+			body = strings.TrimPrefix(body[4+end+5:], "\n")
+		}
+	}
+	return ImportedEntry{Date: date, Body: body}, nil
+}
+
+// importEntries saves the imported entries of the user. Entries of the same
+// date are joined. Unlike editing, entries of any past date can be imported.
+func importEntries(entries EntryStore, revisions RevisionStore, policy RevisionPolicy, user *User, imported []ImportedEntry, conflict string, report *ImportReport) error {
+	byDate := make(map[string]*ImportedEntry)
+	var dates []string
+	for _, e := range imported {
+		e.Body = strings.Trim(strings.Replace(e.Body, "\r\n", "\n", -1), "\n")
+		if joined, ok := byDate[e.Date]; ok {
+			joined.Body = joinBodies(joined.Body, e.Body)
+			joined.ActiveSeconds += e.ActiveSeconds
+			continue
+		}
+		e := e
+		byDate[e.Date] = &e
+		dates = append(dates, e.Date)
+	}
+	sort.Strings(dates)
+
+	today := user.Today()
+	for _, date := range dates {
+		e := byDate[date]
+		if !isValidDate(date, user.Location()) {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: invalid date", date))
+			continue
+		}
+		if date > today {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: future date", date))
+			continue
+		}
+
+		existing, err := entries.Find(user, date)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			entry := NewEntry(user, date)
+			entry.Body = e.Body
+			entry.ActiveSeconds = e.ActiveSeconds
+			entry.updateDerivedFields(user)
+			_, err = entries.Create(entry)
+			if err != nil {
+				return err
+			}
+			report.Created = append(report.Created, date)
+			continue
+		}
+
+		oldBody := existing.Body
+		switch conflict {
+		case ImportConflictOverwrite:
+			existing.Body = e.Body
+			existing.ActiveSeconds = e.ActiveSeconds
+		case ImportConflictAppend:
+			existing.Body = joinBodies(existing.Body, e.Body)
+			existing.ActiveSeconds += e.ActiveSeconds
+		default:
+			report.Skipped = append(report.Skipped, date)
+			continue
+		}
+		existing.updateDerivedFields(user)
+		err = entries.Update(existing)
+		if err == ErrConflict {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: updated while importing", date))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Keep the replaced body so that an import can be undone.
+		err = recordRevision(revisions, policy, existing, oldBody, true)
+		if err != nil {
+			return err
+		}
+		if conflict == ImportConflictOverwrite {
+			report.Overwritten = append(report.Overwritten, date)
+		} else {
+			report.Appended = append(report.Appended, date)
+		}
+	}
+	return nil
+}
+
+func joinBodies(a, b string) string {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	return a + "\n\n" + b
+}
+
+//
+// JSON APIs
+//
+
+// ImportEntries imports the request body, a file or a ZIP archive of files,
+// in the format given by the format parameter.
+func ImportEntries(ctx *web.Context, ren render.Render, entries EntryStore, revisions RevisionStore, policy RevisionPolicy, user *User) {
+	format := ctx.Params["format"]
+	if !isImportFormat(format) {
+		ctx.Abort(http.StatusBadRequest, "Unsupported format. Use 750words, dayone or files.")
+		return
+	}
+	conflict := ctx.Params["conflict"]
+	if conflict == "" {
+		conflict = ImportConflictSkip
+	}
+	if !isImportConflict(conflict) {
+		ctx.Abort(http.StatusBadRequest, "Invalid conflict. Use skip, overwrite or append.")
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(ctx.Request.Body, MaxImportSize+1))
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(data) > MaxImportSize {
+		ctx.Abort(http.StatusRequestEntityTooLarge, ErrImportTooLarge.Error())
+		return
+	}
+	files, err := readImportFiles(ctx.Params["name"], data)
+	if err == ErrImportTooLarge {
+		ctx.Abort(http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if err != nil {
+		ctx.Abort(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report := newImportReport()
+	imported := parseImportFiles(format, files, user, report)
+	err = importEntries(entries, revisions, policy, user, imported, conflict, report)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	ren.JSON(200, report)
+}
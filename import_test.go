@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"github.com/codegangsta/martini-contrib/web"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_parse750Words(t *testing.T) {
+	export := strings.Join([]string{
+		"------ ENTRY ------",
+		"Date:    2014-04-01",
+		"Words:   3",
+		"Minutes: 15",
+		"",
+		"First day.",
+		"",
+		"------ ENTRY ------",
+		"Date:    2014-04-02",
+		"Words:   2",
+		"Minutes: 5",
+		"",
+		"Second day.",
+		"",
+	}, "\r\n")
+	imported, err := parse750Words(strings.NewReader(export))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 2 {
+		t.Fatalf("Expected %d entries but got %v", 2, imported)
+	}
+	if e := imported[0]; e.Date != "2014-04-01" || e.Body != "First day.\n" || e.ActiveSeconds != 900 {
+		t.Errorf("Expected the first entry but got %v", e)
+	}
+	if e := imported[1]; e.Date != "2014-04-02" || e.Body != "Second day." || e.ActiveSeconds != 300 {
+		t.Errorf("Expected the second entry but got %v", e)
+	}
+
+	if _, err := parse750Words(strings.NewReader("Hello")); err == nil {
+		t.Error("Expected an error for a file of another format")
+	}
+}
+
+func Test_parseDayOne(t *testing.T) {
+	export := `{"metadata": {"version": "1.0"}, "entries": [
+		{"creationDate": "2014-03-31T20:00:00Z", "timeZone": "Asia/Tokyo", "text": "Morning in Tokyo"},
+		{"creationDate": "2014-04-01T02:00:00Z", "timeZone": "America/New_York", "text": "Late night in New York"}
+	]}`
+	user := &User{DayStartHour: 4}
+	imported, err := parseDayOne([]byte(export), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 2 || imported[0].Date != "2014-04-01" || imported[1].Date != "2014-03-31" {
+		t.Errorf("Expected dates in the timezones but got %v", imported)
+	}
+
+	if _, err := parseDayOne([]byte(`{"entries": [{"text": "No date"}]}`), user); err == nil {
+		t.Error("Expected an error for an entry without a date")
+	}
+}
+
+func Test_parseDatedFile(t *testing.T) {
+	e, err := parseDatedFile("2014/04/2014-04-01.md", []byte("---\ndate: 2014-04-01\ncharacters: 5\n---\n\nHello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Date != "2014-04-01" || e.Body != "Hello\n" {
+		t.Errorf("Expected the body without front matter but got %q", e.Body)
+	}
+	if _, err := parseDatedFile("notes.txt", []byte("Hello")); err == nil {
+		t.Error("Expected an error for a file without a date")
+	}
+}
+
+func Test_readImportFiles_zip(t *testing.T) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range []string{"2014-04-01.txt", "pages/2014-04-02.md"} {
+		f, _ := archive.Create(name)
+		f.Write([]byte("Body of " + name))
+	}
+	archive.Close()
+
+	files, err := readImportFiles("pages.zip", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[1].Name != "pages/2014-04-02.md" || string(files[1].Data) != "Body of pages/2014-04-02.md" {
+		t.Errorf("Expected files in the archive but got %v", files)
+	}
+}
+
+func zipArchive(files map[string]string) []byte {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, body := range files {
+		f, _ := archive.Create(name)
+		f.Write([]byte(body))
+	}
+	archive.Close()
+	return buf.Bytes()
+}
+
+func Test_readImportFiles_tooLarge(t *testing.T) {
+	defer func(size int64) { maxImportUncompressedSize = size }(maxImportUncompressedSize)
+	maxImportUncompressedSize = 1000
+
+	data := zipArchive(map[string]string{
+		"2014-04-01.txt": strings.Repeat("a", 600),
+		"2014-04-02.txt": strings.Repeat("b", 600),
+	})
+	if _, err := readImportFiles("pages.zip", data); err != ErrImportTooLarge {
+		t.Errorf("Expected ErrImportTooLarge but got %v", err)
+	}
+	data = zipArchive(map[string]string{"2014-04-01.txt": strings.Repeat("a", 1000)})
+	if files, err := readImportFiles("pages.zip", data); err != nil || len(files) != 1 {
+		t.Errorf("Expected a file within the limit but got %v and %v", files, err)
+	}
+}
+
+func Test_readImportFiles_name(t *testing.T) {
+	if _, err := readImportFiles("", []byte("Hello")); err != ErrImportNameRequired {
+		t.Errorf("Expected ErrImportNameRequired but got %v", err)
+	}
+	if files, err := readImportFiles("2014-04-01.md", []byte("Hello")); err != nil || len(files) != 1 || files[0].Name != "2014-04-01.md" {
+		t.Errorf("Expected the file but got %v and %v", files, err)
+	}
+}
+
+func importRequest(storage *Storage, user *User, params map[string]string, body []byte) (*httptest.ResponseRecorder, *mockRender) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/import", bytes.NewReader(body))
+	ctx := &web.Context{Request: r, ResponseWriter: w, Params: params}
+	render := &mockRender{}
+	ImportEntries(ctx, render, storage.Entries, storage.Revisions, DefaultRevisionPolicy, user)
+	return w, render
+}
+
+func Test_ImportEntries_file(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+
+	w, _ := importRequest(storage, user, map[string]string{"format": "files"}, []byte("Hello"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d without a name but got %d", http.StatusBadRequest, w.Code)
+	}
+
+	_, render := importRequest(storage, user, map[string]string{"format": "files", "name": "2014-04-01.md"}, []byte("Hello"))
+	if render.status != 200 {
+		t.Fatalf("Expected %d but got %d", 200, render.status)
+	}
+	if report := render.v.(*ImportReport); len(report.Created) != 1 || report.Created[0] != "2014-04-01" {
+		t.Errorf("Expected the entry to be created but got %v", report)
+	}
+	if entry, err := storage.Entries.Find(user, "2014-04-01"); err != nil || entry.Body != "Hello" {
+		t.Errorf("Expected the imported entry but got %v and %v", entry, err)
+	}
+}
+
+func Test_ImportEntries_tooLarge(t *testing.T) {
+	defer func(size int64) { maxImportUncompressedSize = size }(maxImportUncompressedSize)
+	maxImportUncompressedSize = 1000
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+
+	data := zipArchive(map[string]string{"2014-04-01.txt": strings.Repeat("a", 2000)})
+	w, _ := importRequest(storage, user, map[string]string{"format": "files"}, data)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected %d but got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func Test_importEntries(t *testing.T) {
+	for _, c := range []struct {
+		conflict string
+		body     string
+	}{
+		{ImportConflictSkip, "Existing"},
+		{ImportConflictOverwrite, "Imported"},
+		{ImportConflictAppend, "Existing\n\nImported"},
+	} {
+		storage := openMemoryStorage()
+		user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+		saveEntry(t, storage, user, "2014-04-01", "Existing")
+
+		imported := []ImportedEntry{
+			{Date: "2014-04-01", Body: "Imported\n"},
+			{Date: "2014-03-01", Body: "Old"},
+			{Date: "2014-03-01", Body: "Joined"},
+			{Date: "2014-02-30", Body: "Invalid"},
+			{Date: "2999-01-01", Body: "Future"},
+		}
+		report := newImportReport()
+		err := importEntries(storage.Entries, storage.Revisions, DefaultRevisionPolicy, user, imported, c.conflict, report)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(report.Created) != 1 || len(report.Errors) != 2 {
+			t.Errorf("Expected 1 created and 2 errors but got %v", report)
+		}
+		entry, _ := storage.Entries.Find(user, "2014-03-01")
+		if entry == nil || entry.Body != "Old\n\nJoined" || entry.Count != 11 {
+			t.Errorf("Expected joined entries but got %v", entry)
+		}
+		entry, _ = storage.Entries.Find(user, "2014-04-01")
+		if entry.Body != c.body {
+			t.Errorf("Expected %q for %s but got %q", c.body, c.conflict, entry.Body)
+		}
+		rs, _ := storage.Revisions.FindByEntry(entry)
+		if c.conflict != ImportConflictSkip && (len(rs) != 1 || rs[0].Body != "Existing") {
+			t.Errorf("Expected the replaced body to be kept as a revision but got %v", rs)
+		}
+	}
+}
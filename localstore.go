@@ -0,0 +1,1111 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"labix.org/v2/mgo/bson"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// Embedded storage keeps all the documents in memory and appends every change
+// to a log file per collection. The log is replayed on start.
+//
+
+// openMemoryStorage opens a storage without log files. Everything is lost
+// when the process exits.
+func openMemoryStorage() *Storage {
+	storage := &Storage{
+		Users:     newLocalUserStore(),
+		Entries:   newLocalEntryStore(),
+		Revisions: newLocalRevisionStore(),
+		Tokens:    newLocalTokenStore(),
+		Sessions:  newLocalSessionStore(),
+		closer:    func() {},
+	}
+	return storage
+}
+
+func openFileStorage(dir string) (*Storage, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []*fileLog
+	closeLogs := func() {
+		for _, log := range logs {
+			log.Close()
+		}
+	}
+	openLog := func(name string, store logStore) *fileLog {
+		if err != nil {
+			return nil
+		}
+		var log *fileLog
+		log, err = openStoreLog(filepath.Join(dir, name+".log"), store)
+		if err == nil {
+			logs = append(logs, log)
+		}
+		return log
+	}
+
+	users := newLocalUserStore()
+	users.log = openLog(UserCollectionName, users)
+	entries := newLocalEntryStore()
+	entries.log = openLog(EntryCollectionName, entries)
+	revisions := newLocalRevisionStore()
+	revisions.log = openLog(RevisionCollectionName, revisions)
+	tokens := newLocalTokenStore()
+	tokens.log = openLog(TokenCollectionName, tokens)
+	logins := newLocalSessionStore()
+	logins.log = openLog(SessionCollectionName, logins)
+	if err != nil {
+		closeLogs()
+		return nil, err
+	}
+
+	storage := &Storage{
+		Users:     users,
+		Entries:   entries,
+		Revisions: revisions,
+		Tokens:    tokens,
+		Sessions:  logins,
+		closer:    closeLogs,
+	}
+	return storage, nil
+}
+
+//
+// Log file
+//
+
+type logRecord struct {
+	Id      bson.ObjectId `bson:"_id"`
+	Deleted bool          `bson:"deleted,omitempty"`
+	Doc     bson.Raw      `bson:"doc"`
+}
+
+// fileLog is an append-only file of BSON documents. Each document is a
+// logRecord that puts or deletes a document of a collection.
+type fileLog struct {
+	path    string
+	file    *os.File
+	records int
+}
+
+// openFileLog replays the records in the file and opens it for appending.
+// A broken record at the end, left by a crash while writing, is discarded.
+func openFileLog(path string, replay func(rec *logRecord) error) (*fileLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	log := &fileLog{path: path, file: file}
+
+	var offset int64
+	for {
+		data, err := readDocument(file)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		var rec logRecord
+		err = bson.Unmarshal(data, &rec)
+		if err == nil {
+			err = replay(&rec)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		offset += int64(len(data))
+		log.records++
+	}
+
+	err = file.Truncate(offset)
+	if err == nil {
+		_, err = file.Seek(offset, os.SEEK_SET)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+// readDocument reads a BSON document, which starts with its length as int32.
+func readDocument(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	length := int(binary.LittleEndian.Uint32(header[:]))
+	if length < 5 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	copy(data, header[:])
+	_, err = io.ReadFull(r, data[4:])
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (log *fileLog) Put(id bson.ObjectId, doc interface{}) error {
+	return log.append(bson.M{"_id": id, "doc": doc})
+}
+
+func (log *fileLog) Delete(id bson.ObjectId) error {
+	return log.append(bson.M{"_id": id, "deleted": true})
+}
+
+func (log *fileLog) append(rec bson.M) error {
+	data, err := bson.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = log.file.Write(data)
+	if err != nil {
+		return err
+	}
+	log.records++
+	return log.file.Sync()
+}
+
+// Compact rewrites the log with only the current documents when it has grown
+// much larger than them.
+func (log *fileLog) Compact(docs map[bson.ObjectId]interface{}) error {
+	if log.records <= 2*len(docs)+64 {
+		return nil
+	}
+
+	tmpPath := log.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for id, doc := range docs {
+		data, err := bson.Marshal(bson.M{"_id": id, "doc": doc})
+		if err == nil {
+			_, err = tmp.Write(data)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	err = tmp.Sync()
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, log.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	file, err := os.OpenFile(log.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	log.file.Close()
+	log.file = file
+	log.records = len(docs)
+	return nil
+}
+
+func (log *fileLog) Close() error {
+	return log.file.Close()
+}
+
+// logStore is a local store that can be restored from a log.
+type logStore interface {
+	replay(rec *logRecord) error
+	docs() map[bson.ObjectId]interface{}
+}
+
+func openStoreLog(path string, store logStore) (*fileLog, error) {
+	log, err := openFileLog(path, store.replay)
+	if err != nil {
+		return nil, err
+	}
+	err = log.Compact(store.docs())
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+//
+// User
+//
+
+type localUserStore struct {
+	mutex sync.RWMutex
+	users map[bson.ObjectId]*User
+	log   *fileLog
+}
+
+func newLocalUserStore() *localUserStore {
+	return &localUserStore{users: make(map[bson.ObjectId]*User)}
+}
+
+func (store *localUserStore) Get(userId string) (*User, error) {
+	if !bson.IsObjectIdHex(userId) {
+		return nil, ErrNotFound
+	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	user, ok := store.users[bson.ObjectIdHex(userId)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *user
+	return &found, nil
+}
+
+func (store *localUserStore) FindByIdentity(identity *Identity) (*User, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	for _, user := range store.users {
+		if user.HasIdentity(identity) {
+			found := *user
+			return &found, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (store *localUserStore) CreateByIdentity(identity *Identity) (*User, error) {
+	user := newUser(identity)
+	err := store.Create(user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (store *localUserStore) Create(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.users[user.Id]; ok || store.hasIdentitiesOfOthers(user) {
+		return ErrDuplicate
+	}
+	return store.put(user)
+}
+
+func (store *localUserStore) Update(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.users[user.Id]; !ok {
+		return ErrNotFound
+	}
+	if store.hasIdentitiesOfOthers(user) {
+		return ErrDuplicate
+	}
+	return store.put(user)
+}
+
+func (store *localUserStore) RecordFailedLogin(user *User, max int, lockedUntil time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	saved, ok := store.users[user.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	updated := *saved
+	updated.FailedLogins++
+	if updated.FailedLogins >= max {
+		updated.FailedLogins = 0
+		updated.LockedUntil = &lockedUntil
+	}
+	err := store.put(&updated)
+	if err != nil {
+		return err
+	}
+	user.FailedLogins = updated.FailedLogins
+	user.LockedUntil = updated.LockedUntil
+	return nil
+}
+
+func (store *localUserStore) ResetFailedLogins(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	saved, ok := store.users[user.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	updated := *saved
+	updated.FailedLogins = 0
+	updated.LockedUntil = nil
+	err := store.put(&updated)
+	if err != nil {
+		return err
+	}
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	return nil
+}
+
+func (store *localUserStore) SetPasswordReset(user *User, reset *PasswordReset) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	saved, ok := store.users[user.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	updated := *saved
+	updated.PasswordReset = reset
+	err := store.put(&updated)
+	if err != nil {
+		return err
+	}
+	user.PasswordReset = reset
+	return nil
+}
+
+func (store *localUserStore) SetPassword(user *User, hash string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	saved, ok := store.users[user.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	updated := *saved
+	updated.PasswordHash = hash
+	updated.PasswordReset = nil
+	err := store.put(&updated)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	user.PasswordReset = nil
+	return nil
+}
+
+// hasIdentitiesOfOthers returns whether any of the user's identities belongs
+// to another user.
+func (store *localUserStore) hasIdentitiesOfOthers(user *User) bool {
+	for _, other := range store.users {
+		if other.Id == user.Id {
+			continue
+		}
+		for i := range user.Identities {
+			if other.HasIdentity(&user.Identities[i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (store *localUserStore) Remove(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.users[user.Id]; !ok {
+		return ErrNotFound
+	}
+	if store.log != nil {
+		err := store.log.Delete(user.Id)
+		if err != nil {
+			return err
+		}
+	}
+	delete(store.users, user.Id)
+	return nil
+}
+
+func (store *localUserStore) replay(rec *logRecord) error {
+	if rec.Deleted {
+		delete(store.users, rec.Id)
+		return nil
+	}
+	var user User
+	err := rec.Doc.Unmarshal(&user)
+	if err != nil {
+		return err
+	}
+	var legacy legacyIdentity
+	err = rec.Doc.Unmarshal(&legacy)
+	legacy.upgrade(&user)
+	store.users[rec.Id] = &user
+	return err
+}
+
+func (store *localUserStore) docs() map[bson.ObjectId]interface{} {
+	docs := make(map[bson.ObjectId]interface{}, len(store.users))
+	for id, user := range store.users {
+		docs[id] = user
+	}
+	return docs
+}
+
+func (store *localUserStore) put(user *User) error {
+	if store.log != nil {
+		err := store.log.Put(user.Id, user)
+		if err != nil {
+			return err
+		}
+	}
+	saved := *user
+	store.users[user.Id] = &saved
+	return nil
+}
+
+//
+// Entry
+//
+
+type localEntryStore struct {
+	mutex   sync.RWMutex
+	entries map[bson.ObjectId]*Entry
+	// Entry IDs by user ID and date, which are unique together.
+	ids map[string]bson.ObjectId
+	log *fileLog
+}
+
+func newLocalEntryStore() *localEntryStore {
+	return &localEntryStore{
+		entries: make(map[bson.ObjectId]*Entry),
+		ids:     make(map[string]bson.ObjectId),
+	}
+}
+
+func entryKey(userId bson.ObjectId, date string) string {
+	return userId.Hex() + "/" + date
+}
+
+type entriesByDate []Entry
+
+func (es entriesByDate) Len() int           { return len(es) }
+func (es entriesByDate) Swap(i, j int)      { es[i], es[j] = es[j], es[i] }
+func (es entriesByDate) Less(i, j int) bool { return es[i].Date < es[j].Date }
+
+func (store *localEntryStore) Find(user *User, date string) (*Entry, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	id, ok := store.ids[entryKey(user.Id, date)]
+	if !ok {
+		return nil, nil
+	}
+	found := *store.entries[id]
+	return &found, nil
+}
+
+func (store *localEntryStore) FindByDate(user *User, from, to string) ([]Entry, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var entries []Entry
+	for _, entry := range store.entries {
+		if entry.UserId != user.Id {
+			continue
+		}
+		if from != "" && entry.Date < from {
+			continue
+		}
+		if to != "" && entry.Date > to {
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	sort.Sort(entriesByDate(entries))
+	return entries, nil
+}
+
+func (store *localEntryStore) Create(entry *Entry) (bson.ObjectId, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.create(entry)
+}
+
+func (store *localEntryStore) create(entry *Entry) (bson.ObjectId, error) {
+	if _, ok := store.ids[entryKey(entry.UserId, entry.Date)]; ok {
+		return "", ErrDuplicate
+	}
+	entry.Id = bson.NewObjectId()
+	entry.Version = 1
+	err := store.put(entry)
+	return entry.Id, err
+}
+
+func (store *localEntryStore) Update(entry *Entry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.update(entry)
+}
+
+func (store *localEntryStore) update(entry *Entry) error {
+	saved, ok := store.entries[entry.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	if saved.Version != entry.Version {
+		return ErrConflict
+	}
+	updated := *entry
+	updated.Version++
+	err := store.put(&updated)
+	if err != nil {
+		return err
+	}
+	entry.Version = updated.Version
+	return nil
+}
+
+func (store *localEntryStore) Upsert(entry *Entry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	id, ok := store.ids[entryKey(entry.UserId, entry.Date)]
+	if !ok {
+		if entry.Version != 0 {
+			return ErrConflict
+		}
+		_, err := store.create(entry)
+		return err
+	}
+	entry.Id = id
+	if entry.Version == 0 {
+		entry.Version = store.entries[id].Version
+	}
+	return store.update(entry)
+}
+
+func (store *localEntryStore) Summaries(user *User) ([]EntrySummary, error) {
+	entries, err := store.FindByDate(user, "", "")
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]EntrySummary, len(entries))
+	for i, entry := range entries {
+		summaries[i] = entry.summary()
+	}
+	return summaries, nil
+}
+
+func (store *localEntryStore) Search(user *User, grams []string, skip, limit int) ([]Entry, int, error) {
+	entries, err := store.FindByDate(user, "", "")
+	if err != nil {
+		return nil, 0, err
+	}
+	var found []Entry
+	for _, entry := range entries {
+		if hasGrams(entry.Grams, grams) {
+			found = append(found, entry)
+		}
+	}
+	sort.Sort(sort.Reverse(entriesByDate(found)))
+	total := len(found)
+	if skip >= total {
+		return nil, total, nil
+	}
+	found = found[skip:]
+	if limit > 0 && limit < len(found) {
+		found = found[:limit]
+	}
+	return found, total, nil
+}
+
+func (store *localEntryStore) Remove(entry *Entry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.entries[entry.Id]; !ok {
+		return ErrNotFound
+	}
+	if store.log != nil {
+		err := store.log.Delete(entry.Id)
+		if err != nil {
+			return err
+		}
+	}
+	store.remove(entry.Id)
+	return nil
+}
+
+func (store *localEntryStore) RemoveByUser(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for id, entry := range store.entries {
+		if entry.UserId != user.Id {
+			continue
+		}
+		if store.log != nil {
+			err := store.log.Delete(id)
+			if err != nil {
+				return err
+			}
+		}
+		store.remove(id)
+	}
+	return nil
+}
+
+func (store *localEntryStore) replay(rec *logRecord) error {
+	if rec.Deleted {
+		store.remove(rec.Id)
+		return nil
+	}
+	var entry Entry
+	err := rec.Doc.Unmarshal(&entry)
+	store.remove(rec.Id)
+	store.entries[rec.Id] = &entry
+	store.ids[entryKey(entry.UserId, entry.Date)] = rec.Id
+	return err
+}
+
+func (store *localEntryStore) docs() map[bson.ObjectId]interface{} {
+	docs := make(map[bson.ObjectId]interface{}, len(store.entries))
+	for id, entry := range store.entries {
+		docs[id] = entry
+	}
+	return docs
+}
+
+func (store *localEntryStore) put(entry *Entry) error {
+	if store.log != nil {
+		err := store.log.Put(entry.Id, entry)
+		if err != nil {
+			return err
+		}
+	}
+	saved := *entry
+	store.remove(entry.Id)
+	store.entries[entry.Id] = &saved
+	store.ids[entryKey(entry.UserId, entry.Date)] = entry.Id
+	return nil
+}
+
+// remove removes an entry from memory.
+func (store *localEntryStore) remove(id bson.ObjectId) {
+	if entry, ok := store.entries[id]; ok {
+		delete(store.ids, entryKey(entry.UserId, entry.Date))
+		delete(store.entries, id)
+	}
+}
+
+//
+// Revision
+//
+
+type localRevisionStore struct {
+	mutex     sync.RWMutex
+	revisions map[bson.ObjectId]*Revision
+	log       *fileLog
+}
+
+func newLocalRevisionStore() *localRevisionStore {
+	return &localRevisionStore{revisions: make(map[bson.ObjectId]*Revision)}
+}
+
+type revisionsByNewest []Revision
+
+func (rs revisionsByNewest) Len() int           { return len(rs) }
+func (rs revisionsByNewest) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+func (rs revisionsByNewest) Less(i, j int) bool { return rs[i].CreatedAt.After(rs[j].CreatedAt) }
+
+func (store *localRevisionStore) Get(entry *Entry, revisionId string) (*Revision, error) {
+	if !bson.IsObjectIdHex(revisionId) {
+		return nil, ErrNotFound
+	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	revision, ok := store.revisions[bson.ObjectIdHex(revisionId)]
+	if !ok || revision.EntryId != entry.Id {
+		return nil, ErrNotFound
+	}
+	found := *revision
+	return &found, nil
+}
+
+func (store *localRevisionStore) FindByEntry(entry *Entry) ([]Revision, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var revisions []Revision
+	for _, revision := range store.revisions {
+		if revision.EntryId == entry.Id {
+			revisions = append(revisions, *revision)
+		}
+	}
+	sort.Sort(revisionsByNewest(revisions))
+	return revisions, nil
+}
+
+func (store *localRevisionStore) Create(revision *Revision) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.log != nil {
+		err := store.log.Put(revision.Id, revision)
+		if err != nil {
+			return err
+		}
+	}
+	saved := *revision
+	store.revisions[revision.Id] = &saved
+	return nil
+}
+
+func (store *localRevisionStore) Remove(ids []bson.ObjectId) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, id := range ids {
+		if _, ok := store.revisions[id]; !ok {
+			continue
+		}
+		if store.log != nil {
+			err := store.log.Delete(id)
+			if err != nil {
+				return err
+			}
+		}
+		delete(store.revisions, id)
+	}
+	return nil
+}
+
+func (store *localRevisionStore) RemoveByUser(user *User) error {
+	var ids []bson.ObjectId
+	store.mutex.RLock()
+	for id, revision := range store.revisions {
+		if revision.UserId == user.Id {
+			ids = append(ids, id)
+		}
+	}
+	store.mutex.RUnlock()
+	return store.Remove(ids)
+}
+
+func (store *localRevisionStore) MoveToEntry(from, to *Entry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for id, revision := range store.revisions {
+		if revision.EntryId != from.Id {
+			continue
+		}
+		moved := *revision
+		moved.EntryId = to.Id
+		moved.UserId = to.UserId
+		moved.Date = to.Date
+		if store.log != nil {
+			err := store.log.Put(id, &moved)
+			if err != nil {
+				return err
+			}
+		}
+		store.revisions[id] = &moved
+	}
+	return nil
+}
+
+func (store *localRevisionStore) replay(rec *logRecord) error {
+	if rec.Deleted {
+		delete(store.revisions, rec.Id)
+		return nil
+	}
+	var revision Revision
+	err := rec.Doc.Unmarshal(&revision)
+	store.revisions[rec.Id] = &revision
+	return err
+}
+
+func (store *localRevisionStore) docs() map[bson.ObjectId]interface{} {
+	docs := make(map[bson.ObjectId]interface{}, len(store.revisions))
+	for id, revision := range store.revisions {
+		docs[id] = revision
+	}
+	return docs
+}
+
+//
+// Token
+//
+
+type localTokenStore struct {
+	mutex  sync.RWMutex
+	tokens map[bson.ObjectId]*ApiToken
+	log    *fileLog
+}
+
+func newLocalTokenStore() *localTokenStore {
+	return &localTokenStore{tokens: make(map[bson.ObjectId]*ApiToken)}
+}
+
+type tokensByNewest []ApiToken
+
+func (ts tokensByNewest) Len() int           { return len(ts) }
+func (ts tokensByNewest) Swap(i, j int)      { ts[i], ts[j] = ts[j], ts[i] }
+func (ts tokensByNewest) Less(i, j int) bool { return ts[i].CreatedAt.After(ts[j].CreatedAt) }
+
+func (store *localTokenStore) FindByHash(hash string) (*ApiToken, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	for _, token := range store.tokens {
+		if token.Hash == hash {
+			found := *token
+			return &found, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (store *localTokenStore) FindByUser(user *User) ([]ApiToken, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var tokens []ApiToken
+	for _, token := range store.tokens {
+		if token.UserId == user.Id {
+			tokens = append(tokens, *token)
+		}
+	}
+	sort.Sort(tokensByNewest(tokens))
+	return tokens, nil
+}
+
+func (store *localTokenStore) Create(token *ApiToken) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.log != nil {
+		err := store.log.Put(token.Id, token)
+		if err != nil {
+			return err
+		}
+	}
+	saved := *token
+	store.tokens[token.Id] = &saved
+	return nil
+}
+
+func (store *localTokenStore) Remove(user *User, id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.remove(user, bson.ObjectIdHex(id))
+}
+
+func (store *localTokenStore) remove(user *User, id bson.ObjectId) error {
+	token, ok := store.tokens[id]
+	if !ok || token.UserId != user.Id {
+		return ErrNotFound
+	}
+	if store.log != nil {
+		err := store.log.Delete(id)
+		if err != nil {
+			return err
+		}
+	}
+	delete(store.tokens, id)
+	return nil
+}
+
+func (store *localTokenStore) RemoveByUser(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for id, token := range store.tokens {
+		if token.UserId != user.Id {
+			continue
+		}
+		err := store.remove(user, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *localTokenStore) replay(rec *logRecord) error {
+	if rec.Deleted {
+		delete(store.tokens, rec.Id)
+		return nil
+	}
+	var token ApiToken
+	err := rec.Doc.Unmarshal(&token)
+	store.tokens[rec.Id] = &token
+	return err
+}
+
+func (store *localTokenStore) docs() map[bson.ObjectId]interface{} {
+	docs := make(map[bson.ObjectId]interface{}, len(store.tokens))
+	for id, token := range store.tokens {
+		docs[id] = token
+	}
+	return docs
+}
+
+//
+// Session
+//
+
+type localSessionStore struct {
+	mutex    sync.RWMutex
+	sessions map[bson.ObjectId]*LoginSession
+	log      *fileLog
+}
+
+func newLocalSessionStore() *localSessionStore {
+	return &localSessionStore{sessions: make(map[bson.ObjectId]*LoginSession)}
+}
+
+type sessionsByLastSeen []LoginSession
+
+func (ss sessionsByLastSeen) Len() int           { return len(ss) }
+func (ss sessionsByLastSeen) Swap(i, j int)      { ss[i], ss[j] = ss[j], ss[i] }
+func (ss sessionsByLastSeen) Less(i, j int) bool { return ss[i].LastSeenAt.After(ss[j].LastSeenAt) }
+
+func (store *localSessionStore) Get(id string) (*LoginSession, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	s, ok := store.sessions[bson.ObjectIdHex(id)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *s
+	return &found, nil
+}
+
+func (store *localSessionStore) FindByUser(user *User) ([]LoginSession, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var ss []LoginSession
+	for _, s := range store.sessions {
+		if s.UserId == user.Id {
+			ss = append(ss, *s)
+		}
+	}
+	sort.Sort(sessionsByLastSeen(ss))
+	return ss, nil
+}
+
+func (store *localSessionStore) Create(s *LoginSession) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.put(s)
+}
+
+func (store *localSessionStore) Touch(s *LoginSession) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	saved, ok := store.sessions[s.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	touched := *saved
+	touched.LastSeenAt = s.LastSeenAt
+	return store.put(&touched)
+}
+
+func (store *localSessionStore) put(s *LoginSession) error {
+	if store.log != nil {
+		err := store.log.Put(s.Id, s)
+		if err != nil {
+			return err
+		}
+	}
+	saved := *s
+	store.sessions[s.Id] = &saved
+	return nil
+}
+
+func (store *localSessionStore) Remove(user *User, id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.remove(user, bson.ObjectIdHex(id))
+}
+
+func (store *localSessionStore) remove(user *User, id bson.ObjectId) error {
+	s, ok := store.sessions[id]
+	if !ok || s.UserId != user.Id {
+		return ErrNotFound
+	}
+	if store.log != nil {
+		err := store.log.Delete(id)
+		if err != nil {
+			return err
+		}
+	}
+	delete(store.sessions, id)
+	return nil
+}
+
+func (store *localSessionStore) RemoveByUser(user *User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for id, s := range store.sessions {
+		if s.UserId != user.Id {
+			continue
+		}
+		err := store.remove(user, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *localSessionStore) replay(rec *logRecord) error {
+	if rec.Deleted {
+		delete(store.sessions, rec.Id)
+		return nil
+	}
+	var s LoginSession
+	err := rec.Doc.Unmarshal(&s)
+	store.sessions[rec.Id] = &s
+	return err
+}
+
+func (store *localSessionStore) docs() map[bson.ObjectId]interface{} {
+	docs := make(map[bson.ObjectId]interface{}, len(store.sessions))
+	for id, s := range store.sessions {
+		docs[id] = s
+	}
+	return docs
+}
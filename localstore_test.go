@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempStorageDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "morning_pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func Test_openFileStorage_reopen(t *testing.T) {
+	dir := tempStorageDir(t)
+	defer os.RemoveAll(dir)
+
+	storage, err := openFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234", Name: "Hello World"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := NewEntry(user, "2014-04-01")
+	entry.Body = "Hello"
+	if _, err := storage.Entries.Create(entry); err != nil {
+		t.Fatal(err)
+	}
+	entry.Body = "Hello World"
+	if err := storage.Entries.Update(entry); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	storage, err = openFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	found, err := storage.Users.FindByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Id != user.Id {
+		t.Errorf("Expected %v but got %v", user.Id, found.Id)
+	}
+	foundEntry, err := storage.Entries.Find(user, "2014-04-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foundEntry == nil || foundEntry.Body != "Hello World" {
+		t.Errorf("Expected the updated entry but got %v", foundEntry)
+	}
+}
+
+func Test_openFileStorage_brokenTail(t *testing.T) {
+	dir := tempStorageDir(t)
+	defer os.RemoveAll(dir)
+
+	storage, err := openFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234", Name: "Hello World"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	// Simulate a crash while writing a record.
+	path := filepath.Join(dir, UserCollectionName+".log")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0x40, 0x00, 0x00, 0x00, 0x01})
+	f.Close()
+
+	storage, err = openFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if _, err := storage.Users.Get(user.Id.Hex()); err != nil {
+		t.Errorf("Expected to find the user but got %v", err)
+	}
+	if _, err := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "5678"}); err != nil {
+		t.Errorf("Expected to append after the broken record but got %v", err)
+	}
+}
+
+func Test_fileLog_Compact(t *testing.T) {
+	dir := tempStorageDir(t)
+	defer os.RemoveAll(dir)
+
+	storage, err := openFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234", Name: "Hello World"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := storage.Users.Update(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage.Close()
+
+	storage, err = openFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if records := storage.Users.(*localUserStore).log.records; records != 1 {
+		t.Errorf("Expected %d record but got %d", 1, records)
+	}
+	if _, err := storage.Users.Get(user.Id.Hex()); err != nil {
+		t.Errorf("Expected to find the user but got %v", err)
+	}
+}
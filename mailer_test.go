@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_fileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mailer := &fileMailer{filepath.Join(dir, "mail")}
+	if err := mailer.Send("alice@example.com", "Hello", "Body"); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "mail", "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected a file but got %v", files)
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if s := string(data); !strings.Contains(s, "To: alice@example.com\r\n") || !strings.HasSuffix(s, "\r\n\r\nBody") {
+		t.Errorf("Expected the mail but got %q", s)
+	}
+}
+
+func Test_mailerFromEnv(t *testing.T) {
+	old := os.Getenv("MAIL_URL")
+	defer os.Setenv("MAIL_URL", old)
+	l := log.New(ioutil.Discard, "", 0)
+
+	cases := map[string]string{
+		"":                     "*main.logMailer",
+		"log:":                 "*main.logMailer",
+		"file:///tmp/mail":     "*main.fileMailer",
+		"ftp://somewhere.org/": "",
+		"smtp://localhost:25":  "", // MAIL_FROM is required.
+	}
+	oldFrom := os.Getenv("MAIL_FROM")
+	defer os.Setenv("MAIL_FROM", oldFrom)
+	os.Setenv("MAIL_FROM", "")
+	for mailUrl, expected := range cases {
+		os.Setenv("MAIL_URL", mailUrl)
+		mailer, err := mailerFromEnv(l)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("Expected an error for %s but didn't get one", mailUrl)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected no error for %s but got %v", mailUrl, err)
+		} else if typ := fmt.Sprintf("%T", mailer); typ != expected {
+			t.Errorf("Expected %s for %s but got %s", expected, mailUrl, typ)
+		}
+	}
+}
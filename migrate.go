@@ -0,0 +1,483 @@
+package main
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"strings"
+	"time"
+)
+
+const MigrationCollectionName = "migrations"
+
+// Migration changes the schema or the data of the MongoDB database. Applied
+// migrations are recorded in the migrations collection and never run again.
+type Migration struct {
+	Id          string
+	Description string
+	// Up applies the migration. In dry-run mode, it only logs what it would do.
+	Up func(db *mgo.Database, dryRun bool, l *log.Logger) error
+}
+
+// Migrations run in this order. Append new ones to the end.
+var migrations = []Migration{
+	{
+		"20140501-backfill-entry-version",
+		"Set version 1 to entries saved before versioning",
+		backfillEntryVersion,
+	},
+	{
+		"20140501-merge-duplicate-entries",
+		"Merge entries of the same user and date",
+		mergeDuplicateEntries,
+	},
+	{
+		"20140501-index-entries-user-date",
+		"Unique index on user_id and date of entries",
+		ensureIndex(EntryCollectionName, mgo.Index{Key: []string{"user_id", "date"}, Unique: true}),
+	},
+	{
+		"20140501-index-users-uid",
+		"Index on uid of users",
+		ensureIndex(UserCollectionName, mgo.Index{Key: []string{"uid"}}),
+	},
+	{
+		"20140501-index-revisions-entry",
+		"Index on entry_id and created_at of revisions",
+		ensureIndex(RevisionCollectionName, mgo.Index{Key: []string{"entry_id", "-created_at"}}),
+	},
+	{
+		"20140510-backfill-entry-count",
+		"Count characters of entries saved before counting on the server",
+		backfillDerivedFields("count"),
+	},
+	{
+		"20140515-backfill-entry-goal",
+		"Record whether entries saved before daily goals met the goal",
+		backfillDerivedFields("goal_met"),
+	},
+	{
+		"20140520-backfill-entry-grams",
+		"Index bodies of entries saved before search",
+		backfillDerivedFields("grams"),
+	},
+	{
+		"20140520-index-entries-grams",
+		"Index on user_id and grams of entries",
+		ensureIndex(EntryCollectionName, mgo.Index{Key: []string{"user_id", "grams"}}),
+	},
+	{
+		"20140601-users-identity",
+		"Move Facebook user IDs of users to provider and subject",
+		moveUserIdentities,
+	},
+	{
+		"20140601-index-users-identity",
+		"Unique index on provider and subject of users",
+		ensureIndex(UserCollectionName, mgo.Index{Key: []string{"provider", "subject"}, Unique: true}),
+	},
+	{
+		"20140610-users-identities",
+		"Move provider and subject of users to lists of identities",
+		moveUserIdentitiesToList,
+	},
+	{
+		"20140610-index-users-identities",
+		"Unique index on provider and subject of identities of users",
+		ensureIndex(UserCollectionName, mgo.Index{Key: []string{"identities.provider", "identities.subject"}, Unique: true}),
+	},
+	{
+		"20140615-index-tokens-hash",
+		"Unique index on hash of tokens",
+		ensureIndex(TokenCollectionName, mgo.Index{Key: []string{"hash"}, Unique: true}),
+	},
+	{
+		"20140615-index-tokens-user",
+		"Index on user_id and created_at of tokens",
+		ensureIndex(TokenCollectionName, mgo.Index{Key: []string{"user_id", "-created_at"}}),
+	},
+	{
+		"20140622-index-sessions-user",
+		"Index on user_id and last_seen_at of sessions",
+		ensureIndex(SessionCollectionName, mgo.Index{Key: []string{"user_id", "-last_seen_at"}}),
+	},
+	{
+		"20140622-index-sessions-created",
+		"Remove sessions older than the max age",
+		ensureIndex(SessionCollectionName, mgo.Index{Key: []string{"created_at"}, ExpireAfter: SessionMaxAge}),
+	},
+}
+
+type migrationRecord struct {
+	Id        string    `bson:"_id"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+// Instances migrate at startup, so the one that inserts the lock document
+// migrates while the others wait. The holder refreshes the lock while it
+// migrates, and a lock that hasn't been refreshed for migrationLockTimeout is
+// left over from an instance that crashed and is taken over.
+const migrationLockId = "lock"
+
+var migrationLockTimeout = 10 * time.Minute
+var migrationLockRefreshInterval = time.Minute
+var migrationLockPollInterval = time.Second
+
+type migrationLock struct {
+	Id          string        `bson:"_id"`
+	Owner       bson.ObjectId `bson:"owner"`
+	RefreshedAt time.Time     `bson:"refreshed_at"`
+}
+
+// lockMigrations waits until no other instance is migrating and takes the
+// lock. Call the returned function to release it.
+func lockMigrations(c *mgo.Collection, l *log.Logger) (func(), error) {
+	owner := bson.NewObjectId()
+	waiting := false
+	for {
+		err := c.Insert(&migrationLock{Id: migrationLockId, Owner: owner, RefreshedAt: time.Now()})
+		if err == nil {
+			done := make(chan bool)
+			go refreshMigrationLock(c, owner, done, l)
+			return func() {
+				close(done)
+				err := c.Remove(bson.M{"_id": migrationLockId, "owner": owner})
+				if err != nil && err != mgo.ErrNotFound {
+					l.Println("Failed to release the migration lock", err)
+				}
+			}, nil
+		}
+		if !mgo.IsDup(err) {
+			return nil, err
+		}
+
+		var lock migrationLock
+		err = c.FindId(migrationLockId).One(&lock)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(lock.RefreshedAt) >= migrationLockTimeout {
+			l.Printf("Taking over a migration lock last refreshed at %s", lock.RefreshedAt)
+			err = c.Remove(bson.M{"_id": migrationLockId, "owner": lock.Owner, "refreshed_at": lock.RefreshedAt})
+			if err != nil && err != mgo.ErrNotFound {
+				return nil, err
+			}
+			continue
+		}
+		if !waiting {
+			l.Println("Waiting for another instance to migrate")
+			waiting = true
+		}
+		time.Sleep(migrationLockPollInterval)
+	}
+}
+
+// refreshMigrationLock keeps the lock of the owner until done is closed so
+// that long migrations aren't taken over.
+func refreshMigrationLock(c *mgo.Collection, owner bson.ObjectId, done chan bool, l *log.Logger) {
+	ticker := time.NewTicker(migrationLockRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := c.Update(bson.M{"_id": migrationLockId, "owner": owner}, bson.M{"$set": bson.M{"refreshed_at": time.Now()}})
+			if err != nil {
+				l.Println("Failed to refresh the migration lock", err)
+			}
+		}
+	}
+}
+
+// runMigrations applies migrations that haven't been applied yet. A dry run
+// only reads, so it doesn't take the lock.
+func runMigrations(db *mgo.Database, dryRun bool, l *log.Logger) error {
+	c := db.C(MigrationCollectionName)
+	if !dryRun {
+		unlock, err := lockMigrations(c, l)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	for _, migration := range migrations {
+		count, err := c.FindId(migration.Id).Count()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		l.Printf("Migrating %s: %s", migration.Id, migration.Description)
+		err = migration.Up(db, dryRun, l)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			continue
+		}
+		err = c.Insert(&migrationRecord{Id: migration.Id, AppliedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureIndex(collection string, index mgo.Index) func(*mgo.Database, bool, *log.Logger) error {
+	return func(db *mgo.Database, dryRun bool, l *log.Logger) error {
+		if dryRun {
+			l.Printf("Would ensure index %v on %s", index.Key, collection)
+			return nil
+		}
+		return db.C(collection).EnsureIndex(index)
+	}
+}
+
+//
+// Data migrations
+//
+
+func backfillEntryVersion(db *mgo.Database, dryRun bool, l *log.Logger) error {
+	c := db.C(EntryCollectionName)
+	query := bson.M{"version": bson.M{"$exists": false}}
+	if dryRun {
+		count, err := c.Find(query).Count()
+		l.Printf("Would set version to %d entries", count)
+		return err
+	}
+	info, err := c.UpdateAll(query, bson.M{"$set": bson.M{"version": 1}})
+	if err != nil {
+		return err
+	}
+	l.Printf("Set version to %d entries", info.Updated)
+	return nil
+}
+
+// backfillDerivedFields updates fields computed from bodies of entries that
+// don't have the field.
+func backfillDerivedFields(field string) func(*mgo.Database, bool, *log.Logger) error {
+	return func(db *mgo.Database, dryRun bool, l *log.Logger) error {
+		query := bson.M{field: bson.M{"$exists": false}}
+		if dryRun {
+			count, err := db.C(EntryCollectionName).Find(query).Count()
+			l.Printf("Would update %s of %d entries", field, count)
+			return err
+		}
+		return updateEntries(db, query, derivedFieldsUpdater(db), l)
+	}
+}
+
+func derivedFieldsUpdater(db *mgo.Database) func(entry *Entry) error {
+	users := make(map[bson.ObjectId]*User)
+	return func(entry *Entry) error {
+		user, ok := users[entry.UserId]
+		if !ok {
+			user = &User{}
+			err := db.C(UserCollectionName).FindId(entry.UserId).One(user)
+			if err != nil && err != mgo.ErrNotFound {
+				return err
+			}
+			users[entry.UserId] = user
+		}
+		entry.updateDerivedFields(user)
+		return nil
+	}
+}
+
+// updateEntries applies update to each entry that matches the query and saves
+// it.
+func updateEntries(db *mgo.Database, query bson.M, update func(entry *Entry) error, l *log.Logger) error {
+	c := db.C(EntryCollectionName)
+	iter := c.Find(query).Iter()
+	var entry Entry
+	updated := 0
+	for iter.Next(&entry) {
+		err := update(&entry)
+		if err == nil {
+			err = c.UpdateId(entry.Id, &entry)
+		}
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		updated++
+		entry = Entry{}
+	}
+	l.Printf("Updated %d entries", updated)
+	return iter.Close()
+}
+
+// mergeDuplicateEntries merges entries that were created twice for the same
+// date before the unique index. Bodies are concatenated so that nothing is
+// lost, and the oldest entry is kept with the revisions of the others.
+//
+// The duplicates are removed last, and mergeBodies doesn't repeat bodies
+// merged already, so that it can be run again after a failure.
+func mergeDuplicateEntries(db *mgo.Database, dryRun bool, l *log.Logger) error {
+	c := db.C(EntryCollectionName)
+	var groups []struct {
+		Ids []bson.ObjectId `bson:"ids"`
+	}
+	pipeline := []bson.M{
+		{"$group": bson.M{
+			"_id":   bson.M{"user_id": "$user_id", "date": "$date"},
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}
+	err := c.Pipe(pipeline).All(&groups)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		var entries []Entry
+		err := c.Find(bson.M{"_id": bson.M{"$in": group.Ids}}).Sort("_id").All(&entries)
+		if err != nil {
+			return err
+		}
+		if len(entries) < 2 {
+			continue
+		}
+		kept := entries[0]
+		if dryRun {
+			l.Printf("Would merge %d entries of %s into %s", len(entries), kept.Date, kept.Id.Hex())
+			continue
+		}
+
+		var bodies []string
+		for _, entry := range entries {
+			bodies = append(bodies, entry.Body)
+		}
+		kept.Body = mergeBodies(bodies)
+		err = c.UpdateId(kept.Id, bson.M{"$set": bson.M{"body": kept.Body}})
+		if err != nil {
+			return err
+		}
+		var removed []bson.ObjectId
+		for _, entry := range entries[1:] {
+			removed = append(removed, entry.Id)
+		}
+		_, err = db.C(RevisionCollectionName).UpdateAll(
+			bson.M{"entry_id": bson.M{"$in": removed}},
+			bson.M{"$set": bson.M{"entry_id": kept.Id}},
+		)
+		if err != nil {
+			return err
+		}
+		_, err = c.RemoveAll(bson.M{"_id": bson.M{"$in": removed}})
+		if err != nil {
+			return err
+		}
+		l.Printf("Merged %d entries of %s into %s", len(entries), kept.Date, kept.Id.Hex())
+	}
+	return nil
+}
+
+// mergeBodies concatenates distinct non-empty bodies. Bodies already in the
+// merged text as whole paragraphs are skipped so that merging the result again
+// after a failure doesn't repeat them.
+func mergeBodies(bodies []string) string {
+	merged := ""
+	for _, body := range bodies {
+		if strings.TrimSpace(body) == "" || strings.Contains("\n\n"+merged+"\n\n", "\n\n"+body+"\n\n") {
+			continue
+		}
+		if merged != "" {
+			merged += "\n\n"
+		}
+		merged += body
+	}
+	return merged
+}
+
+// moveUserIdentities moves Facebook user IDs saved in uid to provider and
+// subject.
+func moveUserIdentities(db *mgo.Database, dryRun bool, l *log.Logger) error {
+	c := db.C(UserCollectionName)
+	query := bson.M{"uid": bson.M{"$exists": true}, "provider": bson.M{"$exists": false}}
+	if dryRun {
+		count, err := c.Find(query).Count()
+		l.Printf("Would move identities of %d users", count)
+		return err
+	}
+
+	iter := c.Find(query).Iter()
+	var doc struct {
+		Id  bson.ObjectId `bson:"_id"`
+		Uid string        `bson:"uid"`
+	}
+	updated := 0
+	for iter.Next(&doc) {
+		err := c.UpdateId(doc.Id, bson.M{
+			"$set":   bson.M{"provider": "facebook", "subject": doc.Uid},
+			"$unset": bson.M{"uid": ""},
+		})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		updated++
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	l.Printf("Moved identities of %d users", updated)
+
+	// The index is no longer used.
+	return dropIndex(c, "uid")
+}
+
+// moveUserIdentitiesToList moves provider and subject of users to the list of
+// identities.
+func moveUserIdentitiesToList(db *mgo.Database, dryRun bool, l *log.Logger) error {
+	c := db.C(UserCollectionName)
+	query := bson.M{"provider": bson.M{"$exists": true}, "identities": bson.M{"$exists": false}}
+	if dryRun {
+		count, err := c.Find(query).Count()
+		l.Printf("Would move identities of %d users to lists", count)
+		return err
+	}
+
+	iter := c.Find(query).Iter()
+	var doc struct {
+		Id       bson.ObjectId `bson:"_id"`
+		Provider string        `bson:"provider"`
+		Subject  string        `bson:"subject"`
+	}
+	updated := 0
+	for iter.Next(&doc) {
+		err := c.UpdateId(doc.Id, bson.M{
+			"$set":   bson.M{"identities": []Identity{{Provider: doc.Provider, Subject: doc.Subject}}},
+			"$unset": bson.M{"provider": "", "subject": ""},
+		})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		updated++
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	l.Printf("Moved identities of %d users to lists", updated)
+
+	// Replaced by the index on identities.
+	return dropIndex(c, "provider", "subject")
+}
+
+// dropIndex drops the index of the key if it exists.
+func dropIndex(c *mgo.Collection, key ...string) error {
+	err := c.DropIndex(key...)
+	if err != nil && !strings.Contains(err.Error(), "index not found") {
+		return err
+	}
+	return nil
+}
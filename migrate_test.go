@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_mergeBodies(t *testing.T) {
+	merged := mergeBodies([]string{"Hello", "", "Hello", "World"})
+	expected := "Hello\n\nWorld"
+	if merged != expected {
+		t.Errorf("Expected %q but got %q", expected, merged)
+	}
+	if again := mergeBodies([]string{merged, "World"}); again != expected {
+		t.Errorf("Expected merging again to change nothing but got %q", again)
+	}
+}
+
+func Test_runMigrations(t *testing.T) {
+	url := os.Getenv("MONGO_TEST_URL")
+	if url == "" {
+		t.Skip("MONGO_TEST_URL is not set")
+	}
+	session, err := mgo.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("")
+	if err := db.DropDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DropDatabase()
+
+	userId := bson.NewObjectId()
+	c := db.C(EntryCollectionName)
+	for _, body := range []string{"Hello", "World"} {
+		err := c.Insert(bson.M{"_id": bson.NewObjectId(), "user_id": userId, "date": "2014-04-01", "body": body})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacyUserId := bson.NewObjectId()
+	err = db.C(UserCollectionName).Insert(bson.M{"_id": legacyUserId, "uid": "1234", "name": "Legacy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := log.New(ioutil.Discard, "", 0)
+
+	if err := runMigrations(db, true, l); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := db.C(MigrationCollectionName).Count(); count != 0 {
+		t.Errorf("Expected dry run not to record migrations but got %d", count)
+	}
+
+	if err := runMigrations(db, false, l); err != nil {
+		t.Fatal(err)
+	}
+	var entries []Entry
+	if err := c.Find(bson.M{"user_id": userId}).All(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Body != "Hello\n\nWorld" || entries[0].Version != 1 {
+		t.Errorf("Expected a merged entry but got %v", entries)
+	}
+	var user User
+	if err := db.C(UserCollectionName).FindId(legacyUserId).One(&user); err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Identities) != 1 || user.Identities[0] != (Identity{Provider: "facebook", Subject: "1234"}) {
+		t.Errorf("Expected the Facebook identity in the list but got %v", user.Identities)
+	}
+	if count, _ := db.C(MigrationCollectionName).Count(); count != len(migrations) {
+		t.Errorf("Expected %d migrations to be recorded but got %d", len(migrations), count)
+	}
+
+	if err := runMigrations(db, false, l); err != nil {
+		t.Errorf("Expected migrations to be skipped the second time but got %v", err)
+	}
+}
+
+func Test_lockMigrations(t *testing.T) {
+	url := os.Getenv("MONGO_TEST_URL")
+	if url == "" {
+		t.Skip("MONGO_TEST_URL is not set")
+	}
+	session, err := mgo.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("")
+	if err := db.DropDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DropDatabase()
+	c := db.C(MigrationCollectionName)
+	l := log.New(ioutil.Discard, "", 0)
+
+	unlock, err := lockMigrations(c, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan bool)
+	go func() {
+		unlock, err := lockMigrations(c, l)
+		if err == nil {
+			unlock()
+		}
+		locked <- err == nil
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Expected the second lock to wait")
+	case <-time.After(2 * migrationLockPollInterval):
+	}
+	unlock()
+	if !<-locked {
+		t.Error("Expected the second lock to be taken after the first was released")
+	}
+
+	err = c.Insert(&migrationLock{Id: migrationLockId, Owner: bson.NewObjectId(), RefreshedAt: time.Now().Add(-migrationLockTimeout)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = lockMigrations(c, l)
+	if err != nil {
+		t.Fatalf("Expected a stale lock to be taken over but got %v", err)
+	}
+	unlock()
+	if count, _ := c.FindId(migrationLockId).Count(); count != 0 {
+		t.Error("Expected the lock to be released")
+	}
+
+	// A lock held longer than the timeout is refreshed and not taken over.
+	defer func(timeout, refresh time.Duration) {
+		migrationLockTimeout, migrationLockRefreshInterval = timeout, refresh
+	}(migrationLockTimeout, migrationLockRefreshInterval)
+	migrationLockTimeout = 3 * migrationLockPollInterval
+	migrationLockRefreshInterval = migrationLockPollInterval / 2
+	unlock, err = lockMigrations(c, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		unlock, err := lockMigrations(c, l)
+		if err == nil {
+			unlock()
+		}
+		locked <- err == nil
+	}()
+	select {
+	case <-locked:
+		t.Error("Expected a refreshed lock not to be taken over")
+	case <-time.After(2 * migrationLockTimeout):
+	}
+	unlock()
+	<-locked
+}
+
+func Test_mergeDuplicateEntries_retry(t *testing.T) {
+	url := os.Getenv("MONGO_TEST_URL")
+	if url == "" {
+		t.Skip("MONGO_TEST_URL is not set")
+	}
+	session, err := mgo.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("")
+	if err := db.DropDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DropDatabase()
+
+	// A previous run merged the bodies but failed to remove the duplicate.
+	userId := bson.NewObjectId()
+	keptId, removedId := bson.NewObjectId(), bson.NewObjectId()
+	c := db.C(EntryCollectionName)
+	c.Insert(bson.M{"_id": keptId, "user_id": userId, "date": "2014-04-01", "body": "Hello\n\nWorld"})
+	c.Insert(bson.M{"_id": removedId, "user_id": userId, "date": "2014-04-01", "body": "World"})
+	revisionId := bson.NewObjectId()
+	db.C(RevisionCollectionName).Insert(bson.M{"_id": revisionId, "entry_id": removedId, "user_id": userId, "date": "2014-04-01", "body": "Wor"})
+
+	if err := mergeDuplicateEntries(db, false, log.New(ioutil.Discard, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	var entries []Entry
+	c.Find(bson.M{"user_id": userId}).All(&entries)
+	if len(entries) != 1 || entries[0].Id != keptId || entries[0].Body != "Hello\n\nWorld" {
+		t.Errorf("Expected the bodies not to be merged again but got %v", entries)
+	}
+	var revision Revision
+	if err := db.C(RevisionCollectionName).FindId(revisionId).One(&revision); err != nil || revision.EntryId != keptId {
+		t.Errorf("Expected the revision to be moved to the kept entry but got %v and %v", revision, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+	"strconv"
 	"time"
 )
 
@@ -13,21 +14,129 @@ import (
 
 const UserCollectionName = "users"
 
+// Used when a user hasn't chosen a timezone yet.
+const DefaultTimezone = "Asia/Tokyo"
+
+const DefaultDailyGoal = 2000
+
 type User struct {
-	Id   bson.ObjectId `bson:"_id"`
-	Uid  string        `bson:"uid"`
-	Name string        `bson:"name"`
+	Id bson.ObjectId `bson:"_id"`
+	// The user's accounts at identity providers to log in with. An identity
+	// belongs to only one user.
+	Identities   []Identity `bson:"identities"`
+	Name         string     `bson:"name"`
+	Timezone     string     `bson:"timezone"`
+	DayStartHour int        `bson:"day_start_hour"`
+	EditMode     string     `bson:"edit_mode"`
+	GraceMinutes int        `bson:"grace_minutes"`
+	// Options to count characters.
+	ExcludeWhitespace  bool `bson:"exclude_whitespace"`
+	ExcludePunctuation bool `bson:"exclude_punctuation"`
+	// Characters per day. 0 means DefaultDailyGoal.
+	DailyGoal int `bson:"daily_goal"`
+
+	// bcrypt hash of the password of users who log in with email and password.
+	PasswordHash  string         `bson:"password_hash,omitempty" json:"-"`
+	PasswordReset *PasswordReset `bson:"password_reset,omitempty" json:"-"`
+	// Failed logins with password in a row.
+	FailedLogins int        `bson:"failed_logins,omitempty" json:"-"`
+	LockedUntil  *time.Time `bson:"locked_until,omitempty" json:"-"`
+}
+
+// Location returns the user's timezone, falling back to JST when it is not
+// set or unknown to the system.
+func (user *User) Location() *time.Location {
+	loc, err := loadLocation(user.Timezone)
+	if err != nil {
+		return jst
+	}
+	return loc
 }
 
-type FacebookUser struct {
-	Id   string
-	Name string
+func (user *User) CountOptions() CountOptions {
+	return CountOptions{
+		ExcludeWhitespace:  user.ExcludeWhitespace,
+		ExcludePunctuation: user.ExcludePunctuation,
+	}
+}
+
+// Goal returns the number of characters the user aims to write a day.
+func (user *User) Goal() int {
+	if user.DailyGoal <= 0 {
+		return DefaultDailyGoal
+	}
+	return user.DailyGoal
+}
+
+// Today returns the date of the page the user is writing now.
+func (user *User) Today() string {
+	return logicalDate(time.Now(), user.Location(), user.DayStartHour)
+}
+
+// HasIdentity returns whether the user logs in with the identity.
+func (user *User) HasIdentity(identity *Identity) bool {
+	for _, i := range user.Identities {
+		if i.Provider == identity.Provider && i.Subject == identity.Subject {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyIdentity is how identities were saved before users could have more
+// than one.
+type legacyIdentity struct {
+	// Facebook user ID of users created before there were other providers.
+	Uid      string `bson:"uid"`
+	Provider string `bson:"provider"`
+	Subject  string `bson:"subject"`
+}
+
+// upgrade adds the legacy identity to the user if they don't have any.
+func (legacy *legacyIdentity) upgrade(user *User) {
+	if len(user.Identities) > 0 {
+		return
+	}
+	if legacy.Provider != "" {
+		user.Identities = []Identity{{Provider: legacy.Provider, Subject: legacy.Subject}}
+	} else if legacy.Uid != "" {
+		user.Identities = []Identity{{Provider: "facebook", Subject: legacy.Uid}}
+	}
+}
+
+func newUser(identity *Identity) *User {
+	return &User{
+		Id:         bson.NewObjectId(),
+		Identities: []Identity{*identity},
+		Name:       identity.Name,
+	}
 }
 
 type UserStore interface {
 	Get(userId string) (*User, error)
-	FindByFacebook(fbUser *FacebookUser) (*User, error)
-	CreateByFacebook(fbUser *FacebookUser) (*User, error)
+	FindByIdentity(identity *Identity) (*User, error)
+	// CreateByIdentity returns ErrDuplicate if another user has the identity.
+	CreateByIdentity(identity *Identity) (*User, error)
+	// Create saves a new user such as one made by newUser with more fields.
+	// Returns ErrDuplicate if another user has any of the user's identities.
+	Create(user *User) error
+	// Update returns ErrDuplicate if another user has any of the user's
+	// identities.
+	Update(user *User) error
+	// Remove removes the user only. Remove their entries and revisions first.
+	Remove(user *User) error
+	// RecordFailedLogin counts a failed login of the user atomically. The
+	// user is locked until lockedUntil and the count is reset when it
+	// reaches max.
+	RecordFailedLogin(user *User, max int, lockedUntil time.Time) error
+	// ResetFailedLogins clears the count and the lockout.
+	ResetFailedLogins(user *User) error
+	// SetPasswordReset saves only the password reset of the user. nil
+	// removes it.
+	SetPasswordReset(user *User, reset *PasswordReset) error
+	// SetPassword saves only the password hash of the user and removes the
+	// password reset.
+	SetPassword(user *User, hash string) error
 }
 
 type userStore struct {
@@ -35,26 +144,115 @@ type userStore struct {
 }
 
 func (store *userStore) Get(userId string) (*User, error) {
+	if !bson.IsObjectIdHex(userId) {
+		return nil, ErrNotFound
+	}
 	var user User
 	err := store.db.C(UserCollectionName).FindId(bson.ObjectIdHex(userId)).One(&user)
-	return &user, err
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
 }
 
-func (store *userStore) FindByFacebook(fbUser *FacebookUser) (*User, error) {
+func (store *userStore) FindByIdentity(identity *Identity) (*User, error) {
 	var user User
-	err := store.db.C(UserCollectionName).Find(bson.M{"uid": fbUser.Id}).One(&user)
-	return &user, err
+	query := bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": identity.Provider, "subject": identity.Subject}}}
+	err := store.db.C(UserCollectionName).Find(query).One(&user)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
 }
 
-func (store *userStore) CreateByFacebook(fbUser *FacebookUser) (*User, error) {
-	user := &User{Id: bson.NewObjectId(), Uid: fbUser.Id, Name: fbUser.Name}
-	err := store.db.C(UserCollectionName).Insert(user)
+func (store *userStore) CreateByIdentity(identity *Identity) (*User, error) {
+	user := newUser(identity)
+	err := store.Create(user)
 	if err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
+func (store *userStore) Create(user *User) error {
+	err := store.db.C(UserCollectionName).Insert(user)
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (store *userStore) Update(user *User) error {
+	err := store.db.C(UserCollectionName).UpdateId(user.Id, user)
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	return notFound(err)
+}
+
+func (store *userStore) Remove(user *User) error {
+	err := store.db.C(UserCollectionName).RemoveId(user.Id)
+	return notFound(err)
+}
+
+func (store *userStore) RecordFailedLogin(user *User, max int, lockedUntil time.Time) error {
+	c := store.db.C(UserCollectionName)
+	var counted User
+	change := mgo.Change{Update: bson.M{"$inc": bson.M{"failed_logins": 1}}, ReturnNew: true}
+	_, err := c.FindId(user.Id).Apply(change, &counted)
+	if err != nil {
+		return notFound(err)
+	}
+	user.FailedLogins = counted.FailedLogins
+	if counted.FailedLogins < max {
+		return nil
+	}
+	// Only one of concurrent requests locks.
+	selector := bson.M{"_id": user.Id, "failed_logins": bson.M{"$gte": max}}
+	err = c.Update(selector, bson.M{"$set": bson.M{"failed_logins": 0, "locked_until": lockedUntil}})
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	user.FailedLogins = 0
+	user.LockedUntil = &lockedUntil
+	return nil
+}
+
+func (store *userStore) ResetFailedLogins(user *User) error {
+	update := bson.M{"$unset": bson.M{"failed_logins": 1, "locked_until": 1}}
+	err := store.db.C(UserCollectionName).UpdateId(user.Id, update)
+	if err != nil {
+		return notFound(err)
+	}
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	return nil
+}
+
+func (store *userStore) SetPasswordReset(user *User, reset *PasswordReset) error {
+	update := bson.M{"$set": bson.M{"password_reset": reset}}
+	if reset == nil {
+		update = bson.M{"$unset": bson.M{"password_reset": 1}}
+	}
+	err := store.db.C(UserCollectionName).UpdateId(user.Id, update)
+	if err != nil {
+		return notFound(err)
+	}
+	user.PasswordReset = reset
+	return nil
+}
+
+func (store *userStore) SetPassword(user *User, hash string) error {
+	update := bson.M{"$set": bson.M{"password_hash": hash}, "$unset": bson.M{"password_reset": 1}}
+	err := store.db.C(UserCollectionName).UpdateId(user.Id, update)
+	if err != nil {
+		return notFound(err)
+	}
+	user.PasswordHash = hash
+	user.PasswordReset = nil
+	return nil
+}
+
 //
 // Entry
 //
@@ -66,17 +264,79 @@ type Entry struct {
 	Date   string        `bson:"date" json:"date"`
 	Body   string        `bson:"body" json:"body"`
 	UserId bson.ObjectId `bson:"user_id" json:"userId"`
+	// Incremented on every update. Entries saved before versioning have 0.
+	Version int `bson:"version" json:"version"`
+	// Number of characters in the body counted with the user's options.
+	Count int `bson:"count" json:"count"`
+	// The user's daily goal when the entry was saved and whether it was met.
+	Goal    int  `bson:"goal" json:"goal"`
+	GoalMet bool `bson:"goal_met" json:"goalMet"`
+	// When the first keystroke was made and the entry was saved last, and the
+	// time spent on typing. See recordWritingTime.
+	StartedAt      *time.Time `bson:"started_at,omitempty" json:"startedAt,omitempty"`
+	SavedAt        *time.Time `bson:"saved_at,omitempty" json:"savedAt,omitempty"`
+	ActiveSeconds  int        `bson:"active_seconds" json:"activeSeconds"`
+	CharsPerMinute float64    `bson:"chars_per_minute" json:"charsPerMinute"`
+	// Search index of the body. See indexGrams.
+	Grams []string `bson:"grams" json:"-"`
 }
 
 func NewEntry(user *User, date string) *Entry {
 	return &Entry{Id: bson.NewObjectId(), Date: date, Body: "", UserId: user.Id}
 }
 
+func (entry *Entry) summary() EntrySummary {
+	return EntrySummary{Date: entry.Date, Count: entry.Count, GoalMet: entry.GoalMet, ActiveSeconds: entry.ActiveSeconds}
+}
+
+// updateDerivedFields updates the fields computed from the body. Call it
+// before saving the entry.
+func (entry *Entry) updateDerivedFields(user *User) {
+	entry.Goal = user.Goal()
+	entry.recount(user)
+	entry.Grams = indexGrams(entry.Body)
+}
+
+// recount updates the fields that depend on the count against the goal when
+// the entry was saved.
+func (entry *Entry) recount(user *User) {
+	entry.Count = countCharacters(entry.Body, user.CountOptions())
+	entry.GoalMet = entry.Count >= entry.Goal
+	entry.CharsPerMinute = charsPerMinute(entry.Count, entry.ActiveSeconds)
+}
+
 type EntryStore interface {
 	Find(user *User, date string) (*Entry, error)
 	FindByDate(user *User, from, to string) ([]Entry, error)
+	// Create returns ErrDuplicate if the user already has an entry of the date.
 	Create(entry *Entry) (bson.ObjectId, error)
+	// Update saves the entry only if its version is the same as the stored
+	// one, and increments the version. Otherwise returns ErrConflict.
 	Update(entry *Entry) error
+	// Upsert creates the entry if the user doesn't have one of the date, or
+	// updates the existing one. The version is checked like Update unless it
+	// is 0. The entry gets the stored ID and version.
+	Upsert(entry *Entry) error
+	// Summaries returns summaries of all the user's entries sorted by date.
+	Summaries(user *User) ([]EntrySummary, error)
+	// Search returns the user's entries that have all the grams in their
+	// search index, newest first, skipping skip entries and up to limit
+	// entries unless limit is 0, and the number of all of them. They may not
+	// contain the searched words, so check their bodies.
+	Search(user *User, grams []string, skip, limit int) ([]Entry, int, error)
+	// Remove returns ErrNotFound if the entry doesn't exist.
+	Remove(entry *Entry) error
+	// RemoveByUser removes all the user's entries.
+	RemoveByUser(user *User) error
+}
+
+// EntrySummary is an entry without its body for stats.
+type EntrySummary struct {
+	Date    string `bson:"date" json:"date"`
+	Count   int    `bson:"count" json:"count"`
+	GoalMet bool   `bson:"goal_met" json:"goalMet"`
+	// 0 if the entry was written before timing was recorded.
+	ActiveSeconds int `bson:"active_seconds" json:"activeSeconds"`
 }
 
 type entryStore struct {
@@ -117,12 +377,126 @@ func (store *entryStore) FindByDate(user *User, from, to string) ([]Entry, error
 
 func (store *entryStore) Create(entry *Entry) (bson.ObjectId, error) {
 	entry.Id = bson.NewObjectId()
+	entry.Version = 1
 	err := store.db.C(EntryCollectionName).Insert(entry)
+	if mgo.IsDup(err) {
+		return "", ErrDuplicate
+	}
 	return entry.Id, err
 }
 
 func (store *entryStore) Update(entry *Entry) error {
-	err := store.db.C(EntryCollectionName).UpdateId(entry.Id, entry)
+	c := store.db.C(EntryCollectionName)
+	updated := *entry
+	updated.Version++
+
+	selector := bson.M{"_id": entry.Id, "version": entry.Version}
+	if entry.Version == 0 {
+		// Entries saved before versioning don't have the field.
+		selector["version"] = bson.M{"$in": []interface{}{0, nil}}
+	}
+	err := c.Update(selector, &updated)
+	if err == mgo.ErrNotFound {
+		count, err := c.FindId(entry.Id).Count()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrNotFound
+		}
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	entry.Version = updated.Version
+	return nil
+}
+
+func (store *entryStore) Upsert(entry *Entry) error {
+	c := store.db.C(EntryCollectionName)
+	selector := bson.M{"user_id": entry.UserId, "date": entry.Date}
+
+	if entry.Version != 0 {
+		var saved Entry
+		err := c.Find(selector).Select(bson.M{"_id": 1}).One(&saved)
+		if err == mgo.ErrNotFound {
+			return ErrConflict
+		}
+		if err != nil {
+			return err
+		}
+		entry.Id = saved.Id
+		return store.Update(entry)
+	}
+
+	// Every field but the ID and the version, which are kept if the entry
+	// exists.
+	fields := bson.M{}
+	data, err := bson.Marshal(entry)
+	if err == nil {
+		err = bson.Unmarshal(data, fields)
+	}
+	if err != nil {
+		return err
+	}
+	delete(fields, "_id")
+	delete(fields, "version")
+
+	change := mgo.Change{
+		Update: bson.M{
+			"$set":         fields,
+			"$inc":         bson.M{"version": 1},
+			"$setOnInsert": bson.M{"_id": bson.NewObjectId()},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	var saved Entry
+	_, err = c.Find(selector).Apply(change, &saved)
+	if mgo.IsDup(err) {
+		// Another request has created the entry at the same time.
+		_, err = c.Find(selector).Apply(change, &saved)
+	}
+	if err != nil {
+		return err
+	}
+	entry.Id = saved.Id
+	entry.Version = saved.Version
+	return nil
+}
+
+func (store *entryStore) Summaries(user *User) ([]EntrySummary, error) {
+	var summaries []EntrySummary
+	// Leave bodies in the database.
+	fields := bson.M{"date": 1, "count": 1, "goal_met": 1, "active_seconds": 1}
+	err := store.db.C(EntryCollectionName).Find(bson.M{"user_id": user.Id}).Select(fields).Sort("date").All(&summaries)
+	return summaries, err
+}
+
+func (store *entryStore) Search(user *User, grams []string, skip, limit int) ([]Entry, int, error) {
+	query := store.db.C(EntryCollectionName).Find(bson.M{"user_id": user.Id, "grams": bson.M{"$all": grams}})
+	total, err := query.Count()
+	if err != nil || skip >= total {
+		return nil, total, err
+	}
+	query = query.Select(bson.M{"date": 1, "body": 1}).Sort("-date").Skip(skip)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	var entries []Entry
+	err = query.All(&entries)
+	return entries, total, err
+}
+
+func (store *entryStore) Remove(entry *Entry) error {
+	err := store.db.C(EntryCollectionName).RemoveId(entry.Id)
+	return notFound(err)
+}
+
+func (store *entryStore) RemoveByUser(user *User) error {
+	_, err := store.db.C(EntryCollectionName).RemoveAll(bson.M{"user_id": user.Id})
 	return err
 }
 
@@ -139,30 +513,56 @@ func dateString(year int, month time.Month, day int) string {
 	return fmt.Sprintf("%04d-%02d-%02d", year, month, day)
 }
 
+// formatNumber formats a number with commas such as 730,000.
+func formatNumber(n int) string {
+	if n < 0 {
+		return "-" + formatNumber(-n)
+	}
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
 func dateStringOfTime(t time.Time) string {
 	return dateString(t.Year(), t.Month(), t.Day())
 }
 
-func isValidDate(date string) bool {
-	_, err := parseDate(date)
+var jst = time.FixedZone("JST", 9*60*60)
+
+// loadLocation loads an IANA timezone such as "Europe/Berlin". An empty name
+// means DefaultTimezone.
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		name = DefaultTimezone
+	}
+	return time.LoadLocation(name)
+}
+
+func isValidDate(date string, loc *time.Location) bool {
+	_, err := parseDate(date, loc)
 	return err == nil
 }
 
-func parseDate(date string) (time.Time, error) {
-	// TODO: Use user's timezone.
-	tokyo := time.FixedZone("JST", 9*60*60)
-	t, err := time.ParseInLocation("2006-01-02", date, tokyo)
+func parseDate(date string, loc *time.Location) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", date, loc)
 	if err != nil {
 		return time.Now(), err
 	}
 	return t, nil
 }
 
-func todayString() string {
-	// TODO: Use user's timezone.
-	tokyo := time.FixedZone("JST", 9*60*60)
-	timeInTokyo := time.Now().In(tokyo)
-	return dateStringOfTime(timeInTokyo)
+// logicalDate returns the date that t belongs to for someone whose day starts
+// at dayStartHour o'clock. e.g. 1am on the 2nd still belongs to the 1st when the
+// day starts at 4am.
+func logicalDate(t time.Time, loc *time.Location, dayStartHour int) string {
+	local := t.In(loc)
+	if local.Hour() < dayStartHour {
+		y, m, d := local.Date()
+		local = time.Date(y, m, d-1, 12, 0, 0, 0, loc)
+	}
+	return dateStringOfTime(local)
 }
 
 func beginningOfPreviousMonth(t time.Time) time.Time {
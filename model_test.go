@@ -7,7 +7,7 @@ import (
 )
 
 func Test_NewEntry(t *testing.T) {
-	user := &User{Id: bson.NewObjectId(), Uid: "mm", Name: "Mitsuru Murakami"}
+	user := &User{Id: bson.NewObjectId(), Name: "Mitsuru Murakami"}
 	date := "2013-12-23"
 	entry := NewEntry(user, date)
 
@@ -22,6 +22,41 @@ func Test_NewEntry(t *testing.T) {
 	}
 }
 
+func Test_Entry_updateDerivedFields(t *testing.T) {
+	user := &User{Id: bson.NewObjectId(), DailyGoal: 5}
+	entry := NewEntry(user, "2014-04-01")
+	entry.Body = "Hello"
+	entry.updateDerivedFields(user)
+
+	if entry.Count != 5 {
+		t.Errorf("Expected %d but got %d", 5, entry.Count)
+	}
+	if entry.Goal != 5 || !entry.GoalMet {
+		t.Errorf("Expected to meet goal %d but got %d and %v", 5, entry.Goal, entry.GoalMet)
+	}
+
+	entry.Body = "Hell"
+	entry.updateDerivedFields(user)
+	if entry.GoalMet {
+		t.Error("Expected not to meet the goal")
+	}
+}
+
+func Test_User_Goal_default(t *testing.T) {
+	if goal := (&User{}).Goal(); goal != DefaultDailyGoal {
+		t.Errorf("Expected %d but got %d", DefaultDailyGoal, goal)
+	}
+}
+
+func Test_formatNumber(t *testing.T) {
+	cases := map[int]string{0: "0", 999: "999", 2000: "2,000", 730000: "730,000", 1234567: "1,234,567", -2000: "-2,000"}
+	for n, expected := range cases {
+		if s := formatNumber(n); s != expected {
+			t.Errorf("Expected %s but got %s", expected, s)
+		}
+	}
+}
+
 func Test_daysIn_30(t *testing.T) {
 	days := daysIn(4, 2012)
 	expected := 30
@@ -77,21 +112,21 @@ func Test_dateStringOfTime_eod(t *testing.T) {
 
 func Test_isValidDate_zeropad(t *testing.T) {
 	d := "1981-01-02"
-	if !isValidDate(d) {
+	if !isValidDate(d, time.UTC) {
 		t.Errorf("Expected %s to be valid date", d)
 	}
 }
 
 func Test_isValidDate_nopad(t *testing.T) {
 	d := "1981-1-2"
-	if isValidDate(d) {
+	if isValidDate(d, time.UTC) {
 		t.Errorf("Expected %s to be invalid date", d)
 	}
 }
 
 func Test_isValidDate_notdate(t *testing.T) {
 	d := "hello"
-	if isValidDate(d) {
+	if isValidDate(d, time.UTC) {
 		t.Errorf("Expected %s to be invalid date", d)
 	}
 }
@@ -115,7 +150,22 @@ func Test_beginningOfNextMonth(t *testing.T) {
 func Test_parseDate(t *testing.T) {
 	tokyo := time.FixedZone("JST", 9*60*60)
 	expected := time.Date(2014, 4, 1, 0, 0, 0, 0, tokyo)
-	d, err := parseDate("2014-04-01")
+	d, err := parseDate("2014-04-01", tokyo)
+	if err != nil {
+		t.Errorf("Didn't expect error but got %v", err)
+	}
+	if d.UnixNano() != expected.UnixNano() {
+		t.Errorf("Expected %v but got %v", expected, d)
+	}
+}
+
+func Test_parseDate_location(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2014, 4, 1, 0, 0, 0, 0, berlin)
+	d, err := parseDate("2014-04-01", berlin)
 	if err != nil {
 		t.Errorf("Didn't expect error but got %v", err)
 	}
@@ -123,3 +173,82 @@ func Test_parseDate(t *testing.T) {
 		t.Errorf("Expected %v but got %v", expected, d)
 	}
 }
+
+func Test_User_Location_default(t *testing.T) {
+	user := &User{}
+	expected := "Asia/Tokyo"
+	if name := user.Location().String(); name != expected {
+		t.Errorf("Expected %s but got %s", expected, name)
+	}
+}
+
+func Test_User_Location(t *testing.T) {
+	user := &User{Timezone: "America/New_York"}
+	expected := "America/New_York"
+	if name := user.Location().String(); name != expected {
+		t.Errorf("Expected %s but got %s", expected, name)
+	}
+}
+
+func Test_User_Location_unknown(t *testing.T) {
+	user := &User{Timezone: "Nowhere/Somewhere"}
+	expected := "JST"
+	if name := user.Location().String(); name != expected {
+		t.Errorf("Expected %s but got %s", expected, name)
+	}
+}
+
+func Test_logicalDate(t *testing.T) {
+	d := time.Date(2014, 4, 2, 4, 0, 0, 0, time.UTC)
+	expected := "2014-04-02"
+	if s := logicalDate(d, time.UTC, 4); s != expected {
+		t.Errorf("Expected %s but got %s", expected, s)
+	}
+}
+
+func Test_logicalDate_beforeDayStart(t *testing.T) {
+	d := time.Date(2014, 4, 1, 1, 30, 0, 0, time.UTC)
+	expected := "2014-03-31"
+	if s := logicalDate(d, time.UTC, 4); s != expected {
+		t.Errorf("Expected %s but got %s", expected, s)
+	}
+}
+
+func Test_logicalDate_location(t *testing.T) {
+	// 2014-04-01 23:00 in UTC is 2014-04-02 08:00 in Tokyo.
+	d := time.Date(2014, 4, 1, 23, 0, 0, 0, time.UTC)
+	expected := "2014-04-02"
+	if s := logicalDate(d, jst, 0); s != expected {
+		t.Errorf("Expected %s but got %s", expected, s)
+	}
+}
+
+func Test_legacyIdentity_upgrade(t *testing.T) {
+	user := &User{}
+	(&legacyIdentity{Uid: "1234"}).upgrade(user)
+	if len(user.Identities) != 1 || user.Identities[0] != (Identity{Provider: "facebook", Subject: "1234"}) {
+		t.Errorf("Expected the Facebook identity but got %v", user.Identities)
+	}
+
+	user = &User{}
+	(&legacyIdentity{Provider: "google", Subject: "abc"}).upgrade(user)
+	if len(user.Identities) != 1 || user.Identities[0] != (Identity{Provider: "google", Subject: "abc"}) {
+		t.Errorf("Expected the identity to be moved but got %v", user.Identities)
+	}
+
+	user = &User{Identities: []Identity{{Provider: "google", Subject: "abc"}}}
+	(&legacyIdentity{Provider: "facebook", Subject: "1234"}).upgrade(user)
+	if len(user.Identities) != 1 || user.Identities[0].Provider != "google" {
+		t.Errorf("Expected the identities to be kept but got %v", user.Identities)
+	}
+}
+
+func Test_User_HasIdentity(t *testing.T) {
+	user := &User{Identities: []Identity{{Provider: "facebook", Subject: "1234"}, {Provider: "google", Subject: "abc"}}}
+	if !user.HasIdentity(&Identity{Provider: "google", Subject: "abc", Name: "Alice"}) {
+		t.Error("Expected the user to have the identity")
+	}
+	if user.HasIdentity(&Identity{Provider: "google", Subject: "1234"}) {
+		t.Error("Expected the user not to have the identity of another provider")
+	}
+}
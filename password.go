@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/codegangsta/martini-contrib/sessions"
+	"github.com/codegangsta/martini-contrib/web"
+	"golang.org/x/crypto/bcrypt"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Users who log in with email and password have an identity of this provider
+// with their email as the subject.
+const PasswordProvider = "password"
+
+const MinPasswordLength = 8
+
+// bcrypt ignores bytes after 72.
+const MaxPasswordLength = 72
+
+// Logins are refused for LockoutDuration after MaxFailedLogins failures in a
+// row.
+const MaxFailedLogins = 5
+const LockoutDuration = 15 * time.Minute
+
+const PasswordResetDuration = time.Hour
+const PasswordResetInterval = 5 * time.Minute
+
+// Variable so that tests can hash faster.
+var passwordHashCost = bcrypt.DefaultCost
+
+var (
+	ErrInvalidEmail      = errors.New("Invalid email address")
+	ErrWeakPassword      = fmt.Errorf("Password must be %d to %d characters", MinPasswordLength, MaxPasswordLength)
+	ErrWrongPassword     = errors.New("Wrong email or password")
+	ErrLockedOut         = errors.New("Too many failed logins. Try again later.")
+	ErrInvalidResetToken = errors.New("Invalid or expired reset link")
+	// Not shown to users not to tell who are registered.
+	ErrPasswordResetTooSoon = errors.New("A password reset was sent a moment ago")
+	ErrEmailAlreadyExists   = errors.New("The email address is already registered")
+)
+
+// PasswordReset is an unused password reset token of a user.
+type PasswordReset struct {
+	// SHA-256 of the token so that a leaked database can't reset passwords.
+	TokenHash string    `bson:"token_hash"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// Compared with when the email is unknown so that it takes as long as a
+// wrong password.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func passwordIdentity(email string) *Identity {
+	email = normalizeEmail(email)
+	return &Identity{Provider: PasswordProvider, Subject: email, Email: email}
+}
+
+func validateEmail(email string) error {
+	at := strings.Index(email, "@")
+	if at < 1 || at == len(email)-1 || strings.ContainsAny(email, " \t\r\n") {
+		return ErrInvalidEmail
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len([]rune(password)) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return "", ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	return string(hash), err
+}
+
+func (user *User) isLockedOut(now time.Time) bool {
+	return user.LockedUntil != nil && now.Before(*user.LockedUntil)
+}
+
+// checkPassword checks the password and records the result for lockout. Only
+// the count and the lockout are saved so that concurrent attempts are all
+// counted and don't overwrite other changes of the user.
+func checkPassword(users UserStore, user *User, password string, now time.Time) error {
+	if user.isLockedOut(now) {
+		return ErrLockedOut
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	if err != nil {
+		err = users.RecordFailedLogin(user, MaxFailedLogins, now.Add(LockoutDuration))
+		if err != nil {
+			return err
+		}
+		return ErrWrongPassword
+	}
+	if user.FailedLogins != 0 || user.LockedUntil != nil {
+		return users.ResetFailedLogins(user)
+	}
+	return nil
+}
+
+// registerWithPassword creates a user who logs in with the email and password.
+func registerWithPassword(users UserStore, email, password, name string) (*User, error) {
+	identity := passwordIdentity(email)
+	err := validateEmail(identity.Email)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	identity.Name = strings.TrimSpace(name)
+	if identity.Name == "" {
+		identity.Name = identity.Email[:strings.Index(identity.Email, "@")]
+	}
+
+	// Saved at once so that a failure doesn't leave the email taken by a
+	// user without a password.
+	user := newUser(identity)
+	user.PasswordHash = hash
+	err = users.Create(user)
+	if err == ErrDuplicate {
+		return nil, ErrEmailAlreadyExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// loginWithPassword returns the user of the email if the password is right.
+func loginWithPassword(users UserStore, email, password string, now time.Time) (*User, error) {
+	user, err := users.FindByIdentity(passwordIdentity(email))
+	if err == ErrNotFound || (err == nil && user.PasswordHash == "") {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, ErrWrongPassword
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = checkPassword(users, user, password, now)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// changePassword sets a new password after checking the current one.
+func changePassword(users UserStore, user *User, current, password string, now time.Time) error {
+	if user.PasswordHash == "" {
+		return ErrWrongPassword
+	}
+	err := checkPassword(users, user, current, now)
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return users.SetPassword(user, hash)
+}
+
+// createPasswordReset returns a new reset token of the user, which is valid
+// for PasswordResetDuration. The token contains the user ID so that the user
+// can be found without an index on tokens. A new one isn't made within
+// PasswordResetInterval of the last so that nobody can flood the user's inbox.
+func createPasswordReset(users UserStore, user *User, now time.Time) (string, error) {
+	if last := user.PasswordReset; last != nil && now.Before(last.ExpiresAt.Add(PasswordResetInterval-PasswordResetDuration)) {
+		return "", ErrPasswordResetTooSoon
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	reset := &PasswordReset{TokenHash: hashToken(secret), ExpiresAt: now.Add(PasswordResetDuration)}
+	err = users.SetPasswordReset(user, reset)
+	if err != nil {
+		return "", err
+	}
+	return user.Id.Hex() + "." + secret, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// resetPassword sets a new password with a reset token. The token can be used
+// only once. The lockout is lifted too.
+func resetPassword(users UserStore, token, password string, now time.Time) (*User, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || !bson.IsObjectIdHex(parts[0]) {
+		return nil, ErrInvalidResetToken
+	}
+	user, err := users.Get(parts[0])
+	if err == ErrNotFound {
+		return nil, ErrInvalidResetToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	reset := user.PasswordReset
+	if reset == nil || now.After(reset.ExpiresAt) ||
+		subtle.ConstantTimeCompare([]byte(hashToken(parts[1])), []byte(reset.TokenHash)) != 1 {
+		return nil, ErrInvalidResetToken
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	err = users.SetPassword(user, hash)
+	if err != nil {
+		return nil, err
+	}
+	return user, users.ResetFailedLogins(user)
+}
+
+// baseUrl returns the URL of the site for links in emails. Set BASE_URL in
+// production because the Host header can be forged.
+func baseUrl(r *http.Request) string {
+	if u := os.Getenv("BASE_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+//
+// Handlers
+//
+
+func ShowRegister(r render.Render, token CsrfToken) {
+	r.HTML(200, "register", pageData(nil, token))
+}
+
+func Register(ctx *web.Context, r render.Render, users UserStore, logins SessionStore, session sessions.Session, token CsrfToken, l *log.Logger) {
+	email := ctx.Request.PostFormValue("email")
+	user, err := registerWithPassword(users, email, ctx.Request.PostFormValue("password"), ctx.Request.PostFormValue("name"))
+	if err != nil {
+		data := pageData(nil, token)
+		data["Error"] = err.Error()
+		data["Email"] = email
+		r.HTML(http.StatusBadRequest, "register", data)
+		return
+	}
+	l.Println("Registered a new user", user.Id)
+	err = logIn(ctx.Request, logins, session, user)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx.Redirect(http.StatusFound, "/")
+}
+
+func LoginWithPassword(ctx *web.Context, r render.Render, users UserStore, logins SessionStore, providers IdentityProviders, session sessions.Session, token CsrfToken, l *log.Logger) {
+	email := ctx.Request.PostFormValue("email")
+	user, err := loginWithPassword(users, email, ctx.Request.PostFormValue("password"), time.Now())
+	if err != nil {
+		l.Println("Failed to log in with password", err)
+		data := loginData(providers, token)
+		data["Error"] = err.Error()
+		data["Email"] = email
+		r.HTML(http.StatusUnauthorized, "auth", data)
+		return
+	}
+	err = logIn(ctx.Request, logins, session, user)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx.Redirect(http.StatusFound, "/")
+}
+
+func ShowForgotPassword(r render.Render, token CsrfToken) {
+	r.HTML(200, "forgot", pageData(nil, token))
+}
+
+// SendPasswordReset emails a reset link. It looks the same whether the email
+// is registered or not so that it doesn't tell who are users.
+func SendPasswordReset(ctx *web.Context, r render.Render, users UserStore, mailer Mailer, token CsrfToken, l *log.Logger) {
+	email := ctx.Request.PostFormValue("email")
+	user, err := users.FindByIdentity(passwordIdentity(email))
+	if err == nil {
+		token, err := createPasswordReset(users, user, time.Now())
+		if err == nil {
+			link := baseUrl(ctx.Request) + "/auth/password/reset?token=" + token
+			err = mailer.Send(normalizeEmail(email), "Morning Pages のパスワードの再設定",
+				"次のリンクから 1 時間以内にパスワードを再設定してください。\n\n"+link+"\n")
+		}
+		if err == ErrPasswordResetTooSoon {
+			l.Println("Skipped a password reset sent a moment ago")
+		} else if err != nil {
+			l.Println("Failed to send a password reset", err)
+		}
+	} else if err != ErrNotFound {
+		l.Println("Failed to find a user", err)
+	}
+	data := pageData(nil, token)
+	data["Sent"] = true
+	r.HTML(200, "forgot", data)
+}
+
+func ShowResetPassword(ctx *web.Context, r render.Render, token CsrfToken) {
+	data := pageData(nil, token)
+	data["Token"] = ctx.Request.URL.Query().Get("token")
+	r.HTML(200, "reset", data)
+}
+
+// ResetPassword logs the user out everywhere because the password may have
+// been stolen.
+func ResetPassword(ctx *web.Context, r render.Render, users UserStore, logins SessionStore, session sessions.Session, token CsrfToken, l *log.Logger) {
+	resetToken := ctx.Request.PostFormValue("token")
+	user, err := resetPassword(users, resetToken, ctx.Request.PostFormValue("password"), time.Now())
+	if err != nil {
+		data := pageData(nil, token)
+		data["Token"] = resetToken
+		data["Error"] = err.Error()
+		r.HTML(http.StatusBadRequest, "reset", data)
+		return
+	}
+	l.Println("Reset the password of", user.Id)
+	err = logins.RemoveByUser(user)
+	if err == nil {
+		err = logIn(ctx.Request, logins, session, user)
+	}
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx.Redirect(http.StatusFound, "/")
+}
+
+// ChangePassword logs the user out of other sessions.
+func ChangePassword(ctx *web.Context, r render.Render, users UserStore, providers IdentityProviders, tokens TokenStore, logins SessionStore, token CsrfToken, current *LoginSession, user *User) {
+	err := changePassword(users, user, ctx.Request.PostFormValue("current"), ctx.Request.PostFormValue("password"), time.Now())
+	if err == nil {
+		err = removeOtherSessions(logins, user, current)
+		if err != nil {
+			ctx.Abort(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if err != nil {
+		data, dataErr := accountData(providers, tokens, logins, token, current, user)
+		if dataErr != nil {
+			ctx.Abort(http.StatusInternalServerError, dataErr.Error())
+			return
+		}
+		data["PasswordError"] = err.Error()
+		r.HTML(http.StatusBadRequest, "account", data)
+		return
+	}
+	ctx.Redirect(http.StatusFound, "/account")
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"github.com/codegangsta/martini-contrib/web"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	passwordHashCost = bcrypt.MinCost
+}
+
+func Test_registerWithPassword(t *testing.T) {
+	storage := openMemoryStorage()
+	user, err := registerWithPassword(storage.Users, " Alice@Example.com ", "correct horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "alice" || len(user.Identities) != 1 || user.Identities[0].Subject != "alice@example.com" {
+		t.Errorf("Expected a user with the normalized email but got %v", user)
+	}
+	if found, err := storage.Users.Get(user.Id.Hex()); err != nil || found.PasswordHash == "" {
+		t.Errorf("Expected the password hash to be saved but got %v and %v", found, err)
+	}
+
+	cases := []struct {
+		email, password string
+		err             error
+	}{
+		{"alice@example.com", "another password", ErrEmailAlreadyExists},
+		{"ALICE@example.com", "another password", ErrEmailAlreadyExists},
+		{"not an email", "correct horse", ErrInvalidEmail},
+		{"bob@", "correct horse", ErrInvalidEmail},
+		{"bob@example.com", "short", ErrWeakPassword},
+		{"bob@example.com", strings.Repeat("a", MaxPasswordLength+1), ErrWeakPassword},
+	}
+	for _, c := range cases {
+		if _, err := registerWithPassword(storage.Users, c.email, c.password, ""); err != c.err {
+			t.Errorf("Expected %v for %s and %s but got %v", c.err, c.email, c.password, err)
+		}
+	}
+}
+
+// failingUserStore fails to create users.
+type failingUserStore struct {
+	UserStore
+}
+
+func (store *failingUserStore) Create(user *User) error {
+	return errors.New("Failed to create")
+}
+
+func Test_registerWithPassword_failure(t *testing.T) {
+	storage := openMemoryStorage()
+	if _, err := registerWithPassword(&failingUserStore{storage.Users}, "alice@example.com", "correct horse", ""); err == nil {
+		t.Fatal("Expected an error but didn't get one")
+	}
+	// The email is still available.
+	if _, err := registerWithPassword(storage.Users, "alice@example.com", "correct horse", ""); err != nil {
+		t.Errorf("Expected to register after the failure but got %v", err)
+	}
+}
+
+func Test_loginWithPassword(t *testing.T) {
+	storage := openMemoryStorage()
+	registered, _ := registerWithPassword(storage.Users, "alice@example.com", "correct horse", "Alice")
+	now := time.Now()
+
+	user, err := loginWithPassword(storage.Users, "Alice@Example.com", "correct horse", now)
+	if err != nil || user.Id != registered.Id {
+		t.Errorf("Expected to log in but got %v and %v", user, err)
+	}
+	if _, err := loginWithPassword(storage.Users, "alice@example.com", "wrong", now); err != ErrWrongPassword {
+		t.Errorf("Expected ErrWrongPassword but got %v", err)
+	}
+	if _, err := loginWithPassword(storage.Users, "bob@example.com", "correct horse", now); err != ErrWrongPassword {
+		t.Errorf("Expected ErrWrongPassword for an unknown email but got %v", err)
+	}
+}
+
+func Test_loginWithPassword_lockout(t *testing.T) {
+	storage := openMemoryStorage()
+	registerWithPassword(storage.Users, "alice@example.com", "correct horse", "Alice")
+	now := time.Now()
+
+	for i := 0; i < MaxFailedLogins; i++ {
+		if _, err := loginWithPassword(storage.Users, "alice@example.com", "wrong", now); err != ErrWrongPassword {
+			t.Fatalf("Expected ErrWrongPassword but got %v", err)
+		}
+	}
+	if _, err := loginWithPassword(storage.Users, "alice@example.com", "correct horse", now); err != ErrLockedOut {
+		t.Errorf("Expected ErrLockedOut even with the right password but got %v", err)
+	}
+	later := now.Add(LockoutDuration + time.Second)
+	if _, err := loginWithPassword(storage.Users, "alice@example.com", "correct horse", later); err != nil {
+		t.Errorf("Expected to log in after the lockout but got %v", err)
+	}
+	user, _ := storage.Users.FindByIdentity(passwordIdentity("alice@example.com"))
+	if user.FailedLogins != 0 || user.LockedUntil != nil {
+		t.Errorf("Expected the failures to be reset but got %d and %v", user.FailedLogins, user.LockedUntil)
+	}
+}
+
+func Test_changePassword(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := registerWithPassword(storage.Users, "alice@example.com", "correct horse", "Alice")
+	now := time.Now()
+
+	if err := changePassword(storage.Users, user, "wrong", "battery staple", now); err != ErrWrongPassword {
+		t.Errorf("Expected ErrWrongPassword but got %v", err)
+	}
+	if err := changePassword(storage.Users, user, "correct horse", "battery staple", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loginWithPassword(storage.Users, "alice@example.com", "battery staple", now); err != nil {
+		t.Errorf("Expected to log in with the new password but got %v", err)
+	}
+
+	other, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	if err := changePassword(storage.Users, other, "", "battery staple", now); err != ErrWrongPassword {
+		t.Errorf("Expected ErrWrongPassword for a user without a password but got %v", err)
+	}
+}
+
+func Test_resetPassword(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := registerWithPassword(storage.Users, "alice@example.com", "correct horse", "Alice")
+	now := time.Now()
+	token, err := createPasswordReset(storage.Users, user, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := storage.Users.Get(user.Id.Hex()); strings.Contains(token, found.PasswordReset.TokenHash) {
+		t.Error("Expected the token not to be saved as it is")
+	}
+
+	if _, err := resetPassword(storage.Users, token+"x", "battery staple", now); err != ErrInvalidResetToken {
+		t.Errorf("Expected ErrInvalidResetToken for a wrong token but got %v", err)
+	}
+	if _, err := resetPassword(storage.Users, "invalid", "battery staple", now); err != ErrInvalidResetToken {
+		t.Errorf("Expected ErrInvalidResetToken for an invalid token but got %v", err)
+	}
+	if _, err := resetPassword(storage.Users, token, "battery staple", now.Add(PasswordResetDuration+time.Second)); err != ErrInvalidResetToken {
+		t.Errorf("Expected ErrInvalidResetToken for an expired token but got %v", err)
+	}
+
+	reset, err := resetPassword(storage.Users, token, "battery staple", now)
+	if err != nil || reset.Id != user.Id {
+		t.Fatalf("Expected to reset the password but got %v and %v", reset, err)
+	}
+	if _, err := loginWithPassword(storage.Users, "alice@example.com", "battery staple", now); err != nil {
+		t.Errorf("Expected to log in with the new password but got %v", err)
+	}
+	if _, err := resetPassword(storage.Users, token, "another one", now); err != ErrInvalidResetToken {
+		t.Errorf("Expected the token to be used only once but got %v", err)
+	}
+}
+
+func Test_createPasswordReset(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := registerWithPassword(storage.Users, "alice@example.com", "correct horse", "Alice")
+	now := time.Now()
+
+	// A copy loaded before the lockout doesn't lift it.
+	stale := *user
+	for i := 0; i < MaxFailedLogins; i++ {
+		loginWithPassword(storage.Users, "alice@example.com", "wrong", now)
+	}
+	if _, err := createPasswordReset(storage.Users, &stale, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loginWithPassword(storage.Users, "alice@example.com", "correct horse", now); err != ErrLockedOut {
+		t.Errorf("Expected to stay locked out but got %v", err)
+	}
+
+	if _, err := createPasswordReset(storage.Users, &stale, now.Add(time.Minute)); err != ErrPasswordResetTooSoon {
+		t.Errorf("Expected ErrPasswordResetTooSoon but got %v", err)
+	}
+	if _, err := createPasswordReset(storage.Users, &stale, now.Add(PasswordResetInterval)); err != nil {
+		t.Errorf("Expected to create another after the interval but got %v", err)
+	}
+}
+
+type mockMailer struct {
+	to, subject, body string
+}
+
+func (m *mockMailer) Send(to, subject, body string) error {
+	m.to, m.subject, m.body = to, subject, body
+	return nil
+}
+
+func Test_SendPasswordReset(t *testing.T) {
+	storage := openMemoryStorage()
+	registerWithPassword(storage.Users, "alice@example.com", "correct horse", "Alice")
+	l := log.New(os.Stdout, "", 0)
+
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		w := httptest.NewRecorder()
+		form := url.Values{"email": {email}}
+		r, _ := http.NewRequest("POST", "http://morning.example.com/auth/password/forgot", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := &web.Context{Request: r, ResponseWriter: w}
+		render := &mockRender{}
+		mailer := &mockMailer{}
+		SendPasswordReset(ctx, render, storage.Users, mailer, CsrfToken("TOKEN"), l)
+
+		if render.status != 200 || render.name != "forgot" {
+			t.Errorf("Expected the same page for %s but got %d and %s", email, render.status, render.name)
+		}
+		if email == "alice@example.com" {
+			if mailer.to != email || !strings.Contains(mailer.body, "http://morning.example.com/auth/password/reset?token=") {
+				t.Errorf("Expected a reset link to be sent but got %v", mailer)
+			}
+		} else if mailer.to != "" {
+			t.Errorf("Expected no mail for an unknown email but got %v", mailer)
+		}
+	}
+}
+
+func Test_LoginWithPassword(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := registerWithPassword(storage.Users, "alice@example.com", "correct horse", "Alice")
+	l := log.New(os.Stdout, "", 0)
+
+	for _, password := range []string{"wrong", "correct horse"} {
+		w := httptest.NewRecorder()
+		form := url.Values{"email": {"alice@example.com"}, "password": {password}}
+		r, _ := http.NewRequest("POST", "/auth/password/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := &web.Context{Request: r, ResponseWriter: w}
+		render := &mockRender{}
+		session := &mockSession{v: make(map[interface{}]interface{})}
+		LoginWithPassword(ctx, render, storage.Users, storage.Sessions, IdentityProviders{}, session, CsrfToken("TOKEN"), l)
+
+		if password == "wrong" {
+			if render.status != http.StatusUnauthorized || session.Get(SessionUserIdKey) != nil {
+				t.Errorf("Expected not to log in but got %d and %v", render.status, session.Get(SessionUserIdKey))
+			}
+		} else if w.Code != 302 || session.Get(SessionUserIdKey) != user.Id.Hex() {
+			t.Errorf("Expected to log in but got %d and %v", w.Code, session.Get(SessionUserIdKey))
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/render"
+	"net/http"
+	"time"
+)
+
+// Edit modes decide which pages a user can edit.
+const (
+	// Only today's page is editable.
+	EditModeStrict = "strict"
+	// Yesterday's page stays editable for a while after the day starts.
+	EditModeGrace = "grace"
+	// All the pages until today are editable.
+	EditModeAlways = "always"
+)
+
+// Users opt in to the other modes in their settings.
+const DefaultEditMode = EditModeStrict
+const DefaultGraceMinutes = 30
+const MaxGraceMinutes = 12 * 60
+
+type EditPolicy struct {
+	Mode         string
+	GraceMinutes int
+}
+
+func editPolicyOf(user *User) EditPolicy {
+	policy := EditPolicy{Mode: user.EditMode, GraceMinutes: user.GraceMinutes}
+	if policy.Mode == "" {
+		policy.Mode = DefaultEditMode
+	}
+	if policy.GraceMinutes <= 0 {
+		policy.GraceMinutes = DefaultGraceMinutes
+	}
+	return policy
+}
+
+func isValidEditMode(mode string) bool {
+	return mode == EditModeStrict || mode == EditModeGrace || mode == EditModeAlways
+}
+
+// EditError tells the client why a page is not editable.
+type EditError struct {
+	Code    string `json:"error"`
+	Message string `json:"message"`
+	Date    string `json:"date"`
+	Today   string `json:"today"`
+}
+
+func (err *EditError) Error() string {
+	return err.Message
+}
+
+// Check returns an error if the user can't edit the page of the date at now.
+func (policy EditPolicy) Check(user *User, date string, now time.Time) *EditError {
+	loc := user.Location()
+	today := logicalDate(now, loc, user.DayStartHour)
+	if date == today {
+		return nil
+	}
+	if date > today {
+		return &EditError{"future_entry", "Future entries are not editable", date, today}
+	}
+
+	switch policy.Mode {
+	case EditModeAlways:
+		return nil
+	case EditModeGrace:
+		t, err := parseDate(today, loc)
+		if err != nil {
+			break
+		}
+		y, m, d := t.Date()
+		dayStart := time.Date(y, m, d, user.DayStartHour, 0, 0, 0, loc)
+		yesterday := dateStringOfTime(time.Date(y, m, d-1, 0, 0, 0, 0, loc))
+		grace := time.Duration(policy.GraceMinutes) * time.Minute
+		if date == yesterday && now.Sub(dayStart) <= grace {
+			return nil
+		}
+	}
+	return &EditError{"past_entry", "Past entries are not editable", date, today}
+}
+
+//
+// Filters
+//
+
+func Editable(ren render.Render, params martini.Params, user *User) {
+	err := editPolicyOf(user).Check(user, params["date"], time.Now())
+	if err != nil {
+		ren.JSON(http.StatusForbidden, err)
+		return
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/codegangsta/martini"
+	"testing"
+	"time"
+)
+
+func Test_editPolicyOf_default(t *testing.T) {
+	policy := editPolicyOf(&User{})
+	if policy.Mode != EditModeStrict {
+		t.Errorf("Expected %s but got %s", EditModeStrict, policy.Mode)
+	}
+	if policy.GraceMinutes != DefaultGraceMinutes {
+		t.Errorf("Expected %d but got %d", DefaultGraceMinutes, policy.GraceMinutes)
+	}
+}
+
+func Test_EditPolicy_Check_today(t *testing.T) {
+	user := &User{Timezone: "UTC"}
+	now := time.Date(2014, 4, 2, 10, 0, 0, 0, time.UTC)
+	policy := EditPolicy{Mode: EditModeStrict}
+	if err := policy.Check(user, "2014-04-02", now); err != nil {
+		t.Errorf("Expected today to be editable but got %v", err)
+	}
+}
+
+func Test_EditPolicy_Check_future(t *testing.T) {
+	user := &User{Timezone: "UTC"}
+	now := time.Date(2014, 4, 2, 10, 0, 0, 0, time.UTC)
+	policy := EditPolicy{Mode: EditModeAlways}
+	err := policy.Check(user, "2014-04-03", now)
+	if err == nil || err.Code != "future_entry" {
+		t.Errorf("Expected future_entry error but got %v", err)
+	}
+}
+
+func Test_EditPolicy_Check_strict(t *testing.T) {
+	user := &User{Timezone: "UTC"}
+	now := time.Date(2014, 4, 2, 0, 0, 1, 0, time.UTC)
+	policy := EditPolicy{Mode: EditModeStrict}
+	err := policy.Check(user, "2014-04-01", now)
+	if err == nil || err.Code != "past_entry" {
+		t.Errorf("Expected past_entry error but got %v", err)
+	}
+	if err != nil && err.Today != "2014-04-02" {
+		t.Errorf("Expected %s but got %s", "2014-04-02", err.Today)
+	}
+}
+
+func Test_EditPolicy_Check_grace(t *testing.T) {
+	user := &User{Timezone: "UTC", DayStartHour: 4}
+	policy := EditPolicy{Mode: EditModeGrace, GraceMinutes: 30}
+
+	within := time.Date(2014, 4, 2, 4, 29, 0, 0, time.UTC)
+	if err := policy.Check(user, "2014-04-01", within); err != nil {
+		t.Errorf("Expected yesterday to be editable but got %v", err)
+	}
+
+	after := time.Date(2014, 4, 2, 4, 31, 0, 0, time.UTC)
+	if err := policy.Check(user, "2014-04-01", after); err == nil {
+		t.Error("Expected yesterday not to be editable after the grace period")
+	}
+
+	if err := policy.Check(user, "2014-03-31", within); err == nil {
+		t.Error("Expected the day before yesterday not to be editable")
+	}
+}
+
+func Test_EditPolicy_Check_defaultStrict(t *testing.T) {
+	// Users who haven't chosen a mode can't edit yesterday's page even right
+	// after the day starts.
+	user := &User{Timezone: "UTC", DayStartHour: 4}
+	within := time.Date(2014, 4, 2, 4, 1, 0, 0, time.UTC)
+	if err := editPolicyOf(user).Check(user, "2014-04-01", within); err == nil || err.Code != "past_entry" {
+		t.Errorf("Expected past_entry but got %v", err)
+	}
+}
+
+func Test_EditPolicy_Check_always(t *testing.T) {
+	user := &User{Timezone: "UTC"}
+	now := time.Date(2014, 4, 2, 10, 0, 0, 0, time.UTC)
+	policy := EditPolicy{Mode: EditModeAlways}
+	if err := policy.Check(user, "2013-01-01", now); err != nil {
+		t.Errorf("Expected past entry to be editable but got %v", err)
+	}
+}
+
+func Test_Editable(t *testing.T) {
+	render := &mockRender{}
+	user := &User{EditMode: EditModeStrict}
+	Editable(render, martini.Params{"date": "2000-01-01"}, user)
+
+	if render.status != 403 {
+		t.Errorf("Expected %d but got %d", 403, render.status)
+	}
+	if err, ok := render.v.(*EditError); !ok || err.Code != "past_entry" {
+		t.Errorf("Expected past_entry error but got %v", render.v)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/codegangsta/martini-contrib/web"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+//
+// Revision
+//
+
+const RevisionCollectionName = "revisions"
+
+// Revision is a snapshot of an entry's body before it was overwritten.
+type Revision struct {
+	Id        bson.ObjectId `bson:"_id" json:"id"`
+	EntryId   bson.ObjectId `bson:"entry_id" json:"entryId"`
+	UserId    bson.ObjectId `bson:"user_id" json:"userId"`
+	Date      string        `bson:"date" json:"date"`
+	Body      string        `bson:"body" json:"body"`
+	CreatedAt time.Time     `bson:"created_at" json:"createdAt"`
+}
+
+func NewRevision(entry *Entry, body string, now time.Time) *Revision {
+	return &Revision{
+		Id:        bson.NewObjectId(),
+		EntryId:   entry.Id,
+		UserId:    entry.UserId,
+		Date:      entry.Date,
+		Body:      body,
+		CreatedAt: now,
+	}
+}
+
+type RevisionStore interface {
+	Get(entry *Entry, revisionId string) (*Revision, error)
+	// FindByEntry returns the revisions of the entry, newest first.
+	FindByEntry(entry *Entry) ([]Revision, error)
+	Create(revision *Revision) error
+	Remove(ids []bson.ObjectId) error
+	// RemoveByUser removes all the revisions of the user's entries.
+	RemoveByUser(user *User) error
+	// MoveToEntry moves the revisions of an entry to another entry, which may
+	// be of another user.
+	MoveToEntry(from, to *Entry) error
+}
+
+type revisionStore struct {
+	db *mgo.Database
+}
+
+func (store *revisionStore) Get(entry *Entry, revisionId string) (*Revision, error) {
+	if !bson.IsObjectIdHex(revisionId) {
+		return nil, ErrNotFound
+	}
+	var revision Revision
+	query := bson.M{"_id": bson.ObjectIdHex(revisionId), "entry_id": entry.Id}
+	err := store.db.C(RevisionCollectionName).Find(query).One(&revision)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &revision, nil
+}
+
+func (store *revisionStore) FindByEntry(entry *Entry) ([]Revision, error) {
+	var revisions []Revision
+	query := bson.M{"entry_id": entry.Id}
+	err := store.db.C(RevisionCollectionName).Find(query).Sort("-created_at").All(&revisions)
+	return revisions, err
+}
+
+func (store *revisionStore) Create(revision *Revision) error {
+	return store.db.C(RevisionCollectionName).Insert(revision)
+}
+
+func (store *revisionStore) Remove(ids []bson.ObjectId) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := store.db.C(RevisionCollectionName).RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+func (store *revisionStore) RemoveByUser(user *User) error {
+	_, err := store.db.C(RevisionCollectionName).RemoveAll(bson.M{"user_id": user.Id})
+	return err
+}
+
+func (store *revisionStore) MoveToEntry(from, to *Entry) error {
+	_, err := store.db.C(RevisionCollectionName).UpdateAll(
+		bson.M{"entry_id": from.Id},
+		bson.M{"$set": bson.M{"entry_id": to.Id, "user_id": to.UserId, "date": to.Date}},
+	)
+	return err
+}
+
+//
+// Policy
+//
+
+// RevisionPolicy decides when to take snapshots and how long to keep them.
+type RevisionPolicy struct {
+	// Number of revisions kept per entry.
+	MaxRevisions int
+	// Revisions older than this are removed. Zero keeps them forever.
+	MaxAge time.Duration
+	// Autosave runs every 15 seconds. A snapshot is skipped if the latest one
+	// is newer than this, unless much of the body is removed.
+	MinInterval time.Duration
+}
+
+var DefaultRevisionPolicy = RevisionPolicy{
+	MaxRevisions: 50,
+	MaxAge:       0,
+	MinInterval:  time.Minute,
+}
+
+// revisionPolicyFromEnv reads REVISION_MAX_COUNT, REVISION_MAX_AGE and
+// REVISION_MIN_INTERVAL. Durations are in Go's format such as "720h".
+func revisionPolicyFromEnv() (RevisionPolicy, error) {
+	policy := DefaultRevisionPolicy
+	var err error
+	if v := os.Getenv("REVISION_MAX_COUNT"); v != "" {
+		policy.MaxRevisions, err = strconv.Atoi(v)
+		if err != nil {
+			return policy, err
+		}
+	}
+	if v := os.Getenv("REVISION_MAX_AGE"); v != "" {
+		policy.MaxAge, err = time.ParseDuration(v)
+		if err != nil {
+			return policy, err
+		}
+	}
+	if v := os.Getenv("REVISION_MIN_INTERVAL"); v != "" {
+		policy.MinInterval, err = time.ParseDuration(v)
+		if err != nil {
+			return policy, err
+		}
+	}
+	return policy, nil
+}
+
+// ShouldSnapshot tells whether to keep oldBody, which is being replaced with
+// newBody, as a revision. latest is the newest revision or nil.
+func (policy RevisionPolicy) ShouldSnapshot(latest *Revision, oldBody, newBody string, now time.Time) bool {
+	if oldBody == "" || oldBody == newBody {
+		return false
+	}
+	if latest == nil || now.Sub(latest.CreatedAt) >= policy.MinInterval {
+		return true
+	}
+	// Select-all-delete and the like.
+	return len(newBody) < len(oldBody)/2
+}
+
+// Expired returns IDs of revisions to remove. revisions should be newest first.
+func (policy RevisionPolicy) Expired(revisions []Revision, now time.Time) []bson.ObjectId {
+	var ids []bson.ObjectId
+	for i, revision := range revisions {
+		tooMany := policy.MaxRevisions > 0 && i >= policy.MaxRevisions
+		tooOld := policy.MaxAge > 0 && now.Sub(revision.CreatedAt) > policy.MaxAge
+		if tooMany || tooOld {
+			ids = append(ids, revision.Id)
+		}
+	}
+	return ids
+}
+
+// recordRevision keeps oldBody of the entry as a revision if the policy says
+// so, or always if force is true, and prunes old revisions.
+func recordRevision(revisions RevisionStore, policy RevisionPolicy, entry *Entry, oldBody string, force bool) error {
+	now := time.Now()
+	existing, err := revisions.FindByEntry(entry)
+	if err != nil {
+		return err
+	}
+	var latest *Revision
+	if len(existing) > 0 {
+		latest = &existing[0]
+	}
+	if !(force && oldBody != "") && !policy.ShouldSnapshot(latest, oldBody, entry.Body, now) {
+		return nil
+	}
+
+	revision := NewRevision(entry, oldBody, now)
+	err = revisions.Create(revision)
+	if err != nil {
+		return err
+	}
+	existing = append([]Revision{*revision}, existing...)
+	return revisions.Remove(policy.Expired(existing, now))
+}
+
+//
+// JSON APIs
+//
+
+func GetRevisions(ctx *web.Context, ren render.Render, entries EntryStore, revisions RevisionStore, params martini.Params, user *User) {
+	entry, err := entries.Find(user, params["date"])
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entry == nil {
+		ctx.Abort(http.StatusNotFound, "Entry not found")
+		return
+	}
+
+	rs, err := revisions.FindByEntry(entry)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if rs == nil {
+		rs = []Revision{}
+	}
+	ren.JSON(200, rs)
+}
+
+func RestoreRevision(ctx *web.Context, ren render.Render, entries EntryStore, revisions RevisionStore, policy RevisionPolicy, params martini.Params, user *User, l *log.Logger) {
+	entry, err := entries.Find(user, params["date"])
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if entry == nil {
+		ctx.Abort(http.StatusNotFound, "Entry not found")
+		return
+	}
+	revision, err := revisions.Get(entry, params["id"])
+	if err == ErrNotFound {
+		ctx.Abort(http.StatusNotFound, "Revision not found")
+		return
+	}
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	oldBody := entry.Body
+	entry.Body = revision.Body
+	entry.updateDerivedFields(user)
+	err = entries.Update(entry)
+	if err == ErrConflict {
+		renderCurrentEntry(ctx, ren, entries, user, entry.Date, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Keep the replaced body so that restoring can be undone.
+	err = recordRevision(revisions, policy, entry, oldBody, true)
+	if err != nil {
+		l.Println("Failed to record a revision", err)
+	}
+
+	setETag(ctx, entry)
+	ren.JSON(200, entry)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/web"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_RevisionPolicy_ShouldSnapshot(t *testing.T) {
+	policy := RevisionPolicy{MinInterval: time.Minute}
+	now := time.Now()
+	recent := &Revision{CreatedAt: now.Add(-30 * time.Second)}
+	old := &Revision{CreatedAt: now.Add(-2 * time.Minute)}
+
+	if !policy.ShouldSnapshot(nil, "Hello", "Hello World", now) {
+		t.Error("Expected to take the first snapshot")
+	}
+	if policy.ShouldSnapshot(nil, "", "Hello", now) {
+		t.Error("Expected not to take a snapshot of an empty body")
+	}
+	if policy.ShouldSnapshot(old, "Hello", "Hello", now) {
+		t.Error("Expected not to take a snapshot of an unchanged body")
+	}
+	if policy.ShouldSnapshot(recent, "Hello", "Hello World", now) {
+		t.Error("Expected not to take a snapshot soon after the latest one")
+	}
+	if !policy.ShouldSnapshot(old, "Hello", "Hello World", now) {
+		t.Error("Expected to take a snapshot after the interval")
+	}
+	if !policy.ShouldSnapshot(recent, "Hello World", "", now) {
+		t.Error("Expected to take a snapshot when most of the body is removed")
+	}
+}
+
+func Test_RevisionPolicy_Expired(t *testing.T) {
+	policy := RevisionPolicy{MaxRevisions: 2, MaxAge: time.Hour}
+	now := time.Now()
+	revisions := []Revision{
+		{Id: bson.NewObjectId(), CreatedAt: now},
+		{Id: bson.NewObjectId(), CreatedAt: now.Add(-2 * time.Hour)},
+		{Id: bson.NewObjectId(), CreatedAt: now.Add(-3 * time.Hour)},
+	}
+	ids := policy.Expired(revisions, now)
+	if len(ids) != 2 || ids[0] != revisions[1].Id || ids[1] != revisions[2].Id {
+		t.Errorf("Expected the old revisions to expire but got %v", ids)
+	}
+}
+
+func Test_UpdateEntry_recordsRevision(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	entry := NewEntry(user, "2014-04-01")
+	entry.Body = "Hello World"
+	storage.Entries.Create(entry)
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("PUT", "/entries/2014-04-01", strings.NewReader(`{"body": "", "version": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	render := &mockRender{}
+	params := martini.Params{"date": "2014-04-01"}
+	l := log.New(os.Stdout, "", 0)
+	UpdateEntry(ctx, render, storage.Entries, storage.Revisions, DefaultRevisionPolicy, params, user, l)
+
+	if render.status != 200 {
+		t.Fatalf("Expected %d but got %d", 200, render.status)
+	}
+	revisions, _ := storage.Revisions.FindByEntry(entry)
+	if len(revisions) != 1 || revisions[0].Body != "Hello World" {
+		t.Errorf("Expected the old body to be kept but got %v", revisions)
+	}
+}
+
+func Test_RestoreRevision(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	entry := NewEntry(user, "2014-04-01")
+	entry.Body = "Oops"
+	storage.Entries.Create(entry)
+	revision := NewRevision(entry, "Hello World", time.Now())
+	storage.Revisions.Create(revision)
+
+	w := httptest.NewRecorder()
+	ctx := &web.Context{ResponseWriter: w}
+	render := &mockRender{}
+	params := martini.Params{"date": "2014-04-01", "id": revision.Id.Hex()}
+	l := log.New(os.Stdout, "", 0)
+	RestoreRevision(ctx, render, storage.Entries, storage.Revisions, DefaultRevisionPolicy, params, user, l)
+
+	if render.status != 200 {
+		t.Fatalf("Expected %d but got %d", 200, render.status)
+	}
+	restored, _ := storage.Entries.Find(user, "2014-04-01")
+	if restored.Body != "Hello World" {
+		t.Errorf("Expected %s but got %s", "Hello World", restored.Body)
+	}
+	revisions, _ := storage.Revisions.FindByEntry(entry)
+	if len(revisions) != 2 || revisions[0].Body != "Oops" {
+		t.Errorf("Expected the replaced body to be kept but got %v", revisions)
+	}
+}
+
+func Test_RestoreRevision_notFound(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	storage.Entries.Create(NewEntry(user, "2014-04-01"))
+
+	w := httptest.NewRecorder()
+	ctx := &web.Context{ResponseWriter: w}
+	render := &mockRender{}
+	params := martini.Params{"date": "2014-04-01", "id": bson.NewObjectId().Hex()}
+	l := log.New(os.Stdout, "", 0)
+	RestoreRevision(ctx, render, storage.Entries, storage.Revisions, DefaultRevisionPolicy, params, user, l)
+
+	if w.Code != 404 {
+		t.Errorf("Expected %d but got %d", 404, w.Code)
+	}
+}
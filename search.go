@@ -0,0 +1,334 @@
+package main
+
+import (
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/codegangsta/martini-contrib/web"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Entries are indexed by every character and every pair of adjacent characters
+// (bigram) in their bodies. Japanese is written without spaces between words,
+// so the index doesn't rely on words. An entry matches a query if it has all
+// the grams of the query, and then its body is checked for the exact terms.
+
+const DefaultSearchPerPage = 20
+const MaxSearchPerPage = 100
+
+// Number of characters around the first match in a snippet.
+const snippetRadius = 40
+
+type SearchResult struct {
+	Date string `json:"date"`
+	// HTML with matches highlighted with <mark>.
+	Snippet string `json:"snippet"`
+	// Number of matches in the entry.
+	Matches int `json:"matches"`
+}
+
+type SearchResults struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"`
+	Page    int            `json:"page"`
+	PerPage int            `json:"perPage"`
+	Results []SearchResult `json:"results"`
+}
+
+// normalizeRune folds full-width alphanumerics and cases so that "ＡＢＣ"
+// matches "abc". It maps a rune to a rune so that positions in normalized text
+// are the same as in the original.
+func normalizeRune(r rune) rune {
+	switch {
+	case r >= 0xff01 && r <= 0xff5e:
+		r -= 0xfee0
+	case r == 0x3000:
+		r = ' '
+	}
+	return unicode.ToLower(r)
+}
+
+func normalizeText(text string) []rune {
+	runes := []rune(text)
+	for i, r := range runes {
+		runes[i] = normalizeRune(r)
+	}
+	return runes
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// splitWords splits normalized text into runs of letters and digits.
+func splitWords(runes []rune) [][]rune {
+	var words [][]rune
+	start := -1
+	for i, r := range runes {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			words = append(words, runes[start:i])
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, runes[start:])
+	}
+	return words
+}
+
+// indexGrams returns the sorted characters and bigrams in the text.
+func indexGrams(text string) []string {
+	set := make(map[string]bool)
+	for _, word := range splitWords(normalizeText(text)) {
+		for i := range word {
+			set[string(word[i])] = true
+			if i+1 < len(word) {
+				set[string(word[i:i+2])] = true
+			}
+		}
+	}
+	grams := make([]string, 0, len(set))
+	for gram := range set {
+		grams = append(grams, gram)
+	}
+	sort.Strings(grams)
+	return grams
+}
+
+// queryGrams returns the grams that entries containing all the terms have.
+// Bigrams are enough for terms longer than a character.
+func queryGrams(terms [][]rune) []string {
+	set := make(map[string]bool)
+	for _, term := range terms {
+		if len(term) == 1 {
+			set[string(term)] = true
+		}
+		for i := 0; i+1 < len(term); i++ {
+			set[string(term[i:i+2])] = true
+		}
+	}
+	grams := make([]string, 0, len(set))
+	for gram := range set {
+		grams = append(grams, gram)
+	}
+	sort.Strings(grams)
+	return grams
+}
+
+// hasGrams returns whether sorted grams contain all the wanted ones.
+func hasGrams(grams []string, wanted []string) bool {
+	for _, gram := range wanted {
+		i := sort.SearchStrings(grams, gram)
+		if i == len(grams) || grams[i] != gram {
+			return false
+		}
+	}
+	return true
+}
+
+// match is a range of runes in a body.
+type match struct {
+	start, end int
+}
+
+type matchesByStart []match
+
+func (ms matchesByStart) Len() int           { return len(ms) }
+func (ms matchesByStart) Less(i, j int) bool { return ms[i].start < ms[j].start }
+func (ms matchesByStart) Swap(i, j int)      { ms[i], ms[j] = ms[j], ms[i] }
+
+// findTerms returns the positions of all the terms in the body sorted, or nil
+// if any of the terms is missing.
+func findTerms(body []rune, terms [][]rune) []match {
+	var matches []match
+	for _, term := range terms {
+		found := false
+		for i := 0; i+len(term) <= len(body); i++ {
+			if runesEqual(body[i:i+len(term)], term) {
+				matches = append(matches, match{i, i + len(term)})
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	sort.Sort(matchesByStart(matches))
+	return matches
+}
+
+func runesEqual(a, b []rune) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// snippet returns HTML of the body around the first match with matches in it
+// highlighted.
+func snippet(body []rune, matches []match) string {
+	from := matches[0].start - snippetRadius
+	if from < 0 {
+		from = 0
+	}
+	to := matches[0].end + snippetRadius
+	if to > len(body) {
+		to = len(body)
+	}
+
+	var buf []string
+	if from > 0 {
+		buf = append(buf, "…")
+	}
+	pos := from
+	for _, m := range matches {
+		if m.end <= pos {
+			// Overlaps with the previous match.
+			continue
+		}
+		if m.start >= to {
+			break
+		}
+		start := m.start
+		if start < pos {
+			start = pos
+		}
+		end := m.end
+		if end > to {
+			end = to
+		}
+		buf = append(buf, escapeSnippet(body[pos:start]), "<mark>", escapeSnippet(body[start:end]), "</mark>")
+		pos = end
+	}
+	buf = append(buf, escapeSnippet(body[pos:to]))
+	if to < len(body) {
+		buf = append(buf, "…")
+	}
+	return strings.Join(buf, "")
+}
+
+func escapeSnippet(runes []rune) string {
+	s := strings.Replace(string(runes), "\r\n", " ", -1)
+	s = strings.Replace(s, "\n", " ", -1)
+	return html.EscapeString(s)
+}
+
+// searchEntries returns a page of the user's entries that contain all the
+// words in the query, newest first.
+//
+// The index is exact for terms of one or two characters, so only the entries
+// of the page are read for them. Entries found with the bigrams of longer terms
+// may not contain the terms, so all of them are checked to count the results,
+// but snippets are made only for the page.
+func searchEntries(entries EntryStore, user *User, query string, page, perPage int) (*SearchResults, error) {
+	results := &SearchResults{Query: query, Page: page, PerPage: perPage, Results: []SearchResult{}}
+	terms := splitWords(normalizeText(query))
+	if len(terms) == 0 {
+		return results, nil
+	}
+	from := (page - 1) * perPage
+	to := from + perPage
+
+	if isIndexExact(terms) {
+		candidates, total, err := entries.Search(user, queryGrams(terms), from, perPage)
+		if err != nil {
+			return nil, err
+		}
+		results.Total = total
+		for i := range candidates {
+			matches := findTerms(normalizeText(candidates[i].Body), terms)
+			if matches != nil {
+				results.Results = append(results.Results, searchResult(&candidates[i], []rune(candidates[i].Body), matches))
+			}
+		}
+		return results, nil
+	}
+
+	candidates, _, err := entries.Search(user, queryGrams(terms), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		// Matched positions in normalized text are the same as in the original.
+		matches := findTerms(normalizeText(candidates[i].Body), terms)
+		if matches == nil {
+			continue
+		}
+		if from <= results.Total && results.Total < to {
+			results.Results = append(results.Results, searchResult(&candidates[i], []rune(candidates[i].Body), matches))
+		}
+		results.Total++
+	}
+	return results, nil
+}
+
+// isIndexExact returns whether entries with the grams of the terms always
+// contain the terms, which is the case if none is longer than a bigram.
+func isIndexExact(terms [][]rune) bool {
+	for _, term := range terms {
+		if len(term) > 2 {
+			return false
+		}
+	}
+	return true
+}
+
+func searchResult(entry *Entry, body []rune, matches []match) SearchResult {
+	return SearchResult{
+		Date:    entry.Date,
+		Snippet: snippet(body, matches),
+		Matches: len(matches),
+	}
+}
+
+//
+// JSON APIs
+//
+
+func SearchEntries(ctx *web.Context, ren render.Render, entries EntryStore, user *User) {
+	query := strings.TrimSpace(ctx.Params["q"])
+	if query == "" {
+		ctx.Abort(http.StatusBadRequest, "Query is required")
+		return
+	}
+	page, ok := intParam(ctx, "page", 1)
+	if !ok || page < 1 {
+		ctx.Abort(http.StatusBadRequest, "Invalid page")
+		return
+	}
+	perPage, ok := intParam(ctx, "perPage", DefaultSearchPerPage)
+	if !ok || perPage < 1 {
+		ctx.Abort(http.StatusBadRequest, "Invalid perPage")
+		return
+	}
+	if perPage > MaxSearchPerPage {
+		perPage = MaxSearchPerPage
+	}
+
+	results, err := searchEntries(entries, user, query, page, perPage)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	ren.JSON(200, results)
+}
+
+// intParam returns the integer query parameter, or the default value if it is
+// not given.
+func intParam(ctx *web.Context, name string, defaultValue int) (int, bool) {
+	s := ctx.Params[name]
+	if s == "" {
+		return defaultValue, true
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/codegangsta/martini-contrib/web"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_indexGrams(t *testing.T) {
+	grams := indexGrams("引っ越し、ＯＫ")
+	expected := []string{"ok", "k", "o", "っ", "っ越", "し", "引", "引っ", "越", "越し"}
+	for _, gram := range expected {
+		if !hasGrams(grams, []string{gram}) {
+			t.Errorf("Expected %s in %v", gram, grams)
+		}
+	}
+	if hasGrams(grams, []string{"し、"}) || hasGrams(grams, []string{"しo"}) {
+		t.Errorf("Expected grams not to span punctuation but got %v", grams)
+	}
+}
+
+func Test_queryGrams(t *testing.T) {
+	grams := queryGrams([][]rune{[]rune("引越"), []rune("a"), []rune("abc")})
+	expected := []string{"a", "ab", "bc", "引越"}
+	if strings.Join(grams, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v but got %v", expected, grams)
+	}
+}
+
+func Test_snippet(t *testing.T) {
+	body := []rune(strings.Repeat("あ", 50) + "<b>引っ越し</b>" + strings.Repeat("い", 50))
+	s := snippet(body, findTerms(body, [][]rune{[]rune("引っ越し")}))
+	expected := "…" + strings.Repeat("あ", 37) + "&lt;b&gt;<mark>引っ越し</mark>&lt;/b&gt;" + strings.Repeat("い", 36) + "…"
+	if s != expected {
+		t.Errorf("Expected %s but got %s", expected, s)
+	}
+}
+
+func saveEntry(t *testing.T, storage *Storage, user *User, date, body string) {
+	entry := NewEntry(user, date)
+	entry.Body = body
+	entry.updateDerivedFields(user)
+	if _, err := storage.Entries.Create(entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_searchEntries(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	saveEntry(t, storage, user, "2014-04-01", "来月引っ越しをする。")
+	saveEntry(t, storage, user, "2014-04-02", "引っ越しの準備。Moving is hard.")
+	saveEntry(t, storage, user, "2014-04-03", "越し引っ")
+	saveEntry(t, storage, user, "2014-04-04", "Nothing happened.")
+
+	results, err := searchEntries(storage.Entries, user, "引っ越し", 1, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Total != 2 || len(results.Results) != 2 {
+		t.Fatalf("Expected %d results but got %v", 2, results)
+	}
+	if results.Results[0].Date != "2014-04-02" || results.Results[1].Date != "2014-04-01" {
+		t.Errorf("Expected results newest first but got %v", results.Results)
+	}
+	expected := "来月<mark>引っ越し</mark>をする。"
+	if snippet := results.Results[1].Snippet; snippet != expected {
+		t.Errorf("Expected %s but got %s", expected, snippet)
+	}
+
+	results, _ = searchEntries(storage.Entries, user, "ＭＯＶＩＮＧ 準備", 1, 20)
+	if results.Total != 1 || results.Results[0].Matches != 2 {
+		t.Errorf("Expected a result with %d matches but got %v", 2, results)
+	}
+
+	results, _ = searchEntries(storage.Entries, user, "引っ越し", 2, 1)
+	if results.Total != 2 || len(results.Results) != 1 || results.Results[0].Date != "2014-04-01" {
+		t.Errorf("Expected the second page but got %v", results)
+	}
+	results, _ = searchEntries(storage.Entries, user, "引っ越し", 3, 1)
+	if results.Total != 2 || len(results.Results) != 0 {
+		t.Errorf("Expected an empty page but got %v", results)
+	}
+}
+
+// pagingEntryStore records how many entries Search is asked for.
+type pagingEntryStore struct {
+	EntryStore
+	limits []int
+}
+
+func (store *pagingEntryStore) Search(user *User, grams []string, skip, limit int) ([]Entry, int, error) {
+	store.limits = append(store.limits, limit)
+	return store.EntryStore.Search(user, grams, skip, limit)
+}
+
+func Test_searchEntries_page(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	for _, date := range []string{"2014-04-01", "2014-04-02", "2014-04-03"} {
+		saveEntry(t, storage, user, date, "今日は引っ越し。")
+	}
+
+	// Only the page is read for a bigram.
+	entries := &pagingEntryStore{EntryStore: storage.Entries}
+	results, err := searchEntries(entries, user, "越し", 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Total != 3 || len(results.Results) != 1 || results.Results[0].Date != "2014-04-01" {
+		t.Errorf("Expected the second page but got %v", results)
+	}
+	if len(entries.limits) != 1 || entries.limits[0] != 2 {
+		t.Errorf("Expected to read only the page but got limits %v", entries.limits)
+	}
+}
+
+func Test_SearchEntries_invalid(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+
+	for _, query := range []string{"", "q=", "q=hello&page=0", "q=hello&perPage=x"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/entries/search?"+query, nil)
+		ctx := &web.Context{Request: r, ResponseWriter: w, Params: map[string]string{}}
+		for k, v := range r.URL.Query() {
+			ctx.Params[k] = v[0]
+		}
+		render := &mockRender{}
+		SearchEntries(ctx, render, storage.Entries, user)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %d for %s but got %d", http.StatusBadRequest, query, w.Code)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/codegangsta/martini-contrib/sessions"
 	"github.com/codegangsta/martini-contrib/web"
 	"github.com/joho/godotenv"
-	"labix.org/v2/mgo"
 	"log"
 	"os"
 	"os/signal"
@@ -17,12 +16,50 @@ func prepareRouter(m *martini.ClassicMartini) {
 
 	m.Get("/auth", ShowLogin)
 	m.Get("/auth/logout", Logout)
-	m.Get("/auth/callback", GetAccessToken, GetUserInfo, FindOrCreateUser)
+	m.Post("/auth/password/login", LoginWithPassword)
+	m.Get("/auth/password/register", ShowRegister)
+	m.Post("/auth/password/register", Register)
+	m.Get("/auth/password/forgot", ShowForgotPassword)
+	m.Post("/auth/password/forgot", SendPasswordReset)
+	m.Get("/auth/password/reset", ShowResetPassword)
+	m.Post("/auth/password/reset", ResetPassword)
+	// Registered as the redirect URL of the Facebook app before there were
+	// other providers.
+	m.Get("/auth/callback", UseProvider("facebook"), GetAccessToken, GetUserInfo, FindOrCreateUser)
+	m.Get("/auth/:provider", FindProvider, RedirectToProvider)
+	m.Get("/auth/:provider/callback", FindProvider, GetAccessToken, GetUserInfo, FindOrCreateUser)
 
 	m.Get("/entries", Authorize, GetEntries)
+	// Before /entries/:date not to be taken for a date.
+	m.Get("/entries/search", Authorize, SearchEntries)
 	m.Get("/entries/:date", Authorize, ValidateDate, GetEntry)
-	m.Post("/entries/:date", Authorize, ValidateDate, CreateEntry)
-	m.Put("/entries/:date", Authorize, ValidateDate, UpdateEntry)
+	m.Post("/entries/:date", Authorize, ValidateDate, Editable, CreateEntry)
+	m.Put("/entries/:date", Authorize, ValidateDate, Editable, UpdateEntry)
+	m.Get("/entries/:date/revisions", Authorize, ValidateDate, GetRevisions)
+	m.Post("/entries/:date/revisions/:id/restore", Authorize, ValidateDate, Editable, RestoreRevision)
+
+	m.Get("/stats", Authorize, GetStats)
+	m.Get("/export", Authorize, ExportEntries)
+	// Imports aren't restricted to editable dates.
+	m.Post("/import", Authorize, ImportEntries)
+
+	m.Get("/settings", Authorize, GetSettings)
+	m.Put("/settings", Authorize, UpdateSettings)
+
+	// Tokens can't manage the account.
+	m.Get("/account", Authorize, SessionOnly, ShowAccount)
+	m.Post("/account/password", Authorize, SessionOnly, ChangePassword)
+	m.Get("/account/link/:provider", Authorize, SessionOnly, FindProvider, LinkIdentity)
+	m.Get("/account/merge", Authorize, SessionOnly, ShowMerge)
+	m.Post("/account/merge", Authorize, SessionOnly, MergeAccount)
+	m.Post("/account/tokens", Authorize, SessionOnly, CreateToken)
+	m.Post("/account/tokens/:id/revoke", Authorize, SessionOnly, RevokeToken)
+	m.Get("/account/sessions", Authorize, SessionOnly, ListSessions)
+	m.Delete("/account/sessions/:id", Authorize, SessionOnly, RevokeSession)
+	m.Post("/account/sessions/:id/revoke", Authorize, SessionOnly, RevokeSessionForm)
+	m.Post("/account/sessions/revoke-others", Authorize, SessionOnly, RevokeOtherSessions)
+	m.Get("/account/export", Authorize, SessionOnly, ExportAccount)
+	m.Delete("/account", Authorize, SessionOnly, DeleteAccount)
 }
 
 // Execute cleanup func when the server is killed.
@@ -42,31 +79,67 @@ func main() {
 		log.Println("Failed to load .env. Maybe on production?")
 	}
 
-	m := martini.Classic()
-
 	//
 	// Database
 	//
-	session, err := mgo.Dial(os.Getenv("MONGOHQ_URL"))
+	storageUrl := os.Getenv("STORAGE_URL")
+	if storageUrl == "" {
+		storageUrl = os.Getenv("MONGOHQ_URL")
+	}
+
+	//
+	// Subcommands
+	//
+	if len(os.Args) > 1 {
+		err = runCommand(storageUrl, os.Args[1], os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	storage, err := OpenStorage(storageUrl)
 	if err != nil {
 		log.Fatal(err)
 	}
+
 	cleanupBeforeExit(func() {
 		log.Println("Cleaning up...")
-		session.Close()
+		storage.Close()
 		os.Exit(1)
 	})
+	err = storage.Migrate(false, log.New(os.Stdout, "[migrate] ", 0))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	db := session.DB("") // Use database specified in the URL.
-	m.MapTo(&userStore{db}, (*UserStore)(nil))
-	m.MapTo(&entryStore{db}, (*EntryStore)(nil))
+	m := martini.Classic()
+
+	m.MapTo(storage.Users, (*UserStore)(nil))
+	m.MapTo(storage.Entries, (*EntryStore)(nil))
+	m.MapTo(storage.Revisions, (*RevisionStore)(nil))
+	m.MapTo(storage.Tokens, (*TokenStore)(nil))
+	m.MapTo(storage.Sessions, (*SessionStore)(nil))
+
+	revisionPolicy, err := revisionPolicyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.Map(revisionPolicy)
 
 	//
 	// Session
 	//
-	sessionKey := os.Getenv("SESSION_KEY")
-	store := sessions.NewCookieStore([]byte(sessionKey))
-	m.Use(sessions.Sessions("default-session", store))
+	sessionKeys, err := sessionKeysFromEnv(martini.Env, log.New(os.Stdout, "[sessions] ", 0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cookieOptions, err := cookieOptionsFromEnv(martini.Env)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.Use(SameSite(cookieOptions.SameSite))
+	m.Use(sessions.Sessions(SessionCookieName, newCookieSessionStore(sessionKeys, cookieOptions)))
 
 	//
 	// Template
@@ -78,18 +151,29 @@ func main() {
 	}))
 
 	//
-	// Facebook Auth
+	// Identity providers
 	//
-	appId := os.Getenv("FB_APP_ID")
-	appSecret := os.Getenv("FB_APP_SECRET")
-	redirectUrl := os.Getenv("FB_REDIRECT_URL")
-	fb := NewFacebookAuth(appId, appSecret, redirectUrl)
-	m.MapTo(fb, (*FacebookAuth)(nil))
+	providers, err := identityProvidersFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.Map(providers)
+
+	mailer, err := mailerFromEnv(log.New(os.Stdout, "[mail] ", 0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.MapTo(mailer, (*Mailer)(nil))
 
 	//
 	// web.go context
 	//
-	m.Use(web.ContextWithCookieSecret(sessionKey))
+	m.Use(web.ContextWithCookieSecret(string(sessionKeys[0].Hash)))
+
+	//
+	// CSRF protection of all requests that change anything
+	//
+	m.Use(Csrf)
 
 	//
 	// Router
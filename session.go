@@ -0,0 +1,293 @@
+package main
+
+import (
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/codegangsta/martini-contrib/sessions"
+	"github.com/codegangsta/martini-contrib/web"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"net/http"
+	"time"
+)
+
+//
+// The cookie only carries the ID of a login session saved in the storage so
+// that users can see where they are logged in and log other devices out.
+//
+
+const SessionCollectionName = "sessions"
+
+const SessionIdKey string = "session-id"
+
+// Sessions end after SessionIdleTimeout without requests, and after
+// SessionMaxAge even if they are used.
+const SessionIdleTimeout = 14 * 24 * time.Hour
+const SessionMaxAge = 90 * 24 * time.Hour
+
+// LastSeenAt is saved at most once in this interval so that every request
+// doesn't write.
+const sessionTouchInterval = time.Minute
+
+type LoginSession struct {
+	Id         bson.ObjectId `bson:"_id" json:"id"`
+	UserId     bson.ObjectId `bson:"user_id" json:"-"`
+	UserAgent  string        `bson:"user_agent" json:"userAgent"`
+	RemoteAddr string        `bson:"remote_addr" json:"remoteAddr"`
+	CreatedAt  time.Time     `bson:"created_at" json:"createdAt"`
+	LastSeenAt time.Time     `bson:"last_seen_at" json:"lastSeenAt"`
+}
+
+func newLoginSession(user *User, r *http.Request, now time.Time) *LoginSession {
+	return &LoginSession{
+		Id:         bson.NewObjectId(),
+		UserId:     user.Id,
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: remoteAddr(r),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+}
+
+// remoteAddr returns the client's address. X-Forwarded-For is trusted
+// because the app runs behind a proxy in production. It's only shown to the
+// user.
+func remoteAddr(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return forwarded
+	}
+	return r.RemoteAddr
+}
+
+func (s *LoginSession) IsExpired(now time.Time) bool {
+	return !now.Before(s.LastSeenAt.Add(SessionIdleTimeout)) || !now.Before(s.CreatedAt.Add(SessionMaxAge))
+}
+
+//
+// Store
+//
+
+type SessionStore interface {
+	// Get returns ErrNotFound if there is no session of the ID.
+	Get(id string) (*LoginSession, error)
+	// FindByUser returns the user's sessions, most recently used first.
+	FindByUser(user *User) ([]LoginSession, error)
+	Create(s *LoginSession) error
+	// Touch saves LastSeenAt of the session.
+	Touch(s *LoginSession) error
+	// Remove returns ErrNotFound unless the user has the session.
+	Remove(user *User, id string) error
+	RemoveByUser(user *User) error
+}
+
+type sessionStore struct {
+	db *mgo.Database
+}
+
+func (store *sessionStore) Get(id string) (*LoginSession, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+	var s LoginSession
+	err := store.db.C(SessionCollectionName).FindId(bson.ObjectIdHex(id)).One(&s)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &s, nil
+}
+
+func (store *sessionStore) FindByUser(user *User) ([]LoginSession, error) {
+	var ss []LoginSession
+	err := store.db.C(SessionCollectionName).Find(bson.M{"user_id": user.Id}).Sort("-last_seen_at").All(&ss)
+	return ss, err
+}
+
+func (store *sessionStore) Create(s *LoginSession) error {
+	return store.db.C(SessionCollectionName).Insert(s)
+}
+
+func (store *sessionStore) Touch(s *LoginSession) error {
+	err := store.db.C(SessionCollectionName).UpdateId(s.Id, bson.M{"$set": bson.M{"last_seen_at": s.LastSeenAt}})
+	return notFound(err)
+}
+
+func (store *sessionStore) Remove(user *User, id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+	err := store.db.C(SessionCollectionName).Remove(bson.M{"_id": bson.ObjectIdHex(id), "user_id": user.Id})
+	return notFound(err)
+}
+
+func (store *sessionStore) RemoveByUser(user *User) error {
+	_, err := store.db.C(SessionCollectionName).RemoveAll(bson.M{"user_id": user.Id})
+	return err
+}
+
+//
+// Logging in and out
+//
+
+// logIn starts a new login session of the user.
+func logIn(r *http.Request, logins SessionStore, session sessions.Session, user *User) error {
+	s := newLoginSession(user, r, time.Now())
+	err := logins.Create(s)
+	if err != nil {
+		return err
+	}
+	session.Set(SessionUserIdKey, user.Id.Hex())
+	session.Set(SessionIdKey, s.Id.Hex())
+	return nil
+}
+
+// logOut ends the login session of the cookie if any.
+func logOut(logins SessionStore, session sessions.Session) error {
+	userId, _ := session.Get(SessionUserIdKey).(string)
+	id, _ := session.Get(SessionIdKey).(string)
+	session.Delete(SessionUserIdKey)
+	session.Delete(SessionIdKey)
+	if userId == "" || id == "" || !bson.IsObjectIdHex(userId) {
+		return nil
+	}
+	err := logins.Remove(&User{Id: bson.ObjectIdHex(userId)}, id)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// removeOtherSessions logs the user out of every session but the current
+// one, which can be nil.
+func removeOtherSessions(logins SessionStore, user *User, current *LoginSession) error {
+	ss, err := logins.FindByUser(user)
+	if err != nil {
+		return err
+	}
+	for _, s := range ss {
+		if current != nil && s.Id == current.Id {
+			continue
+		}
+		err = logins.Remove(user, s.Id.Hex())
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorizeSession maps the login session of the cookie and its user. Sessions
+// that are revoked or expired are logged out.
+func authorizeSession(ctx *web.Context, c martini.Context, users UserStore, logins SessionStore, session sessions.Session, l *log.Logger) {
+	userId, _ := session.Get(SessionUserIdKey).(string)
+	if userId == "" {
+		l.Println("Unauthorized access")
+		ctx.Redirect(http.StatusFound, "/auth")
+		return
+	}
+
+	id, _ := session.Get(SessionIdKey).(string)
+	s, err := logins.Get(id)
+	if err != nil && err != ErrNotFound {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	now := time.Now()
+	if err == ErrNotFound || s.UserId.Hex() != userId || s.IsExpired(now) {
+		l.Println("Session revoked or expired")
+		logOut(logins, session)
+		ctx.Redirect(http.StatusFound, "/auth")
+		return
+	}
+
+	user, err := users.Get(userId)
+	if err != nil {
+		l.Println("User not found")
+		logOut(logins, session)
+		ctx.Redirect(http.StatusFound, "/auth")
+		return
+	}
+
+	if now.Sub(s.LastSeenAt) >= sessionTouchInterval {
+		s.LastSeenAt = now
+		err = logins.Touch(s)
+		if err != nil {
+			l.Println("Failed to touch a session", err)
+		}
+	}
+	c.Map(s)
+	c.Map(user)
+}
+
+//
+// Handlers
+//
+
+type sessionInfo struct {
+	LoginSession
+	Current bool `json:"current"`
+}
+
+// sessionInfos returns the user's sessions that haven't expired.
+func sessionInfos(logins SessionStore, user *User, current *LoginSession) ([]sessionInfo, error) {
+	ss, err := logins.FindByUser(user)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	infos := []sessionInfo{}
+	for _, s := range ss {
+		if s.IsExpired(now) {
+			continue
+		}
+		infos = append(infos, sessionInfo{s, current != nil && s.Id == current.Id})
+	}
+	return infos, nil
+}
+
+func ListSessions(ctx *web.Context, ren render.Render, logins SessionStore, current *LoginSession, user *User) {
+	infos, err := sessionInfos(logins, user, current)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	ren.JSON(200, infos)
+}
+
+func revokeSession(ctx *web.Context, logins SessionStore, params martini.Params, user *User, l *log.Logger) bool {
+	err := logins.Remove(user, params["id"])
+	if err == ErrNotFound {
+		ctx.Abort(http.StatusNotFound, "Session not found")
+		return false
+	}
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return false
+	}
+	l.Println("Revoked a session", params["id"], "of", user.Id.Hex())
+	return true
+}
+
+func RevokeSession(ctx *web.Context, ren render.Render, logins SessionStore, params martini.Params, user *User, l *log.Logger) {
+	if revokeSession(ctx, logins, params, user, l) {
+		ren.JSON(200, map[string]bool{"revoked": true})
+	}
+}
+
+// RevokeSessionForm is RevokeSession for the form on the account page.
+func RevokeSessionForm(ctx *web.Context, logins SessionStore, params martini.Params, user *User, l *log.Logger) {
+	if revokeSession(ctx, logins, params, user, l) {
+		ctx.Redirect(http.StatusFound, "/account")
+	}
+}
+
+// RevokeOtherSessions logs the user out everywhere else.
+func RevokeOtherSessions(ctx *web.Context, logins SessionStore, current *LoginSession, user *User, l *log.Logger) {
+	err := removeOtherSessions(logins, user, current)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	l.Println("Revoked other sessions of", user.Id.Hex())
+	ctx.Redirect(http.StatusFound, "/account")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"github.com/codegangsta/inject"
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/web"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_LoginSession_IsExpired(t *testing.T) {
+	now := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		createdAt, lastSeenAt time.Time
+		expected              bool
+	}{
+		{now.Add(-time.Hour), now.Add(-time.Minute), false},
+		{now.Add(-SessionIdleTimeout - time.Hour), now.Add(-SessionIdleTimeout), true},
+		{now.Add(-SessionMaxAge), now.Add(-time.Minute), true},
+		{now.Add(-SessionMaxAge + time.Hour), now.Add(-time.Minute), false},
+	}
+	for _, c := range cases {
+		s := &LoginSession{CreatedAt: c.createdAt, LastSeenAt: c.lastSeenAt}
+		if s.IsExpired(now) != c.expected {
+			t.Errorf("Expected %v for %v but got %v", c.expected, s, !c.expected)
+		}
+	}
+}
+
+func sessionRequest(storage *Storage, session *mockSession) (*httptest.ResponseRecorder, *mockContext) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/entries/2014-06-01", nil)
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	c := &mockContext{inject.New()}
+	l := log.New(os.Stdout, "", 0)
+	Authorize(ctx, storage.Users, storage.Tokens, storage.Sessions, c, session, l)
+	return w, c
+}
+
+func mappedSession(c martini.Context) *LoginSession {
+	v := c.Get(reflect.TypeOf(&LoginSession{}))
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Interface().(*LoginSession)
+}
+
+func Test_Authorize_session(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "Browser")
+	session := &mockSession{v: make(map[interface{}]interface{})}
+	if err := logIn(r, storage.Sessions, session, user); err != nil {
+		t.Fatal(err)
+	}
+
+	w, c := sessionRequest(storage, session)
+	if w.Code != 200 || mappedUser(c) == nil || mappedUser(c).Id != user.Id {
+		t.Fatalf("Expected the user to be mapped but got %d", w.Code)
+	}
+	s := mappedSession(c)
+	if s == nil || s.Id.Hex() != session.Get(SessionIdKey) || s.UserAgent != "Browser" {
+		t.Errorf("Expected the session to be mapped but got %v", s)
+	}
+
+	// LastSeenAt is saved once in a while.
+	s.LastSeenAt = time.Now().Add(-time.Hour)
+	storage.Sessions.Touch(s)
+	sessionRequest(storage, session)
+	if saved, _ := storage.Sessions.Get(s.Id.Hex()); time.Since(saved.LastSeenAt) > time.Minute {
+		t.Errorf("Expected LastSeenAt to be updated but got %v", saved.LastSeenAt)
+	}
+
+	// Idle sessions expire.
+	s.LastSeenAt = time.Now().Add(-SessionIdleTimeout)
+	storage.Sessions.Touch(s)
+	w, c = sessionRequest(storage, session)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/auth" || mappedUser(c) != nil {
+		t.Errorf("Expected to redirect to /auth for an expired session but got %d", w.Code)
+	}
+	if session.Get(SessionUserIdKey) != nil || session.Get(SessionIdKey) != nil {
+		t.Error("Expected to log out")
+	}
+	if _, err := storage.Sessions.Get(s.Id.Hex()); err != ErrNotFound {
+		t.Errorf("Expected the expired session to be removed but got %v", err)
+	}
+}
+
+func Test_Authorize_revokedSession(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	r, _ := http.NewRequest("GET", "/", nil)
+	session := &mockSession{v: make(map[interface{}]interface{})}
+	logIn(r, storage.Sessions, session, user)
+	storage.Sessions.RemoveByUser(user)
+
+	w, c := sessionRequest(storage, session)
+	if w.Code != http.StatusFound || mappedUser(c) != nil {
+		t.Errorf("Expected to redirect for a revoked session but got %d", w.Code)
+	}
+
+	// Cookies without sessions are from before sessions were saved.
+	session = &mockSession{v: map[interface{}]interface{}{SessionUserIdKey: user.Id.Hex()}}
+	if w, _ := sessionRequest(storage, session); w.Code != http.StatusFound {
+		t.Errorf("Expected to redirect without a session but got %d", w.Code)
+	}
+
+	// A session of another user doesn't work.
+	other, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "5678"})
+	session = &mockSession{v: make(map[interface{}]interface{})}
+	logIn(r, storage.Sessions, session, other)
+	session.Set(SessionUserIdKey, user.Id.Hex())
+	if w, _ := sessionRequest(storage, session); w.Code != http.StatusFound {
+		t.Errorf("Expected to redirect with a session of another user but got %d", w.Code)
+	}
+}
+
+func Test_Logout_session(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	r, _ := http.NewRequest("GET", "/", nil)
+	session := &mockSession{v: make(map[interface{}]interface{})}
+	logIn(r, storage.Sessions, session, user)
+
+	w := httptest.NewRecorder()
+	Logout(&web.Context{Request: r, ResponseWriter: w}, storage.Sessions, session)
+	if ss, _ := storage.Sessions.FindByUser(user); len(ss) != 0 {
+		t.Errorf("Expected the session to be removed but got %v", ss)
+	}
+	if session.Get(SessionIdKey) != nil {
+		t.Error("Expected to delete the session ID")
+	}
+}
+
+func Test_ListSessions(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	r, _ := http.NewRequest("GET", "/", nil)
+	now := time.Now()
+	current := newLoginSession(user, r, now)
+	other := newLoginSession(user, r, now.Add(-time.Hour))
+	expired := newLoginSession(user, r, now.Add(-SessionMaxAge))
+	for _, s := range []*LoginSession{current, other, expired} {
+		storage.Sessions.Create(s)
+	}
+
+	render := &mockRender{}
+	ctx := &web.Context{Request: r, ResponseWriter: httptest.NewRecorder()}
+	ListSessions(ctx, render, storage.Sessions, current, user)
+	infos := render.v.([]sessionInfo)
+	if len(infos) != 2 || infos[0].Id != current.Id || !infos[0].Current || infos[1].Id != other.Id || infos[1].Current {
+		t.Errorf("Expected the sessions that haven't expired but got %v", infos)
+	}
+}
+
+func Test_RevokeSession(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	other, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "5678"})
+	r, _ := http.NewRequest("DELETE", "/", nil)
+	s := newLoginSession(user, r, time.Now())
+	storage.Sessions.Create(s)
+	l := log.New(os.Stdout, "", 0)
+
+	revoke := func(user *User) (*httptest.ResponseRecorder, *mockRender) {
+		w := httptest.NewRecorder()
+		render := &mockRender{}
+		RevokeSession(&web.Context{Request: r, ResponseWriter: w}, render, storage.Sessions, martini.Params{"id": s.Id.Hex()}, user, l)
+		return w, render
+	}
+
+	if w, _ := revoke(other); w.Code != http.StatusNotFound {
+		t.Errorf("Expected %d for another user's session but got %d", http.StatusNotFound, w.Code)
+	}
+	if _, render := revoke(user); render.status != 200 {
+		t.Errorf("Expected %d but got %d", 200, render.status)
+	}
+	if _, err := storage.Sessions.Get(s.Id.Hex()); err != ErrNotFound {
+		t.Errorf("Expected the session to be revoked but got %v", err)
+	}
+}
+
+func Test_RevokeOtherSessions(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	r, _ := http.NewRequest("POST", "/account/sessions/revoke-others", nil)
+	current := newLoginSession(user, r, time.Now())
+	storage.Sessions.Create(current)
+	storage.Sessions.Create(newLoginSession(user, r, time.Now()))
+	storage.Sessions.Create(newLoginSession(user, r, time.Now()))
+
+	w := httptest.NewRecorder()
+	RevokeOtherSessions(&web.Context{Request: r, ResponseWriter: w}, storage.Sessions, current, user, log.New(os.Stdout, "", 0))
+	if w.Code != http.StatusFound {
+		t.Errorf("Expected to redirect but got %d", w.Code)
+	}
+	if ss, _ := storage.Sessions.FindByUser(user); len(ss) != 1 || ss[0].Id != current.Id {
+		t.Errorf("Expected only the current session to be left but got %v", ss)
+	}
+}
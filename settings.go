@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/codegangsta/martini-contrib/web"
+	"io/ioutil"
+	"net/http"
+)
+
+const MaxDailyGoal = 100000
+
+// Settings is the part of User that users can change by themselves.
+type Settings struct {
+	Timezone     string `json:"timezone"`
+	DayStartHour int    `json:"dayStartHour"`
+	EditMode     string `json:"editMode"`
+	GraceMinutes int    `json:"graceMinutes"`
+
+	ExcludeWhitespace  bool `json:"excludeWhitespace"`
+	ExcludePunctuation bool `json:"excludePunctuation"`
+
+	DailyGoal int `json:"dailyGoal"`
+}
+
+func settingsOf(user *User) *Settings {
+	timezone := user.Timezone
+	if timezone == "" {
+		timezone = DefaultTimezone
+	}
+	policy := editPolicyOf(user)
+	return &Settings{
+		Timezone:     timezone,
+		DayStartHour: user.DayStartHour,
+		EditMode:     policy.Mode,
+		GraceMinutes: policy.GraceMinutes,
+
+		ExcludeWhitespace:  user.ExcludeWhitespace,
+		ExcludePunctuation: user.ExcludePunctuation,
+
+		DailyGoal: user.Goal(),
+	}
+}
+
+// validate returns a message for the user if the settings are invalid.
+func (settings *Settings) validate() string {
+	if _, err := loadLocation(settings.Timezone); err != nil {
+		return "Unknown timezone. e.g. Asia/Tokyo"
+	}
+	if settings.DayStartHour < 0 || 23 < settings.DayStartHour {
+		return "Day start hour should be between 0 and 23"
+	}
+	if !isValidEditMode(settings.EditMode) {
+		return "Edit mode should be one of strict, grace and always"
+	}
+	if settings.GraceMinutes < 1 || MaxGraceMinutes < settings.GraceMinutes {
+		return "Grace minutes should be between 1 and 720"
+	}
+	if settings.DailyGoal < 1 || MaxDailyGoal < settings.DailyGoal {
+		return "Daily goal should be between 1 and 100000"
+	}
+	return ""
+}
+
+func (settings *Settings) apply(user *User) {
+	user.Timezone = settings.Timezone
+	user.DayStartHour = settings.DayStartHour
+	user.EditMode = settings.EditMode
+	user.GraceMinutes = settings.GraceMinutes
+	user.ExcludeWhitespace = settings.ExcludeWhitespace
+	user.ExcludePunctuation = settings.ExcludePunctuation
+	user.DailyGoal = settings.DailyGoal
+}
+
+// recountEntries counts the characters of the user's entries again after the
+// count options change so that stats don't mix two ways of counting. Entries
+// saved meanwhile are counted again.
+func recountEntries(entries EntryStore, user *User) error {
+	return eachEntry(entries, user, func(entry *Entry) error {
+		for {
+			count := entry.Count
+			entry.recount(user)
+			if entry.Count == count {
+				return nil
+			}
+			err := entries.Update(entry)
+			if err != ErrConflict {
+				return err
+			}
+			entry, err = entries.Find(user, entry.Date)
+			if entry == nil || err != nil {
+				return err
+			}
+		}
+	})
+}
+
+//
+// JSON APIs
+//
+
+func GetSettings(ren render.Render, user *User) {
+	ren.JSON(200, settingsOf(user))
+}
+
+func UpdateSettings(ctx *web.Context, ren render.Render, users UserStore, entries EntryStore, user *User) {
+	requestBody, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Fields missing in the request keep their current values.
+	settings := settingsOf(user)
+	err = json.Unmarshal(requestBody, settings)
+	if err != nil {
+		ctx.Abort(http.StatusBadRequest, err.Error())
+		return
+	}
+	if message := settings.validate(); message != "" {
+		ctx.Abort(http.StatusBadRequest, message)
+		return
+	}
+
+	recount := settings.ExcludeWhitespace != user.ExcludeWhitespace || settings.ExcludePunctuation != user.ExcludePunctuation
+	settings.apply(user)
+	err = users.Update(user)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if recount {
+		err = recountEntries(entries, user)
+		if err != nil {
+			ctx.Abort(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	ren.JSON(200, settings)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/codegangsta/martini-contrib/web"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Mock UserStore
+//
+type mockUserStore struct {
+	updated *User
+}
+
+func (store *mockUserStore) Get(userId string) (*User, error) {
+	return nil, nil
+}
+func (store *mockUserStore) FindByIdentity(identity *Identity) (*User, error) {
+	return nil, nil
+}
+func (store *mockUserStore) CreateByIdentity(identity *Identity) (*User, error) {
+	return nil, nil
+}
+func (store *mockUserStore) Create(user *User) error {
+	return nil
+}
+func (store *mockUserStore) Update(user *User) error {
+	store.updated = user
+	return nil
+}
+func (store *mockUserStore) Remove(user *User) error {
+	return nil
+}
+func (store *mockUserStore) RecordFailedLogin(user *User, max int, lockedUntil time.Time) error {
+	return nil
+}
+func (store *mockUserStore) ResetFailedLogins(user *User) error {
+	return nil
+}
+func (store *mockUserStore) SetPasswordReset(user *User, reset *PasswordReset) error {
+	return nil
+}
+func (store *mockUserStore) SetPassword(user *User, hash string) error {
+	return nil
+}
+
+func Test_settingsOf_default(t *testing.T) {
+	settings := settingsOf(&User{})
+	if settings.Timezone != DefaultTimezone {
+		t.Errorf("Expected %s but got %s", DefaultTimezone, settings.Timezone)
+	}
+}
+
+func Test_UpdateSettings(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("PUT", "/settings", strings.NewReader(`{"timezone": "Europe/Berlin"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	render := &mockRender{}
+	users := &mockUserStore{}
+	user := &User{Id: bson.NewObjectId()}
+	UpdateSettings(ctx, render, users, openMemoryStorage().Entries, user)
+
+	if render.status != 200 {
+		t.Errorf("Expected %d but got %d", 200, render.status)
+	}
+	if users.updated != user {
+		t.Error("Expected to update the user but didn't")
+	}
+	expected := "Europe/Berlin"
+	if user.Timezone != expected {
+		t.Errorf("Expected %s but got %s", expected, user.Timezone)
+	}
+}
+
+func Test_UpdateSettings_unknownTimezone(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("PUT", "/settings", strings.NewReader(`{"timezone": "Mars/Olympus"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	render := &mockRender{}
+	users := &mockUserStore{}
+	UpdateSettings(ctx, render, users, openMemoryStorage().Entries, &User{})
+
+	if w.Code != 400 {
+		t.Errorf("Expected %d but got %d", 400, w.Code)
+	}
+	if users.updated != nil {
+		t.Error("Expected not to update the user but did")
+	}
+}
+
+func Test_UpdateSettings_invalidDayStartHour(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("PUT", "/settings", strings.NewReader(`{"dayStartHour": 24}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	render := &mockRender{}
+	users := &mockUserStore{}
+	UpdateSettings(ctx, render, users, openMemoryStorage().Entries, &User{})
+
+	if w.Code != 400 {
+		t.Errorf("Expected %d but got %d", 400, w.Code)
+	}
+}
+
+func Test_UpdateSettings_recount(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	user.DailyGoal = 11
+	saveEntry(t, storage, user, "2014-04-01", "Hello, World")
+	saveEntry(t, storage, user, "2014-04-02", "Hello")
+
+	r, _ := http.NewRequest("PUT", "/settings", strings.NewReader(`{"excludeWhitespace": true, "excludePunctuation": true}`))
+	ctx := &web.Context{Request: r, ResponseWriter: httptest.NewRecorder()}
+	render := &mockRender{}
+	UpdateSettings(ctx, render, storage.Users, storage.Entries, user)
+	if render.status != 200 {
+		t.Fatalf("Expected %d but got %d", 200, render.status)
+	}
+
+	summaries, _ := storage.Entries.Summaries(user)
+	if len(summaries) != 2 || summaries[0].Count != 10 || summaries[0].GoalMet || summaries[1].Count != 5 {
+		t.Errorf("Expected the entries to be counted with the new options but got %v", summaries)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/codegangsta/martini-contrib/web"
+	"net/http"
+	"time"
+)
+
+// PeriodTotal sums up entries in a month such as "2014-04" or a year such as
+// "2014".
+type PeriodTotal struct {
+	Period     string `json:"period"`
+	Days       int    `json:"days"`
+	Characters int    `json:"characters"`
+}
+
+type Stats struct {
+	CurrentStreak   int     `json:"currentStreak"`
+	LongestStreak   int     `json:"longestStreak"`
+	TotalDays       int     `json:"totalDays"`
+	TotalCharacters int     `json:"totalCharacters"`
+	AveragePerDay   float64 `json:"averagePerDay"`
+	// Days the daily goal was met.
+	GoalDays     int `json:"goalDays"`
+	DailyGoal    int `json:"dailyGoal"`
+	YearlyTarget int `json:"yearlyTarget"`
+	// Time spent on typing, and the speed over entries with the time recorded.
+	ActiveSeconds  int     `json:"activeSeconds"`
+	CharsPerMinute float64 `json:"charsPerMinute"`
+
+	Monthly []PeriodTotal `json:"monthly"`
+	Yearly  []PeriodTotal `json:"yearly"`
+}
+
+// computeStats computes stats from summaries sorted by date. Only days with
+// some characters count as written. The current streak continues until the
+// end of today even if today's page is not written yet.
+func computeStats(summaries []EntrySummary, today string, dailyGoal int) *Stats {
+	stats := &Stats{
+		DailyGoal:    dailyGoal,
+		YearlyTarget: dailyGoal * 365,
+		Monthly:      []PeriodTotal{},
+		Yearly:       []PeriodTotal{},
+	}
+
+	streak := 0
+	lastDate := ""
+	timedCharacters := 0
+	for _, summary := range summaries {
+		if summary.Count <= 0 {
+			continue
+		}
+
+		stats.TotalDays++
+		if summary.GoalMet {
+			stats.GoalDays++
+		}
+		stats.TotalCharacters += summary.Count
+		if summary.ActiveSeconds > 0 {
+			stats.ActiveSeconds += summary.ActiveSeconds
+			timedCharacters += summary.Count
+		}
+		stats.Monthly = addToPeriod(stats.Monthly, summary.Date[:7], summary.Count)
+		stats.Yearly = addToPeriod(stats.Yearly, summary.Date[:4], summary.Count)
+
+		if lastDate != "" && addDays(lastDate, 1) == summary.Date {
+			streak++
+		} else {
+			streak = 1
+		}
+		if streak > stats.LongestStreak {
+			stats.LongestStreak = streak
+		}
+		lastDate = summary.Date
+	}
+
+	if lastDate == today || lastDate == addDays(today, -1) {
+		stats.CurrentStreak = streak
+	}
+	if stats.TotalDays > 0 {
+		stats.AveragePerDay = float64(stats.TotalCharacters) / float64(stats.TotalDays)
+	}
+	stats.CharsPerMinute = charsPerMinute(timedCharacters, stats.ActiveSeconds)
+	return stats
+}
+
+// addToPeriod adds characters of a day to the last period, or a new period.
+func addToPeriod(totals []PeriodTotal, period string, characters int) []PeriodTotal {
+	if len(totals) == 0 || totals[len(totals)-1].Period != period {
+		totals = append(totals, PeriodTotal{Period: period})
+	}
+	total := &totals[len(totals)-1]
+	total.Days++
+	total.Characters += characters
+	return totals
+}
+
+// addDays returns the date string of days after the date.
+func addDays(date string, days int) string {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return ""
+	}
+	return dateStringOfTime(t.AddDate(0, 0, days))
+}
+
+//
+// JSON APIs
+//
+
+func GetStats(ctx *web.Context, ren render.Render, entries EntryStore, user *User) {
+	summaries, err := entries.Summaries(user)
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	ren.JSON(200, computeStats(summaries, user.Today(), user.Goal()))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_computeStats(t *testing.T) {
+	summaries := []EntrySummary{
+		{"2013-12-30", 1000, false, 0},
+		{"2013-12-31", 2000, true, 1200},
+		{"2014-01-01", 3000, true, 1800},
+		{"2014-01-02", 0, false, 0},
+		{"2014-01-03", 500, false, 0},
+		{"2014-01-04", 1500, false, 900},
+	}
+	stats := computeStats(summaries, "2014-01-05", 2000)
+
+	if stats.CurrentStreak != 2 {
+		t.Errorf("Expected current streak %d but got %d", 2, stats.CurrentStreak)
+	}
+	if stats.LongestStreak != 3 {
+		t.Errorf("Expected longest streak %d but got %d", 3, stats.LongestStreak)
+	}
+	if stats.TotalDays != 5 {
+		t.Errorf("Expected total days %d but got %d", 5, stats.TotalDays)
+	}
+	if stats.TotalCharacters != 8000 {
+		t.Errorf("Expected total characters %d but got %d", 8000, stats.TotalCharacters)
+	}
+	if stats.AveragePerDay != 1600 {
+		t.Errorf("Expected average %f but got %f", 1600.0, stats.AveragePerDay)
+	}
+	if stats.GoalDays != 2 {
+		t.Errorf("Expected goal days %d but got %d", 2, stats.GoalDays)
+	}
+	if stats.YearlyTarget != 730000 {
+		t.Errorf("Expected yearly target %d but got %d", 730000, stats.YearlyTarget)
+	}
+	if stats.ActiveSeconds != 3900 {
+		t.Errorf("Expected active seconds %d but got %d", 3900, stats.ActiveSeconds)
+	}
+	// 6500 characters in 65 minutes. Entries without time don't count.
+	if stats.CharsPerMinute != 100 {
+		t.Errorf("Expected %f characters per minute but got %f", 100.0, stats.CharsPerMinute)
+	}
+
+	expectedMonthly := []PeriodTotal{{"2013-12", 2, 3000}, {"2014-01", 3, 5000}}
+	if len(stats.Monthly) != len(expectedMonthly) {
+		t.Fatalf("Expected %v but got %v", expectedMonthly, stats.Monthly)
+	}
+	for i, total := range expectedMonthly {
+		if stats.Monthly[i] != total {
+			t.Errorf("Expected %v but got %v", total, stats.Monthly[i])
+		}
+	}
+	expectedYearly := []PeriodTotal{{"2013", 2, 3000}, {"2014", 3, 5000}}
+	if len(stats.Yearly) != len(expectedYearly) {
+		t.Fatalf("Expected %v but got %v", expectedYearly, stats.Yearly)
+	}
+	for i, total := range expectedYearly {
+		if stats.Yearly[i] != total {
+			t.Errorf("Expected %v but got %v", total, stats.Yearly[i])
+		}
+	}
+}
+
+func Test_computeStats_brokenStreak(t *testing.T) {
+	summaries := []EntrySummary{{"2014-01-01", 100, false, 0}, {"2014-01-02", 100, false, 0}}
+	stats := computeStats(summaries, "2014-01-04", 2000)
+	if stats.CurrentStreak != 0 {
+		t.Errorf("Expected current streak %d but got %d", 0, stats.CurrentStreak)
+	}
+	if stats.LongestStreak != 2 {
+		t.Errorf("Expected longest streak %d but got %d", 2, stats.LongestStreak)
+	}
+}
+
+func Test_computeStats_empty(t *testing.T) {
+	stats := computeStats(nil, "2014-01-04", 2000)
+	if stats.TotalDays != 0 || stats.AveragePerDay != 0 || stats.CurrentStreak != 0 {
+		t.Errorf("Expected empty stats but got %v", stats)
+	}
+}
+
+func Test_addDays(t *testing.T) {
+	if d := addDays("2014-02-28", 1); d != "2014-03-01" {
+		t.Errorf("Expected %s but got %s", "2014-03-01", d)
+	}
+	if d := addDays("2014-01-01", -1); d != "2013-12-31" {
+		t.Errorf("Expected %s but got %s", "2013-12-31", d)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"time"
+)
+
+// Writing time is reported by the editor and can't be trusted as is: a client
+// with a wrong clock or a bug must not make a page look written in no time.
+
+// A first keystroke reported longer ago than this is ignored.
+const maxWritingSession = 24 * time.Hour
+
+// recordWritingTime updates the timing fields of the entry being saved at now
+// with the ones reported by the editor in input. The first keystroke is kept
+// once recorded, and active time only grows, by no more than the time passed
+// since the previous save.
+func (entry *Entry) recordWritingTime(input *Entry, now time.Time) {
+	if entry.StartedAt == nil {
+		started := now
+		if input.StartedAt != nil && input.StartedAt.Before(now) && now.Sub(*input.StartedAt) < maxWritingSession {
+			started = *input.StartedAt
+		}
+		entry.StartedAt = &started
+	}
+
+	since := *entry.StartedAt
+	if entry.SavedAt != nil && entry.SavedAt.After(since) {
+		since = *entry.SavedAt
+	}
+	if gained := input.ActiveSeconds - entry.ActiveSeconds; gained > 0 {
+		elapsed := int(now.Sub(since) / time.Second)
+		if gained > elapsed {
+			gained = elapsed
+		}
+		if gained > 0 {
+			entry.ActiveSeconds += gained
+		}
+	}
+
+	entry.SavedAt = &now
+}
+
+// charsPerMinute returns the writing speed, or 0 if the time is unknown.
+func charsPerMinute(count, activeSeconds int) float64 {
+	if activeSeconds <= 0 {
+		return 0
+	}
+	return float64(count) * 60 / float64(activeSeconds)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Entry_recordWritingTime(t *testing.T) {
+	now := time.Date(2014, 4, 1, 7, 0, 0, 0, time.UTC)
+	started := now.Add(-10 * time.Minute)
+	entry := &Entry{}
+
+	entry.recordWritingTime(&Entry{StartedAt: &started, ActiveSeconds: 300}, now)
+	if !entry.StartedAt.Equal(started) {
+		t.Errorf("Expected %v but got %v", started, entry.StartedAt)
+	}
+	if !entry.SavedAt.Equal(now) {
+		t.Errorf("Expected %v but got %v", now, entry.SavedAt)
+	}
+	if entry.ActiveSeconds != 300 {
+		t.Errorf("Expected %d but got %d", 300, entry.ActiveSeconds)
+	}
+
+	// Active time never decreases, and the first keystroke is kept.
+	later := now.Add(time.Minute)
+	entry.recordWritingTime(&Entry{StartedAt: &later, ActiveSeconds: 100}, later)
+	if !entry.StartedAt.Equal(started) {
+		t.Errorf("Expected %v but got %v", started, entry.StartedAt)
+	}
+	if entry.ActiveSeconds != 300 {
+		t.Errorf("Expected %d but got %d", 300, entry.ActiveSeconds)
+	}
+
+	// No more than the time since the previous save.
+	entry.recordWritingTime(&Entry{ActiveSeconds: 3600}, later.Add(2*time.Minute))
+	if entry.ActiveSeconds != 420 {
+		t.Errorf("Expected %d but got %d", 420, entry.ActiveSeconds)
+	}
+}
+
+func Test_Entry_recordWritingTime_invalidStart(t *testing.T) {
+	now := time.Date(2014, 4, 1, 7, 0, 0, 0, time.UTC)
+	for _, started := range []time.Time{now.Add(time.Hour), now.AddDate(0, 0, -2)} {
+		entry := &Entry{}
+		entry.recordWritingTime(&Entry{StartedAt: &started, ActiveSeconds: 60}, now)
+		if !entry.StartedAt.Equal(now) {
+			t.Errorf("Expected %v but got %v", now, entry.StartedAt)
+		}
+		if entry.ActiveSeconds != 0 {
+			t.Errorf("Expected %d but got %d", 0, entry.ActiveSeconds)
+		}
+	}
+}
+
+func Test_charsPerMinute(t *testing.T) {
+	if cpm := charsPerMinute(1500, 900); cpm != 100 {
+		t.Errorf("Expected %f but got %f", 100.0, cpm)
+	}
+	if cpm := charsPerMinute(1500, 0); cpm != 0 {
+		t.Errorf("Expected %f but got %f", 0.0, cpm)
+	}
+}
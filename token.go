@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/codegangsta/martini-contrib/web"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Personal access tokens let scripts and editors call the JSON APIs with
+// "Authorization: Bearer <token>" instead of the session cookie.
+//
+
+const TokenCollectionName = "tokens"
+
+// A token with the read scope can GET, and one with the write scope can do
+// everything else.
+const (
+	TokenScopeRead  = "read"
+	TokenScopeWrite = "write"
+)
+
+// Tokens look like "mp_..." so that they are easy to find in leaked code.
+const tokenPrefix = "mp_"
+
+const MaxTokenNameLength = 100
+
+var (
+	ErrInvalidTokenName   = fmt.Errorf("Token name must be 1 to %d characters", MaxTokenNameLength)
+	ErrInvalidTokenScopes = errors.New("Choose read, write or both scopes")
+	ErrInvalidTokenExpiry = errors.New("Expiry must be a positive number of days")
+)
+
+type ApiToken struct {
+	Id     bson.ObjectId `bson:"_id" json:"id"`
+	UserId bson.ObjectId `bson:"user_id" json:"-"`
+	Name   string        `bson:"name" json:"name"`
+	// SHA-256 of the token. The token itself is shown only when it's created.
+	Hash      string    `bson:"hash" json:"-"`
+	Scopes    []string  `bson:"scopes" json:"scopes"`
+	CreatedAt time.Time `bson:"created_at" json:"createdAt"`
+	// Never expires if nil.
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expiresAt,omitempty"`
+}
+
+// newApiToken returns a token of the user and its secret. expiresIn of 0
+// means that it never expires.
+func newApiToken(user *User, name string, scopes []string, expiresIn time.Duration, now time.Time) (*ApiToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > MaxTokenNameLength {
+		return nil, "", ErrInvalidTokenName
+	}
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+	secret = tokenPrefix + secret
+
+	token := &ApiToken{
+		Id:        bson.NewObjectId(),
+		UserId:    user.Id,
+		Name:      name,
+		Hash:      hashToken(secret),
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	if expiresIn > 0 {
+		expiresAt := now.Add(expiresIn)
+		token.ExpiresAt = &expiresAt
+	}
+	return token, secret, nil
+}
+
+// normalizeScopes returns the known scopes sorted without duplicates.
+func normalizeScopes(scopes []string) ([]string, error) {
+	set := make(map[string]bool)
+	for _, scope := range scopes {
+		if scope != TokenScopeRead && scope != TokenScopeWrite {
+			return nil, ErrInvalidTokenScopes
+		}
+		set[scope] = true
+	}
+	if len(set) == 0 {
+		return nil, ErrInvalidTokenScopes
+	}
+	var normalized []string
+	for scope := range set {
+		normalized = append(normalized, scope)
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+func (token *ApiToken) IsExpired(now time.Time) bool {
+	return token.ExpiresAt != nil && !now.Before(*token.ExpiresAt)
+}
+
+func (token *ApiToken) HasScope(scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token in the Authorization header if any.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+//
+// Store
+//
+
+type TokenStore interface {
+	// FindByHash returns ErrNotFound if no token has the hash.
+	FindByHash(hash string) (*ApiToken, error)
+	// FindByUser returns the user's tokens, newest first.
+	FindByUser(user *User) ([]ApiToken, error)
+	Create(token *ApiToken) error
+	// Remove returns ErrNotFound unless the user has the token.
+	Remove(user *User, id string) error
+	RemoveByUser(user *User) error
+}
+
+type tokenStore struct {
+	db *mgo.Database
+}
+
+func (store *tokenStore) FindByHash(hash string) (*ApiToken, error) {
+	var token ApiToken
+	err := store.db.C(TokenCollectionName).Find(bson.M{"hash": hash}).One(&token)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &token, nil
+}
+
+func (store *tokenStore) FindByUser(user *User) ([]ApiToken, error) {
+	var tokens []ApiToken
+	err := store.db.C(TokenCollectionName).Find(bson.M{"user_id": user.Id}).Sort("-created_at").All(&tokens)
+	return tokens, err
+}
+
+func (store *tokenStore) Create(token *ApiToken) error {
+	return store.db.C(TokenCollectionName).Insert(token)
+}
+
+func (store *tokenStore) Remove(user *User, id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+	err := store.db.C(TokenCollectionName).Remove(bson.M{"_id": bson.ObjectIdHex(id), "user_id": user.Id})
+	return notFound(err)
+}
+
+func (store *tokenStore) RemoveByUser(user *User) error {
+	_, err := store.db.C(TokenCollectionName).RemoveAll(bson.M{"user_id": user.Id})
+	return err
+}
+
+//
+// Filters
+//
+
+// authorizeToken maps the user of the bearer token. Tokens are checked
+// instead of the session so that a bad token is never mistaken for the
+// browser's login.
+func authorizeToken(ctx *web.Context, c martini.Context, users UserStore, tokens TokenStore, secret string) {
+	ctx.SetHeader("WWW-Authenticate", `Bearer realm="morning_pages"`, true)
+	token, err := tokens.FindByHash(hashToken(secret))
+	if err == ErrNotFound || (err == nil && token.IsExpired(time.Now())) {
+		ctx.Abort(http.StatusUnauthorized, "Invalid or expired token")
+		return
+	}
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	scope := TokenScopeWrite
+	if isSafeMethod(ctx.Request.Method) {
+		scope = TokenScopeRead
+	}
+	if !token.HasScope(scope) {
+		ctx.Abort(http.StatusForbidden, fmt.Sprintf("The token doesn't have the %s scope", scope))
+		return
+	}
+
+	user, err := users.Get(token.UserId.Hex())
+	if err != nil {
+		ctx.Abort(http.StatusUnauthorized, "Invalid or expired token")
+		return
+	}
+	c.Map(user)
+}
+
+// SessionOnly rejects requests with tokens. For managing the account, which
+// tokens shouldn't be able to do.
+func SessionOnly(ctx *web.Context) {
+	if _, ok := bearerToken(ctx.Request); ok {
+		ctx.Abort(http.StatusForbidden, "Not available with tokens")
+	}
+}
+
+//
+// Handlers
+//
+
+// parseTokenExpiry parses expires_days. Tokens never expire only if it's
+// empty.
+func parseTokenExpiry(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days <= 0 {
+		return 0, ErrInvalidTokenExpiry
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+func CreateToken(ctx *web.Context, ren render.Render, providers IdentityProviders, tokens TokenStore, logins SessionStore, csrfToken CsrfToken, current *LoginSession, user *User, l *log.Logger) {
+	r := ctx.Request
+	r.ParseForm()
+	var token *ApiToken
+	var secret string
+	expiresIn, err := parseTokenExpiry(r.PostForm.Get("expires_days"))
+	if err == nil {
+		token, secret, err = newApiToken(user, r.PostForm.Get("name"), r.PostForm["scopes"], expiresIn, time.Now())
+	}
+	if err == nil {
+		err = tokens.Create(token)
+	}
+
+	data, dataErr := accountData(providers, tokens, logins, csrfToken, current, user)
+	if dataErr != nil {
+		ctx.Abort(http.StatusInternalServerError, dataErr.Error())
+		return
+	}
+	if err != nil {
+		data["TokenError"] = err.Error()
+		ren.HTML(http.StatusBadRequest, "account", data)
+		return
+	}
+	l.Println("Created a token", token.Id.Hex(), "of", user.Id.Hex())
+	data["NewToken"] = secret
+	ren.HTML(200, "account", data)
+}
+
+func RevokeToken(ctx *web.Context, tokens TokenStore, params martini.Params, user *User, l *log.Logger) {
+	err := tokens.Remove(user, params["id"])
+	if err == ErrNotFound {
+		ctx.Abort(http.StatusNotFound, "Token not found")
+		return
+	}
+	if err != nil {
+		ctx.Abort(http.StatusInternalServerError, err.Error())
+		return
+	}
+	l.Println("Revoked a token", params["id"], "of", user.Id.Hex())
+	ctx.Redirect(http.StatusFound, "/account")
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"github.com/codegangsta/inject"
+	"github.com/codegangsta/martini"
+	"github.com/codegangsta/martini-contrib/web"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newApiToken(t *testing.T) {
+	user := &User{Id: "user"}
+	now := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	token, secret, err := newApiToken(user, " CLI ", []string{"write", "read", "write"}, 24*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, tokenPrefix) || token.Hash != hashToken(secret) {
+		t.Errorf("Expected the hash of the secret but got %s and %s", secret, token.Hash)
+	}
+	if token.UserId != user.Id || token.Name != "CLI" || !reflect.DeepEqual(token.Scopes, []string{"read", "write"}) {
+		t.Errorf("Expected the user, name and scopes but got %v", token)
+	}
+	if token.IsExpired(now.Add(24*time.Hour-time.Second)) || !token.IsExpired(now.Add(24*time.Hour)) {
+		t.Errorf("Expected to expire in a day but got %v", token.ExpiresAt)
+	}
+
+	forever, _, _ := newApiToken(user, "Editor", []string{"read"}, 0, now)
+	if forever.ExpiresAt != nil || forever.IsExpired(now.Add(10*365*24*time.Hour)) {
+		t.Errorf("Expected not to expire but got %v", forever.ExpiresAt)
+	}
+
+	if _, _, err := newApiToken(user, " ", []string{"read"}, 0, now); err != ErrInvalidTokenName {
+		t.Errorf("Expected ErrInvalidTokenName but got %v", err)
+	}
+	if _, _, err := newApiToken(user, strings.Repeat("a", MaxTokenNameLength+1), []string{"read"}, 0, now); err != ErrInvalidTokenName {
+		t.Errorf("Expected ErrInvalidTokenName for a long name but got %v", err)
+	}
+	if _, _, err := newApiToken(user, "CLI", nil, 0, now); err != ErrInvalidTokenScopes {
+		t.Errorf("Expected ErrInvalidTokenScopes without scopes but got %v", err)
+	}
+	if _, _, err := newApiToken(user, "CLI", []string{"admin"}, 0, now); err != ErrInvalidTokenScopes {
+		t.Errorf("Expected ErrInvalidTokenScopes for an unknown scope but got %v", err)
+	}
+}
+
+func Test_bearerToken(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected string
+		ok       bool
+	}{
+		{"", "", false},
+		{"Basic dXNlcjpwYXNz", "", false},
+		{"Bearer mp_abc", "mp_abc", true},
+		{"bearer  mp_abc ", "mp_abc", true},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "/entries", nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		if token, ok := bearerToken(r); token != c.expected || ok != c.ok {
+			t.Errorf("Expected %q and %v for %q but got %q and %v", c.expected, c.ok, c.header, token, ok)
+		}
+	}
+}
+
+func tokenRequest(storage *Storage, method, secret string) (*httptest.ResponseRecorder, *mockContext) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(method, "/entries/2014-06-01", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	ctx := &web.Context{Request: r, ResponseWriter: w}
+	c := &mockContext{inject.New()}
+	session := &mockSession{v: make(map[interface{}]interface{})}
+	l := log.New(os.Stdout, "", 0)
+	Authorize(ctx, storage.Users, storage.Tokens, storage.Sessions, c, session, l)
+	return w, c
+}
+
+func mappedUser(c martini.Context) *User {
+	v := c.Get(reflect.TypeOf(&User{}))
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Interface().(*User)
+}
+
+func Test_Authorize_token(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	now := time.Now()
+	read, readSecret, _ := newApiToken(user, "Read", []string{TokenScopeRead}, 0, now)
+	storage.Tokens.Create(read)
+	write, writeSecret, _ := newApiToken(user, "Write", []string{TokenScopeWrite}, 0, now)
+	storage.Tokens.Create(write)
+	expired, expiredSecret, _ := newApiToken(user, "Expired", []string{TokenScopeRead}, time.Hour, now.Add(-2*time.Hour))
+	storage.Tokens.Create(expired)
+
+	cases := []struct {
+		method, secret string
+		expected       int
+	}{
+		{"GET", readSecret, http.StatusOK},
+		{"PUT", readSecret, http.StatusForbidden},
+		{"PUT", writeSecret, http.StatusOK},
+		{"GET", writeSecret, http.StatusForbidden},
+		{"GET", expiredSecret, http.StatusUnauthorized},
+		{"GET", "mp_unknown", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		w, ctx := tokenRequest(storage, c.method, c.secret)
+		if w.Code != c.expected {
+			t.Errorf("Expected %d for %s with %s but got %d", c.expected, c.method, c.secret, w.Code)
+		}
+		mapped := mappedUser(ctx)
+		if c.expected == http.StatusOK && (mapped == nil || mapped.Id != user.Id) {
+			t.Errorf("Expected the user to be mapped but got %v", mapped)
+		}
+		if c.expected != http.StatusOK && mapped != nil {
+			t.Errorf("Expected no user to be mapped but got %v", mapped)
+		}
+	}
+
+	// The token of a deleted user is invalid.
+	storage.Users.Remove(user)
+	if w, _ := tokenRequest(storage, "GET", readSecret); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d for a deleted user but got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func Test_Csrf_bearer(t *testing.T) {
+	session := &mockSession{v: map[interface{}]interface{}{SessionCsrfTokenKey: "TOKEN"}}
+	r, _ := http.NewRequest("PUT", "/entries/2014-06-01", nil)
+	r.Header.Set("Authorization", "Bearer mp_abc")
+	if w, _ := csrfRequest(session, r); w.Code != http.StatusOK {
+		t.Errorf("Expected requests with tokens to pass but got %d", w.Code)
+	}
+}
+
+func Test_SessionOnly(t *testing.T) {
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/account", nil)
+	r.Header.Set("Authorization", "Bearer mp_abc")
+	SessionOnly(&web.Context{Request: r, ResponseWriter: w})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected %d but got %d", http.StatusForbidden, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/account", nil)
+	SessionOnly(&web.Context{Request: r, ResponseWriter: w})
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected sessions to pass but got %d", w.Code)
+	}
+}
+
+func Test_CreateToken(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	l := log.New(os.Stdout, "", 0)
+
+	create := func(form url.Values) *mockRender {
+		r, _ := http.NewRequest("POST", "/account/tokens", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := &web.Context{Request: r, ResponseWriter: httptest.NewRecorder()}
+		render := &mockRender{}
+		CreateToken(ctx, render, IdentityProviders{}, storage.Tokens, storage.Sessions, "TOKEN", nil, user, l)
+		return render
+	}
+
+	render := create(url.Values{"name": {"CLI"}, "scopes": {"read", "write"}, "expires_days": {"30"}})
+	if render.status != 200 || render.name != "account" {
+		t.Fatalf("Expected the account page but got %d %s", render.status, render.name)
+	}
+	data := render.v.(map[string]interface{})
+	secret, _ := data["NewToken"].(string)
+	token, err := storage.Tokens.FindByHash(hashToken(secret))
+	if err != nil {
+		t.Fatalf("Expected the new token to be shown but got %v", err)
+	}
+	if token.ExpiresAt == nil || token.ExpiresAt.Sub(token.CreatedAt) != 30*24*time.Hour {
+		t.Errorf("Expected to expire in 30 days but got %v", token.ExpiresAt)
+	}
+	if ts := data["ApiTokens"].([]ApiToken); len(ts) != 1 || ts[0].Name != "CLI" {
+		t.Errorf("Expected the token in the list but got %v", ts)
+	}
+
+	render = create(url.Values{"name": {"No scopes"}})
+	if render.status != http.StatusBadRequest || render.v.(map[string]interface{})["TokenError"] != ErrInvalidTokenScopes.Error() {
+		t.Errorf("Expected the error but got %d %v", render.status, render.v)
+	}
+	if ts, _ := storage.Tokens.FindByUser(user); len(ts) != 1 {
+		t.Errorf("Expected no token to be created but got %v", ts)
+	}
+
+	for _, days := range []string{"0", "-1", "forever"} {
+		render = create(url.Values{"name": {"CLI"}, "scopes": {"read"}, "expires_days": {days}})
+		if render.status != http.StatusBadRequest || render.v.(map[string]interface{})["TokenError"] != ErrInvalidTokenExpiry.Error() {
+			t.Errorf("Expected %q to be rejected but got %d %v", days, render.status, render.v)
+		}
+	}
+	if ts, _ := storage.Tokens.FindByUser(user); len(ts) != 1 {
+		t.Errorf("Expected no token to be created but got %v", ts)
+	}
+
+	render = create(url.Values{"name": {"Forever"}, "scopes": {"read"}, "expires_days": {""}})
+	secret, _ = render.v.(map[string]interface{})["NewToken"].(string)
+	token, err = storage.Tokens.FindByHash(hashToken(secret))
+	if err != nil || token.ExpiresAt != nil {
+		t.Errorf("Expected a token that never expires but got %v %v", token, err)
+	}
+}
+
+func Test_RevokeToken(t *testing.T) {
+	storage := openMemoryStorage()
+	user, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "1234"})
+	other, _ := storage.Users.CreateByIdentity(&Identity{Provider: "facebook", Subject: "5678"})
+	token, _, _ := newApiToken(user, "CLI", []string{TokenScopeRead}, 0, time.Now())
+	storage.Tokens.Create(token)
+	l := log.New(os.Stdout, "", 0)
+
+	revoke := func(user *User) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/account/tokens/"+token.Id.Hex()+"/revoke", nil)
+		ctx := &web.Context{Request: r, ResponseWriter: w}
+		RevokeToken(ctx, storage.Tokens, martini.Params{"id": token.Id.Hex()}, user, l)
+		return w
+	}
+
+	if w := revoke(other); w.Code != http.StatusNotFound {
+		t.Errorf("Expected %d for another user's token but got %d", http.StatusNotFound, w.Code)
+	}
+	if w := revoke(user); w.Code != http.StatusFound || w.Header().Get("Location") != "/account" {
+		t.Errorf("Expected to redirect to the account page but got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if _, err := storage.Tokens.FindByHash(token.Hash); err != ErrNotFound {
+		t.Errorf("Expected the token to be revoked but got %v", err)
+	}
+}